@@ -12,6 +12,8 @@ func CreateWorker(id string) daemons.Worker {
 	switch id {
 	case "cron_job":
 		return daemons.NewCronJob()
+	case "cancel_on_disconnect":
+		return daemons.NewCancelOnDisconnect()
 	default:
 		return nil
 	}
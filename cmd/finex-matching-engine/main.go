@@ -14,6 +14,7 @@ import (
 
 	"github.com/zsmartex/finex/config"
 	engine "github.com/zsmartex/finex/server"
+	"github.com/zsmartex/finex/server/bookrpc"
 )
 
 func main() {
@@ -25,7 +26,19 @@ func main() {
 	server := engine.NewEngineServer()
 	grpcServer := grpc.NewServer()
 
-	consumer, err := services.NewKafkaConsumer(strings.Split(os.Getenv("KAFKA_URL"), ","), uuid.NewString(), []string{"matching"})
+	// With snapshots the offsets are committed once they are on disk, the consumer group
+	// must be kept between restarts to resume right after the latest snapshot. Every instance
+	// consumes the whole topic so each one needs its own ENGINE_GROUP_ID, instances sharing
+	// a group would split the partitions between them.
+	group_id := uuid.NewString()
+	if engine.SnapshotEnabled() {
+		group_id = os.Getenv("ENGINE_GROUP_ID")
+		if len(group_id) == 0 {
+			group_id = "finex-matching-engine"
+		}
+	}
+
+	consumer, err := services.NewKafkaConsumer(strings.Split(os.Getenv("KAFKA_URL"), ","), group_id, []string{"matching"})
 	if err != nil {
 		panic(err)
 	}
@@ -45,13 +58,33 @@ func main() {
 				}
 
 				config.Logger.Debugf("Recevie message from topic: %s payload: %s", record.Topic, string(record.Value))
-				err := server.Process(record.Value)
+				err := server.ProcessRecord(record.Partition, record.Offset, record.Value)
 
 				if err != nil {
 					config.Logger.Fatalf("Worker error: %v", err.Error())
 				}
 
-				consumer.CommitRecords(*record)
+				if server.Journal != nil && server.Journal.CheckpointDue() {
+					server.WriteCheckpoint()
+				}
+
+				if !engine.SnapshotEnabled() {
+					consumer.CommitRecords(*record)
+					continue
+				}
+
+				if server.SnapshotDue() {
+					if err := server.TakeSnapshot(); err != nil {
+						config.Logger.Errorf("Failed to write engine snapshot: %v", err)
+						continue
+					}
+
+					consumer.CommitRecords(*record)
+				}
+			}
+
+			if err := server.FlushProcessed(); err != nil {
+				config.Logger.Fatalf("Failed to write processed offsets: %v", err)
 			}
 		}
 	}()
@@ -64,6 +97,7 @@ func main() {
 	}
 
 	GrpcEngine.RegisterMatchingEngineServiceServer(grpcServer, server)
+	bookrpc.RegisterBookServiceServer(grpcServer, server)
 
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %s", err)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/zsmartex/pkg/services"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
+	engine "github.com/zsmartex/finex/server"
+)
+
+// finex-replay runs a journal written by finex-matching-engine through fresh engines,
+// it needs neither Kafka, Redis nor Quantex.
+func main() {
+	until := flag.Int64("until", 0, "stop after the entry with this sequence")
+	verbose := flag.Bool("v", false, "print the books at the end of the replay")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <journal>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config.Logger = services.NewLoggerService("Finex")
+
+	replayer := engine.NewReplayer(os.Stdout)
+
+	errStop := fmt.Errorf("stop")
+	err := engine.ReadJournal(flag.Arg(0), func(entry *engine.JournalEntry) error {
+		if *until > 0 && entry.Sequence > *until {
+			return errStop
+		}
+
+		return replayer.Apply(entry)
+	})
+	if err != nil && err != errStop {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if *verbose {
+		engines := make([]*matching.Engine, 0)
+		for _, e := range replayer.Engines {
+			engines = append(engines, e)
+		}
+		sort.Slice(engines, func(i, j int) bool {
+			return engines[i].Symbol.String() < engines[j].Symbol.String()
+		})
+
+		for _, e := range engines {
+			snapshot, err := e.Snapshot()
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s market price %s\n", e.Symbol.String(), snapshot.MarketPrice)
+			for _, o := range snapshot.Asks {
+				fmt.Printf("  ask %d %s@%s filled %s\n", o.ID, o.Quantity, o.Price, o.FilledQuantity)
+			}
+			for _, o := range snapshot.Bids {
+				fmt.Printf("  bid %d %s@%s filled %s\n", o.ID, o.Quantity, o.Price, o.FilledQuantity)
+			}
+		}
+	}
+
+	fmt.Printf("%d entries replayed, %d mismatches\n", replayer.Entries, replayer.Mismatches)
+
+	if replayer.Mismatches > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/zsmartex/pkg"
+	"github.com/zsmartex/pkg/services"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
+	engine "github.com/zsmartex/finex/server"
+	"github.com/zsmartex/finex/types"
+)
+
+// finex-sim runs an order flow through an offline engine and writes its trades, the events of
+// its orders and snapshots of its depth to trades.jsonl, orders.jsonl and depth.jsonl. It needs
+// neither Kafka, Postgres, Redis nor Influx.
+func main() {
+	base_currency := flag.String("base", "", "base currency of the market")
+	quote_currency := flag.String("quote", "", "quote currency of the market")
+	market_price := flag.String("market-price", "0", "price of the last trade before the order flow")
+	price_precision := flag.Int("price-precision", matching.DEFAULT_PRECISION, "number of decimals of the prices")
+	amount_precision := flag.Int("amount-precision", matching.DEFAULT_PRECISION, "number of decimals of the quantities")
+	matching_algorithm := flag.String("matching-algorithm", string(types.MatchingAlgorithmFIFO), "fifo, pro_rata or pro_rata_top_order")
+	self_trade_prevention := flag.String("self-trade-prevention", string(types.SelfTradePreventionNone), "self trade prevention of the market")
+	price_band := flag.String("price-band", "0", "largest deviation from the market price in percent, 0 for none")
+	depth_interval := flag.Duration("depth-interval", time.Second, "order flow time between two depth snapshots, 0 for the last one only")
+	depth_levels := flag.Int64("depth-levels", 20, "price levels of each side in the depth snapshots")
+	out := flag.String("out", ".", "directory the outputs are written to")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <order flow .csv or .jsonl>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || len(*base_currency) == 0 || len(*quote_currency) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config.Logger = services.NewLoggerService("Finex")
+
+	market_config := matching.DefaultMarketConfig()
+	market_config.PricePrecision = int32(*price_precision)
+	market_config.AmountPrecision = int32(*amount_precision)
+	market_config.MatchingAlgorithm = types.MatchingAlgorithm(*matching_algorithm)
+	market_config.SelfTradePrevention = types.SelfTradePrevention(*self_trade_prevention)
+	market_config.PriceBand = decimal.RequireFromString(*price_band)
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	outputs := make([]*os.File, 0, 3)
+	for _, name := range []string{"trades.jsonl", "orders.jsonl", "depth.jsonl"} {
+		file, err := os.Create(filepath.Join(*out, name))
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		defer file.Close()
+
+		outputs = append(outputs, file)
+	}
+
+	simulator := engine.NewSimulator(engine.SimulatorConfig{
+		Symbol:        pkg.Symbol{BaseCurrency: *base_currency, QuoteCurrency: *quote_currency},
+		MarketPrice:   decimal.RequireFromString(*market_price),
+		MarketConfig:  market_config,
+		DepthInterval: *depth_interval,
+		DepthLevels:   *depth_levels,
+	}, outputs[0], outputs[1], outputs[2])
+
+	err := engine.ReadOrderFlow(flag.Arg(0), simulator.Apply)
+	if err == nil {
+		err = simulator.Finish()
+	}
+
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d events simulated, %d trades, %d order events\n", simulator.Events, simulator.Trades, simulator.OrderEvents)
+}
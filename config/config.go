@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
 	"github.com/zsmartex/finex/types"
 	"github.com/zsmartex/pkg/services"
@@ -19,6 +20,9 @@ var RangoClient *services.RangoClient
 var Referral *types.Referral
 var Redis *services.RedisClient
 
+// RedisCommands runs the commands services.RedisClient doesn't wrap, sorted sets and scripts.
+var RedisCommands *redis.Client
+
 func InitializeConfig() error {
 	Logger = services.NewLoggerService("Finex")
 	db, err := NewDatabase()
@@ -42,6 +46,11 @@ func InitializeConfig() error {
 		return err
 	}
 
+	RedisCommands, err = NewRedisCommands(os.Getenv("REDIS_URL"))
+	if err != nil {
+		return err
+	}
+
 	if err := NewInfluxDB(); err != nil {
 		return err
 	}
@@ -62,3 +71,17 @@ func InitializeConfig() error {
 
 	return nil
 }
+
+// NewRedisCommands connects to REDIS_URL, a redis:// URL or the address of the server.
+func NewRedisCommands(url string) (*redis.Client, error) {
+	if !strings.Contains(url, "://") {
+		return redis.NewClient(&redis.Options{Addr: url}), nil
+	}
+
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return redis.NewClient(options), nil
+}
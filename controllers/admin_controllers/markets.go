@@ -0,0 +1,49 @@
+package admin_controllers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/controllers/admin_controllers/queries"
+	"github.com/zsmartex/finex/controllers/helpers"
+	"github.com/zsmartex/finex/matching"
+	"github.com/zsmartex/finex/models"
+)
+
+// UpdateMarketTradingState halts a market, makes it cancel only or post only, or resumes its trading.
+// The matching engine keeps the book of the market whatever its state is.
+func UpdateMarketTradingState(c *fiber.Ctx) error {
+	var payload queries.TradingStatePayload
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(422).JSON(helpers.Errors{
+			Errors: []string{"server.method.invalid_message_body"},
+		})
+	}
+
+	if !payload.State.IsValid() {
+		return c.Status(422).JSON(helpers.Errors{
+			Errors: []string{"admin.market.invalid_trading_state"},
+		})
+	}
+
+	var market *models.Market
+	if result := config.DataBase.First(&market, "symbol = ?", c.Params("market")); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(helpers.Errors{
+			Errors: []string{"record.not_found"},
+		})
+	}
+
+	market.TradingState = payload.State
+	config.DataBase.Model(&market).Update("trading_state", payload.State)
+
+	config.KafkaProducer.Produce("matching", map[string]interface{}{
+		"action":        matching.ActionSetTradingState,
+		"symbol":        market.GetSymbol(),
+		"trading_state": payload.State,
+	})
+
+	return c.Status(200).JSON(market)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/zsmartex/finex/controllers/entities"
 	"github.com/zsmartex/finex/controllers/helpers"
 	"github.com/zsmartex/finex/controllers/queries"
+	"github.com/zsmartex/finex/matching"
 	"github.com/zsmartex/finex/models"
 	"github.com/zsmartex/finex/types"
 	"github.com/zsmartex/pkg"
@@ -33,6 +34,12 @@ func CancelOrder(c *fiber.Ctx) error {
 		})
 	}
 
+	if market := order.Market(); !market.TradingState.AcceptsCancels() {
+		return c.Status(422).JSON(helpers.Errors{
+			Errors: []string{"admin.order.market_halted"},
+		})
+	}
+
 	// Doing cancel
 	config.KafkaProducer.Produce("matching", map[string]interface{}{
 		"action": pkg.ActionCancel,
@@ -42,8 +49,10 @@ func CancelOrder(c *fiber.Ctx) error {
 	return c.Status(200).JSON(order.ToJSON())
 }
 
+// CancelAllOrders cancels the open orders of any member matching the filters with a mass cancel
+// run by the matching engines and answers how many orders they cancelled. The orders of the
+// markets which don't accept cancels are kept.
 func CancelAllOrders(c *fiber.Ctx) error {
-	var orders []*models.Order
 	params := new(queries.CancelOrderParams)
 
 	if err := c.BodyParser(params); err != nil {
@@ -52,43 +61,43 @@ func CancelAllOrders(c *fiber.Ctx) error {
 		})
 	}
 
-	tx := config.DataBase.Where("state = ?", models.StateWait)
+	var symbol pkg.Symbol
+	mass_cancel := &matching.MassCancel{
+		PriceFrom: params.PriceFrom,
+		PriceTo:   params.PriceTo,
+	}
 
 	if len(params.Market) > 0 {
-		tx = tx.Where("market_id = ?", params.Market)
+		var market *models.Market
+		if result := config.DataBase.First(&market, "symbol = ?", params.Market); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return c.Status(422).JSON(helpers.Errors{
+				Errors: []string{"admin.orders.invalid_market"},
+			})
+		}
+
+		symbol = market.GetSymbol()
 	}
 
 	if len(params.Side) > 0 {
-		var nSide models.OrderSide
-
 		if params.Side == types.TypeBuy {
-			nSide = models.SideBuy
+			mass_cancel.Side = pkg.SideBuy
 		} else if params.Side == types.TypeSell {
-			nSide = models.SideSell
+			mass_cancel.Side = pkg.SideSell
 		} else {
 			return c.Status(422).JSON(helpers.Errors{
 				Errors: []string{"admin.orders.invalid_side"},
 			})
 		}
-
-		tx = tx.Where("type = ?", nSide)
 	}
 
-	tx.Find(&orders)
+	count, err := helpers.MassCancel(c.Context(), symbol, mass_cancel)
+	if err != nil {
+		config.Logger.Errorf("Failed to fetch the result of mass cancel %s, Error: %v", mass_cancel.RequestID, err)
 
-	for _, order := range orders {
-		// Doing cancel
-		config.KafkaProducer.Produce("matching", map[string]interface{}{
-			"action": pkg.ActionCancel,
-			"order":  order.ToMatchingAttributes(),
+		return c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.internal_error"},
 		})
 	}
 
-	var ordersJSON []entities.OrderEntity
-
-	for _, order := range orders {
-		ordersJSON = append(ordersJSON, order.ToJSON())
-	}
-
-	return c.Status(201).JSON(ordersJSON)
+	return c.Status(201).JSON(entities.MassCancelEntity{Count: count})
 }
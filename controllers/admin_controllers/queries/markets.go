@@ -0,0 +1,9 @@
+package queries
+
+import (
+	"github.com/zsmartex/finex/types"
+)
+
+type TradingStatePayload struct {
+	State types.TradingState `json:"state"`
+}
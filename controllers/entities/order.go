@@ -13,14 +13,25 @@ type OrderEntity struct {
 	Market          string              `json:"market"`
 	Side            string              `json:"side"`
 	OrdType         types.OrderType     `json:"ord_type"`
+	TimeInForce     types.TimeInForce   `json:"time_in_force"`
 	Price           decimal.NullDecimal `json:"price"`
 	StopPrice       decimal.NullDecimal `json:"stop_price"`
 	AvgPrice        decimal.Decimal     `json:"avg_price"`
 	State           string              `json:"state"`
 	OriginVolume    decimal.Decimal     `json:"origin_volume"`
+	DisplayVolume   decimal.NullDecimal `json:"display_volume"`
+	TrailingOffset  decimal.NullDecimal `json:"trailing_offset"`
+	TrailingPercent decimal.NullDecimal `json:"trailing_percent"`
+	OcoUUID         *uuid.UUID          `json:"oco_uuid,omitempty"`
+	QuoteVolume     decimal.NullDecimal `json:"quote_volume"`
 	RemainingVolume decimal.Decimal     `json:"remaining_volume"`
 	ExecutedVolume  decimal.Decimal     `json:"executed_volume"`
 	TradesCount     int64               `json:"trades_count"`
 	CreatedAt       time.Time           `json:"created_at"`
 	UpdatedAt       time.Time           `json:"updated_at"`
 }
+
+// MassCancelEntity is the number of orders the matching engines cancelled for a mass cancel.
+type MassCancelEntity struct {
+	Count int64 `json:"count"`
+}
@@ -30,6 +30,8 @@ func VaildateMessage(prefix string) map[string]string {
 		"ValidateOrderState": prefix + ".invalid_{field}",
 		"ValidateType":       prefix + ".invalid_{field}",
 		"ValidateOrderBy":    prefix + ".invalid_{field}",
+		"ValidateGroup":      prefix + ".invalid_{field}",
+		"ValidateTimeout":    prefix + ".invalid_{field}",
 	}
 }
 
@@ -46,6 +48,10 @@ func VaildateTranslateFields() map[string]string {
 		"TimeFrom":  "time_from",
 		"TimeTo":    "time_to",
 		"OrderBy":   "order_by",
+		"Group":     "group",
+		"From":      "from",
+		"To":        "to",
+		"Timeout":   "timeout",
 	}
 }
 
@@ -55,6 +61,8 @@ func ValidateOrderState(val string) bool {
 		return true
 	case "wait":
 		return true
+	case "trigger_wait":
+		return true
 	case "cancel":
 		return true
 	case "done":
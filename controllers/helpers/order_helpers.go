@@ -1,39 +1,54 @@
 package helpers
 
 import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
 	"github.com/gookit/validate"
 	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
 
 	"github.com/zsmartex/pkg"
 	GrpcEngine "github.com/zsmartex/pkg/Grpc/engine"
 	GrpcSymbol "github.com/zsmartex/pkg/Grpc/symbol"
-	GrpcUtils "github.com/zsmartex/pkg/Grpc/utils"
 	clientEngine "github.com/zsmartex/pkg/client/engine"
 
 	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
 	"github.com/zsmartex/finex/models"
+	"github.com/zsmartex/finex/server/bookrpc"
 	"github.com/zsmartex/finex/types"
 )
 
 type CreateOrderParams struct {
-	Market    string              `json:"market" form:"market" validate:"required"`
-	Side      types.OrderSide     `json:"side" form:"side" validate:"required|VaildateSide"`
-	OrdType   types.OrderType     `json:"ord_type" form:"ord_type" validate:"VaildateOrdType"`
-	Price     decimal.NullDecimal `json:"price" form:"price" validate:"VaildatePrice"`
-	StopPrice decimal.NullDecimal `json:"stop_price" form:"stop_price" validate:"VaildateStopPrice"`
-	Quantity  decimal.NullDecimal `json:"quantity" form:"quantity"`
-	Volume    decimal.NullDecimal `json:"volume" form:"volume"`
+	Market          string              `json:"market" form:"market" validate:"required"`
+	Side            types.OrderSide     `json:"side" form:"side" validate:"required|VaildateSide"`
+	OrdType         types.OrderType     `json:"ord_type" form:"ord_type" validate:"VaildateOrdType"`
+	Price           decimal.NullDecimal `json:"price" form:"price" validate:"VaildatePrice"`
+	StopPrice       decimal.NullDecimal `json:"stop_price" form:"stop_price" validate:"VaildateStopPrice"`
+	Quantity        decimal.NullDecimal `json:"quantity" form:"quantity"`
+	Volume          decimal.NullDecimal `json:"volume" form:"volume" validate:"VaildateVolume"`
+	TimeInForce     types.TimeInForce   `json:"time_in_force" form:"time_in_force" validate:"VaildateTimeInForce"`
+	DisplayQuantity decimal.NullDecimal `json:"display_quantity" form:"display_quantity" validate:"VaildateDisplayQuantity"`
+	TrailingOffset  decimal.NullDecimal `json:"trailing_offset" form:"trailing_offset" validate:"VaildateTrailingOffset"`
+	TrailingPercent decimal.NullDecimal `json:"trailing_percent" form:"trailing_percent" validate:"VaildateTrailingPercent"`
 }
 
 func (p CreateOrderParams) Messages() map[string]string {
 	invalid_message := "market.order.invalid_{field}"
 
 	return validate.MS{
-		"required":          invalid_message,
-		"VaildateSide":      invalid_message,
-		"VaildatePrice":     "market.order.non_positive_price",
-		"VaildateStopPrice": "market.order.non_positive_stop_price",
-		"VaildateVolume":    "market.order.non_positive_volume",
+		"required":                invalid_message,
+		"VaildateSide":            invalid_message,
+		"VaildatePrice":           "market.order.non_positive_price",
+		"VaildateStopPrice":       "market.order.non_positive_stop_price",
+		"VaildateVolume":          "market.order.non_positive_volume",
+		"VaildateTimeInForce":     "market.order.invalid_time_in_force",
+		"VaildateDisplayQuantity": "market.order.invalid_display_quantity",
+		"VaildateTrailingOffset":  "market.order.invalid_trailing_offset",
+		"VaildateTrailingPercent": "market.order.invalid_trailing_percent",
 	}
 }
 
@@ -54,17 +69,70 @@ func (p CreateOrderParams) VaildateStopPrice(StopPrice decimal.NullDecimal) bool
 }
 
 func (p CreateOrderParams) VaildateOrdType(OrdType types.OrderType) bool {
-	if OrdType == types.TypeMarket && (p.Price.Valid || p.StopPrice.Valid) {
-		return false
-	} else if OrdType == types.TypeLimit && !p.Price.Valid {
+	trailing := p.TrailingOffset.Valid || p.TrailingPercent.Valid
+
+	switch OrdType {
+	case types.TypeMarket:
+		return !p.Price.Valid && !p.StopPrice.Valid && !trailing
+	case "", types.TypeLimit:
+		return p.Price.Valid && !p.StopPrice.Valid && !trailing
+	case types.TypeStopLimit:
+		return p.Price.Valid && p.StopPrice.Valid && !trailing
+	case types.TypeStopMarket:
+		return !p.Price.Valid && p.StopPrice.Valid && !trailing
+	case types.TypeTrailingStop:
+		return !p.Price.Valid && !p.StopPrice.Valid && p.TrailingOffset.Valid != p.TrailingPercent.Valid
+	default:
 		return false
 	}
+}
+
+func (p CreateOrderParams) VaildateTrailingOffset(TrailingOffset decimal.NullDecimal) bool {
+	if TrailingOffset.Valid {
+		return p.OrdType == types.TypeTrailingStop && TrailingOffset.Decimal.IsPositive()
+	}
+
+	return true
+}
+
+func (p CreateOrderParams) VaildateTrailingPercent(TrailingPercent decimal.NullDecimal) bool {
+	if TrailingPercent.Valid {
+		return p.OrdType == types.TypeTrailingStop && TrailingPercent.Decimal.IsPositive() && TrailingPercent.Decimal.LessThan(decimal.NewFromInt(100))
+	}
 
 	return true
 }
 
-func (p CreateOrderParams) VaildateVolume(Volume decimal.Decimal) bool {
-	return Volume.IsPositive()
+func (p CreateOrderParams) VaildateTimeInForce(TimeInForce types.TimeInForce) bool {
+	switch TimeInForce {
+	case "", types.TimeInForceGTC, types.TimeInForceIOC, types.TimeInForceFOK:
+		return true
+	case types.TimeInForcePostOnly:
+		return !p.OrdType.IsMarket()
+	default:
+		return false
+	}
+}
+
+func (p CreateOrderParams) VaildateDisplayQuantity(DisplayQuantity decimal.NullDecimal) bool {
+	if !DisplayQuantity.Valid {
+		return true
+	}
+
+	if p.OrdType.IsMarket() || p.TimeInForce == types.TimeInForceIOC || p.TimeInForce == types.TimeInForceFOK {
+		return false
+	}
+
+	return DisplayQuantity.Decimal.IsPositive() && DisplayQuantity.Decimal.LessThan(p.Quantity.Decimal)
+}
+
+// VaildateVolume only accepts a quote volume on buy market orders, in place of their quantity.
+func (p CreateOrderParams) VaildateVolume(Volume decimal.NullDecimal) bool {
+	if !Volume.Valid {
+		return true
+	}
+
+	return p.OrdType == types.TypeMarket && p.Side == types.SideBuy && !p.Quantity.Valid && Volume.Decimal.IsPositive()
 }
 
 func (p CreateOrderParams) VaildateSide(val types.OrderSide) bool {
@@ -97,6 +165,14 @@ func (p CreateOrderParams) BuildOrder(member *models.Member, err_src *Errors) *m
 		p.OrdType = types.TypeLimit
 	}
 
+	if len(p.TimeInForce) == 0 {
+		p.TimeInForce = types.TimeInForceGTC
+	}
+
+	if !p.VaildateTradingState(market, err_src) {
+		return nil
+	}
+
 	trading_fee := models.TradingFeeFor(member.Group, "spot", market.Symbol)
 	var quantity decimal.Decimal
 	var locked decimal.Decimal
@@ -115,18 +191,27 @@ func (p CreateOrderParams) BuildOrder(member *models.Member, err_src *Errors) *m
 
 		symbol := market.GetSymbol()
 
-		calc_market_order_response, err := matching_client.CalcMarketOrder(&GrpcEngine.CalcMarketOrderRequest{
+		calc_market_order_request := &GrpcEngine.CalcMarketOrderRequest{
 			Symbol: &GrpcSymbol.Symbol{BaseCurrency: symbol.BaseCurrency, QuoteCurrency: symbol.QuoteCurrency},
 			Side:   string(side),
-			Quantity: &GrpcUtils.Decimal{
-				Val: p.Quantity.Decimal.CoefficientInt64(),
-				Exp: p.Quantity.Decimal.Exponent(),
-			},
-			// Volume: &engineGrpc.Decimal{
-			// 	Val: p.Volume.Decimal.CoefficientInt64(),
-			// 	Exp: p.Volume.Decimal.Exponent(),
-			// },
-		})
+		}
+
+		var err error
+		if p.Volume.Valid {
+			if calc_market_order_request.Volume, err = matching.GrpcDecimal(p.Volume.Decimal); err != nil {
+				err_src.Errors = append(err_src.Errors, "market.order.invalid_volume")
+
+				return nil
+			}
+		} else {
+			if calc_market_order_request.Quantity, err = matching.GrpcDecimal(p.Quantity.Decimal); err != nil {
+				err_src.Errors = append(err_src.Errors, "market.order.invalid_quantity")
+
+				return nil
+			}
+		}
+
+		calc_market_order_response, err := matching_client.CalcMarketOrder(calc_market_order_request)
 		if err != nil {
 			err_src.Errors = append(err_src.Errors, "market.order.insufficient_market_liquidity")
 
@@ -139,6 +224,28 @@ func (p CreateOrderParams) BuildOrder(member *models.Member, err_src *Errors) *m
 		if quantity.IsZero() || locked.IsZero() {
 			err_src.Errors = append(err_src.Errors, "market.order.insufficient_market_liquidity")
 		}
+
+		// an order placed by quote volume locks exactly its volume, its quantity is what its trades buy
+		if p.Volume.Valid {
+			quantity = decimal.Zero
+			locked = p.Volume.Decimal
+		}
+	} else if p.OrdType.IsMarket() {
+		// stop market orders lock their funds at their trigger price, a buy order triggered higher
+		// stops matching once it spent what it locked
+		quantity = p.Quantity.Decimal
+		if p.Side == types.SideBuy {
+			trigger_price, ok := p.TriggerPrice(market)
+			if !ok {
+				err_src.Errors = append(err_src.Errors, "market.order.market_has_no_price")
+
+				return nil
+			}
+
+			locked = trigger_price.Mul(p.Quantity.Decimal)
+		} else {
+			locked = p.Quantity.Decimal
+		}
 	} else {
 		quantity = p.Quantity.Decimal
 		if p.Side == types.SideBuy {
@@ -153,22 +260,47 @@ func (p CreateOrderParams) BuildOrder(member *models.Member, err_src *Errors) *m
 	}
 
 	order := &models.Order{
-		MemberID:     member.ID,
-		Ask:          market.BaseUnit,
-		Bid:          market.QuoteUnit,
-		MarketID:     market.Symbol,
-		MarketType:   types.AccountTypeSpot,
-		OrdType:      p.OrdType,
-		State:        models.StatePending,
-		Type:         order_side,
-		Price:        p.Price,
-		StopPrice:    p.StopPrice,
-		Volume:       quantity,
-		MakerFee:     trading_fee.Maker,
-		TakerFee:     trading_fee.Taker,
-		OriginVolume: quantity,
-		Locked:       locked,
-		OriginLocked: locked,
+		MemberID:        member.ID,
+		Ask:             market.BaseUnit,
+		Bid:             market.QuoteUnit,
+		MarketID:        market.Symbol,
+		MarketType:      types.AccountTypeSpot,
+		OrdType:         p.OrdType,
+		TimeInForce:     p.TimeInForce,
+		State:           models.StatePending,
+		Type:            order_side,
+		Price:           p.Price,
+		StopPrice:       p.StopPrice,
+		Volume:          quantity,
+		MakerFee:        trading_fee.Maker,
+		TakerFee:        trading_fee.Taker,
+		OriginVolume:    quantity,
+		DisplayVolume:   p.DisplayQuantity,
+		TrailingOffset:  p.TrailingOffset,
+		TrailingPercent: p.TrailingPercent,
+		QuoteVolume:     p.Volume,
+		Locked:          locked,
+		OriginLocked:    locked,
+	}
+
+	// the total of a buy order is what it locks, a sell order without limit or stop price
+	// only knows its total once it traded
+	notional := locked
+	if p.Side == types.SideSell {
+		switch {
+		case p.Price.Valid:
+			notional = p.Price.Decimal.Mul(quantity)
+		case p.StopPrice.Valid:
+			notional = p.StopPrice.Decimal.Mul(quantity)
+		default:
+			notional = decimal.Zero
+		}
+	}
+
+	// the trading rules are checked first for their error codes
+	err_src.Errors = append(err_src.Errors, order.TradingRulesErrors(market, notional)...)
+	if err_src.Size() > 0 {
+		return nil
 	}
 
 	Vaildate(order, err_src)
@@ -176,6 +308,60 @@ func (p CreateOrderParams) BuildOrder(member *models.Member, err_src *Errors) *m
 	return order
 }
 
+// VaildateTradingState checks the market accepts the order in its trading state,
+// a post only market only accepts limit orders which can rest in the book.
+func (p CreateOrderParams) VaildateTradingState(market models.Market, err_src *Errors) bool {
+	if !market.TradingState.AcceptsOrders() {
+		err_src.Errors = append(err_src.Errors, TradingStateError(market.TradingState))
+
+		return false
+	}
+
+	if market.TradingState == types.TradingStatePostOnly && (p.OrdType != types.TypeLimit || p.TimeInForce == types.TimeInForceIOC || p.TimeInForce == types.TimeInForceFOK) {
+		err_src.Errors = append(err_src.Errors, TradingStateError(market.TradingState))
+
+		return false
+	}
+
+	return true
+}
+
+// TradingStateError is the error of the requests refused by the trading state of a market.
+func TradingStateError(state types.TradingState) string {
+	return "market.order.market_" + string(state)
+}
+
+// TriggerPrice returns the highest price a buy stop market order can be triggered at,
+// the trigger price of a buy trailing stop only goes down from the current market price.
+func (p CreateOrderParams) TriggerPrice(market models.Market) (decimal.Decimal, bool) {
+	if p.OrdType == types.TypeStopMarket {
+		return p.StopPrice.Decimal, true
+	}
+
+	matching_client := clientEngine.NewMatchingClient()
+	defer matching_client.Close()
+
+	symbol := market.GetSymbol()
+
+	fetch_market_price_response, err := matching_client.FetchMarketPrice(&GrpcEngine.FetchMarketPriceRequest{
+		Symbol: &GrpcSymbol.Symbol{BaseCurrency: symbol.BaseCurrency, QuoteCurrency: symbol.QuoteCurrency},
+	})
+	if err != nil {
+		return decimal.Zero, false
+	}
+
+	market_price := fetch_market_price_response.Price.ToDecimal()
+	if !market_price.IsPositive() {
+		return decimal.Zero, false
+	}
+
+	if p.TrailingOffset.Valid {
+		return market_price.Add(p.TrailingOffset.Decimal), true
+	}
+
+	return market_price.Add(market_price.Mul(p.TrailingPercent.Decimal).Div(decimal.NewFromInt(100))), true
+}
+
 func (p CreateOrderParams) CreateOrder(member *models.Member, err_src *Errors) (order *models.Order) {
 	order = p.BuildOrder(member, err_src)
 
@@ -196,3 +382,247 @@ func (p CreateOrderParams) CreateOrder(member *models.Member, err_src *Errors) (
 
 	return order
 }
+
+// CreateOcoOrderParams is a limit order and a stop order placed together as an OCO pair,
+// the stop order is a stop limit order when StopLimitPrice is given and a stop market order otherwise.
+type CreateOcoOrderParams struct {
+	Market         string              `json:"market" form:"market" validate:"required"`
+	Side           types.OrderSide     `json:"side" form:"side" validate:"required|VaildateSide"`
+	Quantity       decimal.NullDecimal `json:"quantity" form:"quantity"`
+	Price          decimal.NullDecimal `json:"price" form:"price" validate:"VaildatePrice"`
+	StopPrice      decimal.NullDecimal `json:"stop_price" form:"stop_price" validate:"VaildateStopPrice"`
+	StopLimitPrice decimal.NullDecimal `json:"stop_limit_price" form:"stop_limit_price" validate:"VaildateStopLimitPrice"`
+}
+
+func (p CreateOcoOrderParams) Messages() map[string]string {
+	invalid_message := "market.order.invalid_{field}"
+
+	return validate.MS{
+		"required":               invalid_message,
+		"VaildateSide":           invalid_message,
+		"VaildatePrice":          "market.order.non_positive_price",
+		"VaildateStopPrice":      "market.order.invalid_stop_price",
+		"VaildateStopLimitPrice": "market.order.non_positive_stop_limit_price",
+	}
+}
+
+func (p CreateOcoOrderParams) VaildateSide(val types.OrderSide) bool {
+	return p.Side == types.SideBuy || p.Side == types.SideSell
+}
+
+func (p CreateOcoOrderParams) VaildatePrice(Price decimal.NullDecimal) bool {
+	return Price.Valid && Price.Decimal.IsPositive()
+}
+
+// VaildateStopPrice checks the stop order is on the other side of the market than the limit order,
+// below it for a sell pair and above it for a buy pair.
+func (p CreateOcoOrderParams) VaildateStopPrice(StopPrice decimal.NullDecimal) bool {
+	if !StopPrice.Valid || !StopPrice.Decimal.IsPositive() {
+		return false
+	}
+
+	if p.Side == types.SideSell {
+		return StopPrice.Decimal.LessThan(p.Price.Decimal)
+	}
+
+	return StopPrice.Decimal.GreaterThan(p.Price.Decimal)
+}
+
+func (p CreateOcoOrderParams) VaildateStopLimitPrice(StopLimitPrice decimal.NullDecimal) bool {
+	if StopLimitPrice.Valid {
+		return StopLimitPrice.Decimal.IsPositive()
+	}
+
+	return true
+}
+
+func (p CreateOcoOrderParams) LimitOrderParams() CreateOrderParams {
+	return CreateOrderParams{
+		Market:   p.Market,
+		Side:     p.Side,
+		OrdType:  types.TypeLimit,
+		Price:    p.Price,
+		Quantity: p.Quantity,
+	}
+}
+
+func (p CreateOcoOrderParams) StopOrderParams() CreateOrderParams {
+	params := CreateOrderParams{
+		Market:    p.Market,
+		Side:      p.Side,
+		OrdType:   types.TypeStopMarket,
+		StopPrice: p.StopPrice,
+		Quantity:  p.Quantity,
+	}
+
+	if p.StopLimitPrice.Valid {
+		params.OrdType = types.TypeStopLimit
+		params.Price = p.StopLimitPrice
+	}
+
+	return params
+}
+
+// CreateOrders creates both orders of the pair and submits them, the member only needs
+// the funds of the largest one since they are locked once for the pair.
+func (p CreateOcoOrderParams) CreateOrders(member *models.Member, err_src *Errors) (limit_order *models.Order, stop_order *models.Order) {
+	limit_order = p.LimitOrderParams().BuildOrder(member, err_src)
+	if len(err_src.Errors) > 0 {
+		return nil, nil
+	}
+
+	stop_order = p.StopOrderParams().BuildOrder(member, err_src)
+	if len(err_src.Errors) > 0 {
+		return nil, nil
+	}
+
+	if err := config.DataBase.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&limit_order).Error; err != nil {
+			return err
+		}
+
+		stop_order.OcoID = sql.NullInt64{Int64: limit_order.ID, Valid: true}
+		if err := tx.Create(&stop_order).Error; err != nil {
+			return err
+		}
+
+		limit_order.OcoID = sql.NullInt64{Int64: stop_order.ID, Valid: true}
+
+		return tx.Save(&limit_order).Error
+	}); err != nil {
+		err_src.Errors = append(err_src.Errors, "market.order.invalid_volume_or_price")
+
+		return nil, nil
+	}
+
+	if err := limit_order.Submit(); err != nil {
+		err_src.Errors = append(err_src.Errors, err.Error())
+
+		return nil, nil
+	}
+
+	return limit_order, stop_order
+}
+
+// AmendOrderParams is the new price and the new quantity of an open limit order,
+// the quantity is the total quantity of the order including what it already executed.
+type AmendOrderParams struct {
+	Price    decimal.NullDecimal `json:"price" form:"price" validate:"VaildatePrice"`
+	Quantity decimal.NullDecimal `json:"quantity" form:"quantity" validate:"VaildateQuantity"`
+}
+
+func (p AmendOrderParams) Messages() map[string]string {
+	return validate.MS{
+		"VaildatePrice":    "market.order.non_positive_price",
+		"VaildateQuantity": "market.order.non_positive_quantity",
+	}
+}
+
+func (p AmendOrderParams) VaildatePrice(Price decimal.NullDecimal) bool {
+	if Price.Valid {
+		return Price.Decimal.IsPositive()
+	}
+
+	return true
+}
+
+func (p AmendOrderParams) VaildateQuantity(Quantity decimal.NullDecimal) bool {
+	if Quantity.Valid {
+		return Quantity.Decimal.IsPositive()
+	}
+
+	return true
+}
+
+// AmendOrder checks the amended order and sends it to order_processor which locks the funds it needs more.
+func (p AmendOrderParams) AmendOrder(order *models.Order, err_src *Errors) {
+	if !order.IsAmendable() {
+		err_src.Errors = append(err_src.Errors, "market.order.not_amendable")
+
+		return
+	}
+
+	market := order.Market()
+	if !market.TradingState.AcceptsOrders() {
+		err_src.Errors = append(err_src.Errors, TradingStateError(market.TradingState))
+
+		return
+	}
+
+	price := order.Price.Decimal
+	if p.Price.Valid {
+		price = p.Price.Decimal
+	}
+
+	volume := order.OriginVolume
+	if p.Quantity.Valid {
+		volume = p.Quantity.Decimal
+	}
+
+	if price.Equal(order.Price.Decimal) && volume.Equal(order.OriginVolume) {
+		err_src.Errors = append(err_src.Errors, "market.order.nothing_to_amend")
+
+		return
+	}
+
+	if volume.LessThanOrEqual(order.OriginVolume.Sub(order.Volume)) {
+		err_src.Errors = append(err_src.Errors, "market.order.invalid_quantity")
+
+		return
+	}
+
+	amended := *order
+	amended.Price = decimal.NewNullDecimal(price)
+	amended.OriginVolume = volume
+
+	err_src.Errors = append(err_src.Errors, amended.TradingRulesErrors(*market, price.Mul(volume))...)
+	if err_src.Size() > 0 {
+		return
+	}
+
+	Vaildate(&amended, err_src)
+	if err_src.Size() > 0 {
+		return
+	}
+
+	if required := order.AmendedLocked(price, volume).Sub(order.Locked); required.IsPositive() && order.MemberBalance().LessThan(required) {
+		err_src.Errors = append(err_src.Errors, "market.account.insufficient_balance")
+
+		return
+	}
+
+	config.KafkaProducer.Produce("order_processor", map[string]interface{}{
+		"action":   matching.ActionAmend,
+		"id":       order.ID,
+		"price":    price,
+		"quantity": volume,
+	})
+}
+
+// MASS_CANCEL_TIMEOUT is how long a mass cancel waits for the matching engine to run it.
+var MASS_CANCEL_TIMEOUT = 5 * time.Second
+
+// MassCancel sends the mass cancel to the matching engine of the symbol, or of every market when the
+// symbol is empty, and returns how many orders it cancelled. The engine may still run the mass cancel
+// after it failed to answer in time.
+func MassCancel(ctx context.Context, symbol pkg.Symbol, mass_cancel *matching.MassCancel) (int64, error) {
+	book_client, err := bookrpc.NewClient()
+	if err != nil {
+		return 0, err
+	}
+	defer book_client.Close()
+
+	mass_cancel.RequestID = uuid.New().String()
+
+	// the engines select and cancel the orders themselves in a single pass
+	config.KafkaProducer.Produce("matching", map[string]interface{}{
+		"action":      matching.ActionMassCancel,
+		"symbol":      symbol,
+		"mass_cancel": mass_cancel,
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, MASS_CANCEL_TIMEOUT)
+	defer cancel()
+
+	return book_client.FetchMassCancel(ctx, mass_cancel.RequestID)
+}
@@ -0,0 +1,43 @@
+package market_controllers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/controllers/helpers"
+	"github.com/zsmartex/finex/controllers/queries"
+	"github.com/zsmartex/finex/models"
+)
+
+// SetCountdown arms or refreshes the dead man's switch of the member, its resting orders are
+// cancelled unless it's called again within timeout seconds. A zero timeout disarms it.
+func SetCountdown(c *fiber.Ctx) error {
+	CurrentUser := c.Locals("CurrentUser").(*models.Member)
+
+	errors := new(helpers.Errors)
+	payload := new(queries.CountdownParams)
+
+	if err := c.BodyParser(payload); err != nil {
+		return c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.method.invalid_message_body"},
+		})
+	}
+
+	helpers.Vaildate(payload, errors)
+	if errors.Size() > 0 {
+		return c.Status(422).JSON(errors)
+	}
+
+	countdown, err := models.ArmCountdown(CurrentUser.ID, payload.Timeout, time.Now())
+	if err != nil {
+		config.Logger.Errorf("failed to arm the countdown of member %d: %v", CurrentUser.ID, err)
+
+		return c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.internal_error"},
+		})
+	}
+
+	return c.Status(200).JSON(countdown)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/zsmartex/finex/controllers/entities"
 	"github.com/zsmartex/finex/controllers/helpers"
 	"github.com/zsmartex/finex/controllers/queries"
+	"github.com/zsmartex/finex/matching"
 	"github.com/zsmartex/finex/models"
 	"github.com/zsmartex/finex/types"
 
@@ -43,6 +44,36 @@ func CreateOrder(c *fiber.Ctx) error {
 	return c.Status(201).JSON(order.ToJSON())
 }
 
+// CreateOcoOrder places a limit order and a stop order as an OCO pair,
+// the first of them which trades or is triggered cancels the other one.
+func CreateOcoOrder(c *fiber.Ctx) error {
+	CurrentUser := c.Locals("CurrentUser").(*models.Member)
+
+	errors := new(helpers.Errors)
+	payload := new(helpers.CreateOcoOrderParams)
+
+	if err := c.BodyParser(payload); err != nil {
+		c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.method.invalid_message_body"},
+		})
+
+		return err
+	}
+
+	helpers.Vaildate(payload, errors)
+	if errors.Size() > 0 {
+		return c.Status(422).JSON(errors)
+	}
+
+	limit_order, stop_order := payload.CreateOrders(CurrentUser, errors)
+
+	if errors.Size() > 0 {
+		return c.Status(422).JSON(errors)
+	}
+
+	return c.Status(201).JSON([]entities.OrderEntity{limit_order.ToJSON(), stop_order.ToJSON()})
+}
+
 func GetOrders(c *fiber.Ctx) error {
 	CurrentUser := c.Locals("CurrentUser").(*models.Member)
 
@@ -90,6 +121,9 @@ func GetOrders(c *fiber.Ctx) error {
 			state = models.StatePending
 		case "wait":
 			state = models.StateWait
+		case "trigger_wait":
+			state = models.StateWait
+			tx = tx.Where("ord_type IN ? AND triggered_at IS NULL", []types.OrderType{types.TypeStopLimit, types.TypeStopMarket, types.TypeTrailingStop})
 		case "cancel":
 			state = models.StateCancel
 		case "done":
@@ -159,6 +193,52 @@ func GetOrderByUUID(c *fiber.Ctx) error {
 	return c.Status(200).JSON(order.ToJSON())
 }
 
+// AmendOrderByUUID changes the price and the quantity of an open limit order,
+// the order keeps its time priority when its quantity is only reduced.
+func AmendOrderByUUID(c *fiber.Ctx) error {
+	CurrentUser := c.Locals("CurrentUser").(*models.Member)
+
+	uuid, err := uuid.Parse(c.Params("uuid"))
+	if err != nil {
+		return c.Status(422).JSON(helpers.Errors{
+			Errors: []string{"market.order.invaild_uuid"},
+		})
+	}
+
+	errors_src := new(helpers.Errors)
+	payload := new(helpers.AmendOrderParams)
+
+	if err := c.BodyParser(payload); err != nil {
+		c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.method.invalid_message_body"},
+		})
+
+		return err
+	}
+
+	helpers.Vaildate(payload, errors_src)
+	if errors_src.Size() > 0 {
+		return c.Status(422).JSON(errors_src)
+	}
+
+	var order *models.Order
+
+	result := config.DataBase.Where("uuid = ? AND member_id = ?", uuid, CurrentUser.ID).First(&order)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(helpers.Errors{
+			Errors: []string{"record.not_found"},
+		})
+	}
+
+	payload.AmendOrder(order, errors_src)
+
+	if errors_src.Size() > 0 {
+		return c.Status(422).JSON(errors_src)
+	}
+
+	return c.Status(200).JSON(order.ToJSON())
+}
+
 func CancelOrderByUUID(c *fiber.Ctx) error {
 	CurrentUser := c.Locals("CurrentUser").(*models.Member)
 
@@ -178,6 +258,12 @@ func CancelOrderByUUID(c *fiber.Ctx) error {
 		})
 	}
 
+	if market := order.Market(); !market.TradingState.AcceptsCancels() {
+		return c.Status(422).JSON(helpers.Errors{
+			Errors: []string{helpers.TradingStateError(market.TradingState)},
+		})
+	}
+
 	// Doing cancel
 	config.KafkaProducer.Produce("matching", map[string]interface{}{
 		"action": pkg.ActionCancel,
@@ -187,10 +273,12 @@ func CancelOrderByUUID(c *fiber.Ctx) error {
 	return c.Status(200).JSON(order.ToJSON())
 }
 
+// CancelAllOrders cancels the open orders of the member matching the filters with a mass cancel run by the
+// matching engines and answers how many orders they cancelled. The orders of the markets which
+// don't accept cancels are kept.
 func CancelAllOrders(c *fiber.Ctx) error {
 	CurrentUser := c.Locals("CurrentUser").(*models.Member)
 
-	var orders []*models.Order
 	params := new(queries.CancelOrderParams)
 
 	if err := c.BodyParser(params); err != nil {
@@ -199,43 +287,44 @@ func CancelAllOrders(c *fiber.Ctx) error {
 		})
 	}
 
-	tx := config.DataBase.Where("member_id = ? AND state = ?", CurrentUser.ID, models.StateWait)
+	var symbol pkg.Symbol
+	mass_cancel := &matching.MassCancel{
+		MemberID:  CurrentUser.ID,
+		PriceFrom: params.PriceFrom,
+		PriceTo:   params.PriceTo,
+	}
 
 	if len(params.Market) > 0 {
-		tx = tx.Where("market_id = ?", params.Market)
+		var market *models.Market
+		if result := config.DataBase.First(&market, "symbol = ?", params.Market); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return c.Status(422).JSON(helpers.Errors{
+				Errors: []string{"market.orders.invalid_market"},
+			})
+		}
+
+		symbol = market.GetSymbol()
 	}
 
 	if len(params.Side) > 0 {
-		var nSide models.OrderSide
-
 		if params.Side == types.TypeBuy {
-			nSide = models.SideBuy
+			mass_cancel.Side = pkg.SideBuy
 		} else if params.Side == types.TypeSell {
-			nSide = models.SideSell
+			mass_cancel.Side = pkg.SideSell
 		} else {
 			return c.Status(422).JSON(helpers.Errors{
 				Errors: []string{"market.orders.invalid_side"},
 			})
 		}
-
-		tx = tx.Where("type = ?", nSide)
 	}
 
-	tx.Find(&orders)
+	count, err := helpers.MassCancel(c.Context(), symbol, mass_cancel)
+	if err != nil {
+		config.Logger.Errorf("Failed to fetch the result of mass cancel %s, Error: %v", mass_cancel.RequestID, err)
 
-	for _, order := range orders {
-		// Doing cancel
-		config.KafkaProducer.Produce("matching", map[string]interface{}{
-			"action": pkg.ActionCancel,
-			"order":  order.ToMatchingAttributes(),
+		return c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.internal_error"},
 		})
 	}
 
-	var ordersJSON []entities.OrderEntity
-
-	for _, order := range orders {
-		ordersJSON = append(ordersJSON, order.ToJSON())
-	}
-
-	return c.Status(201).JSON(ordersJSON)
+	return c.Status(201).JSON(entities.MassCancelEntity{Count: count})
 }
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
@@ -8,6 +9,8 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/shopspring/decimal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/gorm"
 
 	"github.com/zsmartex/pkg"
@@ -18,6 +21,8 @@ import (
 	"github.com/zsmartex/finex/controllers/helpers"
 	"github.com/zsmartex/finex/controllers/queries"
 	"github.com/zsmartex/finex/models"
+	"github.com/zsmartex/finex/models/concerns"
+	"github.com/zsmartex/finex/server/bookrpc"
 	"github.com/zsmartex/finex/types"
 	engineGrpc "github.com/zsmartex/pkg/Grpc/engine"
 	GrpcSymbol "github.com/zsmartex/pkg/Grpc/symbol"
@@ -108,8 +113,16 @@ func GetDepth(c *fiber.Ctx) error {
 		})
 	}
 
-	matching_client := clientEngine.NewMatchingClient()
-	defer matching_client.Close()
+	group := decimal.Zero
+	if len(params.Group) > 0 {
+		group = decimal.RequireFromString(params.Group)
+	}
+
+	if !(concerns.PrecisionValidator{}).LessThanOrEqTo(group, int32(market.PricePrecision)) {
+		return c.Status(422).JSON(helpers.Errors{
+			Errors: []string{"public.market_depth.invalid_group"},
+		})
+	}
 
 	if params.Limit == 0 {
 		params.Limit = 100
@@ -121,10 +134,7 @@ func GetDepth(c *fiber.Ctx) error {
 		Sequence: 0,
 	}
 	symbol := market.GetSymbol()
-	fetch_orderbook_response, err := matching_client.FetchOrderBook(&engineGrpc.FetchOrderBookRequest{
-		Symbol: &GrpcSymbol.Symbol{BaseCurrency: symbol.BaseCurrency, QuoteCurrency: symbol.QuoteCurrency},
-		Limit:  params.Limit,
-	})
+	fetch_orderbook_response, err := fetchOrderBook(c.Context(), symbol, params.Limit, group)
 	if err != nil {
 		log.Println(err)
 		config.Logger.Errorf("Failed to fetch %s depth, Error: %v", symbol.String(), err)
@@ -151,6 +161,82 @@ func GetDepth(c *fiber.Ctx) error {
 	return c.Status(200).JSON(depth)
 }
 
+// GetDepthDeltas returns the depth events of a market from the sequence from to the sequence to, or
+// up to the last one, for the clients which missed some. Only the last events are kept, the depth
+// has to be fetched again once they are gone.
+func GetDepthDeltas(c *fiber.Ctx) error {
+	var errs = new(helpers.Errors)
+
+	marketID := c.Params("market")
+	params := new(queries.DepthDeltasQuery)
+	if err := c.QueryParser(params); err != nil {
+		return c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.method.invalid_query"},
+		})
+	}
+
+	helpers.Vaildate(params, errs)
+
+	if errs.Size() > 0 {
+		return c.Status(422).JSON(errs)
+	}
+
+	var market *models.Market
+	if result := config.DataBase.First(&market, "symbol = ?", marketID); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return c.Status(422).JSON(helpers.Errors{
+			Errors: []string{"public.market.doesnt_exist"},
+		})
+	}
+
+	book_client, err := bookrpc.NewClient()
+	if err != nil {
+		config.Logger.Errorf("Failed to connect to the matching engine, Error: %v", err)
+
+		return c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.internal_error"},
+		})
+	}
+	defer book_client.Close()
+
+	symbol := market.GetSymbol()
+	response, err := book_client.FetchDepthDeltas(c.Context(), symbol, params.From, params.To)
+	if status.Code(err) == codes.NotFound {
+		return c.Status(422).JSON(helpers.Errors{
+			Errors: []string{"public.market_depth.deltas_unavailable"},
+		})
+	} else if err != nil {
+		config.Logger.Errorf("Failed to fetch %s depth deltas, Error: %v", symbol.String(), err)
+
+		return c.Status(500).JSON(helpers.Errors{
+			Errors: []string{"server.internal_error"},
+		})
+	}
+
+	return c.Status(200).JSON(response.AsMap())
+}
+
+// fetchOrderBook fetches the depth of a market from the matching engine, the levels are merged by
+// the book service of finex when group is positive.
+func fetchOrderBook(ctx context.Context, symbol pkg.Symbol, limit int64, group decimal.Decimal) (*engineGrpc.FetchOrderBookResponse, error) {
+	if group.IsPositive() {
+		book_client, err := bookrpc.NewClient()
+		if err != nil {
+			return nil, err
+		}
+		defer book_client.Close()
+
+		return book_client.FetchGroupedOrderBook(ctx, symbol, limit, group)
+	}
+
+	matching_client := clientEngine.NewMatchingClient()
+	defer matching_client.Close()
+
+	return matching_client.FetchOrderBook(&engineGrpc.FetchOrderBookRequest{
+		Symbol: &GrpcSymbol.Symbol{BaseCurrency: symbol.BaseCurrency, QuoteCurrency: symbol.QuoteCurrency},
+		Limit:  limit,
+	})
+}
+
 func GetGlobalPrice(c *fiber.Ctx) error {
 
 	result, err := config.Redis.Get("finex:h24:global_price")
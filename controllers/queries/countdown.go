@@ -0,0 +1,23 @@
+package queries
+
+import (
+	"github.com/zsmartex/finex/controllers/helpers"
+	"github.com/zsmartex/finex/models"
+)
+
+type CountdownParams struct {
+	// Timeout is the number of seconds the orders are kept without a new call, 0 disarms the countdown
+	Timeout int64 `json:"timeout" form:"timeout" validate:"ValidateTimeout"`
+}
+
+func (t CountdownParams) ValidateTimeout(val int64) bool {
+	return val == 0 || (val >= models.COUNTDOWN_MIN_TIMEOUT && val <= models.COUNTDOWN_MAX_TIMEOUT)
+}
+
+func (t CountdownParams) Messages() map[string]string {
+	return helpers.VaildateMessage("market.countdown")
+}
+
+func (t CountdownParams) Translates() map[string]string {
+	return helpers.VaildateTranslateFields()
+}
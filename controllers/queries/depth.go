@@ -1,9 +1,25 @@
 package queries
 
-import "github.com/zsmartex/finex/controllers/helpers"
+import (
+	"github.com/shopspring/decimal"
+
+	"github.com/zsmartex/finex/controllers/helpers"
+)
 
 type DepthQuery struct {
 	Limit int64 `query:"limit" validate:"uint"`
+	// Group merges the price levels by multiples of a price, it must be a multiple of the price precision
+	Group string `query:"group" validate:"ValidateGroup"`
+}
+
+func (t DepthQuery) ValidateGroup(val string) bool {
+	if len(val) == 0 {
+		return true
+	}
+
+	group, err := decimal.NewFromString(val)
+
+	return err == nil && group.IsPositive()
 }
 
 func (t DepthQuery) Messages() map[string]string {
@@ -13,3 +29,16 @@ func (t DepthQuery) Messages() map[string]string {
 func (t DepthQuery) Translates() map[string]string {
 	return helpers.VaildateTranslateFields()
 }
+
+type DepthDeltasQuery struct {
+	From int64 `query:"from" validate:"uint"`
+	To   int64 `query:"to" validate:"uint"`
+}
+
+func (t DepthDeltasQuery) Messages() map[string]string {
+	return helpers.VaildateMessage("public.market_depth")
+}
+
+func (t DepthDeltasQuery) Translates() map[string]string {
+	return helpers.VaildateTranslateFields()
+}
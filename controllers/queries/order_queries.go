@@ -1,6 +1,8 @@
 package queries
 
 import (
+	"github.com/shopspring/decimal"
+
 	"github.com/zsmartex/finex/controllers/helpers"
 	"github.com/zsmartex/finex/types"
 )
@@ -37,6 +39,9 @@ func (t OrderFilters) Translates() map[string]string {
 type CancelOrderParams struct {
 	Market string          `json:"market" form:"market" validate:"ValidateType"`
 	Side   types.TakerType `json:"side" form:"side"`
+	// PriceFrom and PriceTo only cancel the orders whose limit price is within them, they are ignored when zero
+	PriceFrom decimal.Decimal `json:"price_from" form:"price_from"`
+	PriceTo   decimal.Decimal `json:"price_to" form:"price_to"`
 }
 
 func (t CancelOrderParams) ValidateType(val types.TakerType) bool {
@@ -0,0 +1,89 @@
+package matching
+
+import (
+	"github.com/google/uuid"
+
+	"github.com/zsmartex/finex/types"
+)
+
+// allocate splits the quantity taken from a price level between its orders, nil is returned
+// when they are filled in time priority. Pro-rata allocations are rounded down to the lot size
+// of the market and what is left is given lot by lot in time priority, so they always sum to the quantity.
+func (ob *OrderBook) allocate(price_level *PriceLevel, quantity Fixed) map[uuid.UUID]Fixed {
+	algorithm := ob.Config.MatchingAlgorithm
+	if algorithm != types.MatchingAlgorithmProRata && algorithm != types.MatchingAlgorithmProRataTopOrder {
+		return nil
+	}
+
+	orders := make([]*Order, 0, price_level.Size())
+	var total Fixed
+
+	for order := price_level.Top(); order != nil; order = price_level.Next(order) {
+		if order.Visible() <= 0 {
+			continue
+		}
+
+		orders = append(orders, order)
+		total += order.Visible()
+	}
+
+	// every order of the level is filled whatever the algorithm
+	if quantity <= 0 || quantity >= total {
+		return nil
+	}
+
+	allocations := make(map[uuid.UUID]Fixed, len(orders))
+
+	// the first order of the level is filled before the others share the rest
+	if algorithm == types.MatchingAlgorithmProRataTopOrder {
+		top := orders[0]
+		orders = orders[1:]
+
+		allocations[top.UUID] = MinFixed(top.Visible(), quantity)
+		quantity -= allocations[top.UUID]
+		total -= top.Visible()
+
+		if quantity <= 0 {
+			return allocations
+		}
+	}
+
+	// the lot is the smallest unit of the amount precision when the market has no lot size
+	lot := ob.tradingRules.lotSize
+	if lot <= 0 {
+		lot = 1
+	}
+
+	remainder := quantity
+	for _, order := range orders {
+		allocation := MulFixed(quantity, order.Visible()).Div(total)
+		allocation -= allocation % lot
+
+		allocations[order.UUID] = allocation
+		remainder -= allocation
+	}
+
+	for remainder > 0 {
+		allocated := remainder
+
+		for _, order := range orders {
+			if remainder <= 0 {
+				break
+			}
+
+			allocation := MinFixed(lot, remainder, order.Visible()-allocations[order.UUID])
+			if allocation <= 0 {
+				continue
+			}
+
+			allocations[order.UUID] += allocation
+			remainder -= allocation
+		}
+
+		if remainder == allocated {
+			break
+		}
+	}
+
+	return allocations
+}
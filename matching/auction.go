@@ -0,0 +1,266 @@
+package matching
+
+import (
+	"sort"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/types"
+	"github.com/zsmartex/pkg"
+)
+
+// StartAuction stops the continuous matching of the market, the orders are collected
+// in the book until the auction ends.
+func (ob *OrderBook) StartAuction() {
+	if ob.Auction {
+		return
+	}
+
+	ob.Auction = true
+
+	ob.PublishMarketState()
+	ob.PublishIndicativePrice()
+}
+
+// EndAuction uncrosses the book at the price which executes the largest volume,
+// every trade of the auction is made at this price. The market goes back to continuous
+// matching and the stop orders triggered by the auction price are matched.
+func (ob *OrderBook) EndAuction() {
+	if !ob.Auction {
+		return
+	}
+
+	price, volume := ob.indicativePrice()
+	if volume > 0 {
+		config.Logger.Debugf("[oceanbook.orderbook] auction uncrossed at %s for %s", ob.Config.PriceScale().Decimal(price), ob.Config.AmountScale().Decimal(volume))
+
+		ob.uncross(price, volume)
+		ob.tradePrices = nil
+		ob.setMarketPrice(price)
+	}
+
+	ob.Auction = false
+
+	ob.PublishMarketState()
+	ob.matchPendingOrders()
+}
+
+// collectOrder adds an order to the book during an auction without matching it, the orders
+// which can't rest in the book are rejected.
+func (ob *OrderBook) collectOrder(order *Order) {
+	if order.Type == pkg.TypeMarket || order.IsImmediate() {
+		config.Logger.Debugf("[oceanbook.orderbook] order %d rejected, the market is in auction", order.ID)
+
+		ob.PublishReject(order.Key())
+		ob.cancelOcoOrder(order)
+		return
+	}
+
+	if order.IsIceberg() {
+		order.Replenish()
+	}
+
+	ob.Depth.Add(order)
+	ob.PublishIndicativePrice()
+}
+
+// IndicativePrice returns the price the book would be uncrossed at and the volume executed at it.
+// The price executes the largest volume, then leaves the smallest surplus, then is the closest to
+// the market price, then is the lowest.
+func (ob *OrderBook) IndicativePrice() (price, volume decimal.Decimal) {
+	indicative_price, indicative_volume := ob.indicativePrice()
+
+	return ob.Config.PriceScale().Decimal(indicative_price), ob.Config.AmountScale().Decimal(indicative_volume)
+}
+
+func (ob *OrderBook) indicativePrice() (price, volume Fixed) {
+	type auctionLevel struct {
+		price Fixed
+		total Fixed
+	}
+
+	asks := make([]auctionLevel, 0, ob.Depth.Asks.Size())
+	bids := make([]auctionLevel, 0, ob.Depth.Bids.Size())
+	prices := make([]Fixed, 0, ob.Depth.Asks.Size()+ob.Depth.Bids.Size())
+	var demand Fixed
+
+	// the market price is only used to break ties
+	market_price := ob.MarketPrice
+
+	// asks from the lowest price
+	it := ob.Depth.Asks.Iterator()
+	for it.Next() {
+		pl := it.Value().(*PriceLevel)
+		asks = append(asks, auctionLevel{price: pl.Price, total: pl.Total()})
+		prices = append(prices, pl.Price)
+	}
+
+	// bids from the lowest price
+	it = ob.Depth.Bids.Iterator()
+	for it.End(); it.Prev(); {
+		pl := it.Value().(*PriceLevel)
+		bids = append(bids, auctionLevel{price: pl.Price, total: pl.Total()})
+		prices = append(prices, pl.Price)
+		demand += pl.Total()
+	}
+
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i] < prices[j]
+	})
+
+	var surplus, supply Fixed
+	a, b := 0, 0
+
+	distance := func(p Fixed) Fixed {
+		if p < market_price {
+			return market_price - p
+		}
+
+		return p - market_price
+	}
+
+	for i, p := range prices {
+		if i > 0 && p == prices[i-1] {
+			continue
+		}
+
+		// supply are the asks at or below p, demand the bids at or above p
+		for ; a < len(asks) && asks[a].price <= p; a++ {
+			supply += asks[a].total
+		}
+
+		for ; b < len(bids) && bids[b].price < p; b++ {
+			demand -= bids[b].total
+		}
+
+		executed := MinFixed(supply, demand)
+		if executed <= 0 {
+			continue
+		}
+
+		imbalance := supply - demand
+		if imbalance < 0 {
+			imbalance = -imbalance
+		}
+
+		switch {
+		case executed > volume:
+		case executed < volume:
+			continue
+		case imbalance < surplus:
+		case imbalance > surplus:
+			continue
+		case market_price > 0 && distance(p) < distance(price):
+		default:
+			continue
+		}
+
+		price = p
+		volume = executed
+		surplus = imbalance
+	}
+
+	return price, volume
+}
+
+// uncross matches the best bids and the best asks at the auction price until the volume is executed.
+// The self trade prevention of the market applies between the orders of a member, the most recently
+// queued of the two takes the place of the taker. The trades are sent once the book is uncrossed so
+// an order cancelled after it traded is cancelled by its last trade.
+func (ob *OrderBook) uncross(price, volume Fixed) {
+	trades := make([]*Trade, 0)
+	last_trades := make(map[int64]*Trade)
+
+	for volume > 0 {
+		best_bid := ob.Depth.Bids.Left()
+		best_ask := ob.Depth.Asks.Left()
+		if best_bid == nil || best_ask == nil {
+			break
+		}
+
+		// the orders cancelled by self trade prevention may leave the book uncrossed before the volume
+		bid_level, ask_level := best_bid.Value.(*PriceLevel), best_ask.Value.(*PriceLevel)
+		if bid_level.Price < price || ask_level.Price > price {
+			break
+		}
+
+		bid := bid_level.Top()
+		ask := ask_level.Top()
+
+		if ob.isSelfTrade(bid, ask) {
+			taker, maker := bid, ask
+			if ask.Priority > bid.Priority {
+				taker, maker = ask, bid
+			}
+
+			cancel_taker, cancel_maker := ob.preventSelfTrade(taker, maker, MinFixed(bid.UnfilledQuantity(), ask.UnfilledQuantity()))
+
+			// the maker is reduced in the book by the decrement, the taker rests in it as well here
+			if ob.Config.SelfTradePrevention == types.SelfTradePreventionDecrementAndCancel && !cancel_taker {
+				ob.Depth.Reduce(taker)
+			}
+
+			for _, cancelled := range []struct {
+				order  *Order
+				cancel bool
+			}{{taker, cancel_taker}, {maker, cancel_maker}} {
+				if !cancelled.cancel {
+					continue
+				}
+
+				config.Logger.Debugf("[oceanbook.orderbook] order %d cancelled by self trade prevention", cancelled.order.ID)
+
+				cancelled.order.Cancelled = true
+				ob.Depth.RemoveOrder(cancelled.order)
+				ob.cancelAfterTrades(cancelled.order, last_trades[cancelled.order.ID])
+				ob.cancelOcoOrder(cancelled.order)
+			}
+
+			continue
+		}
+
+		quantity := MinFixed(volume, bid.UnfilledQuantity(), ask.UnfilledQuantity())
+
+		for _, order := range []*Order{bid, ask} {
+			order.Fill(quantity)
+			ob.Depth.Execute(order, quantity)
+
+			if order.Filled() {
+				ob.Depth.RemoveOrder(order)
+			} else if order.IsIceberg() && order.visibleQuantity <= 0 {
+				order.Replenish()
+				ob.Depth.Requeue(order)
+			} else {
+				ob.Depth.Refresh(order)
+			}
+
+			ob.cancelOcoOrder(order)
+		}
+
+		volume -= quantity
+
+		trade := ob.newTrade(bid, ask, price, quantity)
+		trades = append(trades, trade)
+		last_trades[bid.ID] = trade
+		last_trades[ask.ID] = trade
+	}
+
+	for _, trade := range trades {
+		ob.PublishTrade(trade)
+	}
+}
+
+// PublishIndicativePrice sends the price and the volume the auction would uncross at to the websocket.
+func (ob *OrderBook) PublishIndicativePrice() {
+	if ob.Silent {
+		return
+	}
+
+	price, volume := ob.IndicativePrice()
+
+	ob.Depth.Notification.Enqueue("auction", map[string]interface{}{
+		"price":  price,
+		"volume": volume,
+	})
+}
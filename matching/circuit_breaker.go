@@ -0,0 +1,153 @@
+package matching
+
+import (
+	"math"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/zsmartex/finex/types"
+)
+
+// MarketStateTrading, MarketStateHalted and MarketStateAuction are the states sent
+// to the websocket with the market_state event.
+const (
+	MarketStateTrading = "trading"
+	MarketStateHalted  = "halted"
+	MarketStateAuction = "auction"
+)
+
+// PricePoint is the price of a trade and the time it was made at, as kept in the snapshots.
+type PricePoint struct {
+	Price decimal.Decimal
+	Time  time.Time
+}
+
+// tradePrice is the price of a trade of the circuit breaker window, scaled by the price precision.
+type tradePrice struct {
+	price Fixed
+	time  time.Time
+}
+
+func (ob *OrderBook) now() time.Time {
+	if ob.Clock == nil {
+		return time.Now()
+	}
+
+	return ob.Clock()
+}
+
+// priceBand returns the lowest and the highest price an order can trade at, around the market price.
+// The band is rounded inwards to the price precision.
+func (ob *OrderBook) priceBand() (low, high Fixed, ok bool) {
+	if ob.priceBandPercent <= 0 || ob.MarketPrice <= 0 {
+		return 0, 0, false
+	}
+
+	deviation := percentOf(ob.MarketPrice, ob.priceBandPercent)
+	if deviation > math.MaxInt64-ob.MarketPrice {
+		return 0, 0, false
+	}
+
+	return ob.MarketPrice - deviation, ob.MarketPrice + deviation, true
+}
+
+// isOutsidePriceBand returns true if the order would trade beyond the price band at the given price.
+func isOutsidePriceBand(order *Order, price, low, high Fixed) bool {
+	if order.IsAsk() {
+		return price < low
+	}
+
+	return price > high
+}
+
+// IsHalted returns true if the circuit breaker of the market tripped, the market
+// is resumed and the websocket notified once the halt is over.
+func (ob *OrderBook) IsHalted() bool {
+	return ob.isHaltedAt(ob.now())
+}
+
+// ResumeHalt resumes the market once its halt is over at now, the engine runs it periodically
+// so a market without orders coming in is resumed and the websocket notified on time.
+func (ob *OrderBook) ResumeHalt(now time.Time) {
+	ob.isHaltedAt(now)
+}
+
+func (ob *OrderBook) isHaltedAt(now time.Time) bool {
+	if ob.HaltedUntil.IsZero() {
+		return false
+	}
+
+	if now.Before(ob.HaltedUntil) {
+		return true
+	}
+
+	ob.HaltedUntil = time.Time{}
+	ob.PublishMarketState()
+
+	return false
+}
+
+// recordTradePrice keeps the prices of the circuit breaker window and halts the market when
+// the price moved more than the circuit breaker percent within it.
+func (ob *OrderBook) recordTradePrice(price Fixed) {
+	if ob.circuitBreakerPercent <= 0 || ob.Config.CircuitBreakerWindow <= 0 {
+		return
+	}
+
+	now := ob.now()
+
+	prices := ob.tradePrices[:0]
+	for _, point := range ob.tradePrices {
+		if now.Sub(point.time) <= ob.Config.CircuitBreakerWindow {
+			prices = append(prices, point)
+		}
+	}
+
+	ob.tradePrices = append(prices, tradePrice{price: price, time: now})
+
+	low, high := price, price
+	for _, point := range ob.tradePrices {
+		low = MinFixed(low, point.price)
+		if point.price > high {
+			high = point.price
+		}
+	}
+
+	// the move is compared in percents scaled by PERCENT_SCALE
+	if MulFixed(high-low, hundredPercent).Cmp(MulFixed(low, ob.circuitBreakerPercent)) < 0 {
+		return
+	}
+
+	ob.HaltedUntil = now.Add(ob.Config.CircuitBreakerHalt)
+	ob.tradePrices = nil
+
+	ob.PublishMarketState()
+}
+
+// PublishMarketState sends the state of the market to the websocket.
+func (ob *OrderBook) PublishMarketState() {
+	if ob.Silent {
+		return
+	}
+
+	state := map[string]interface{}{
+		"state": MarketStateTrading,
+	}
+
+	if !ob.HaltedUntil.IsZero() {
+		state["state"] = MarketStateHalted
+		state["halted_until"] = ob.HaltedUntil.Unix()
+	}
+
+	if ob.Auction {
+		state["state"] = MarketStateAuction
+	}
+
+	// the state set by the admins wins over the circuit breaker and the auction
+	if len(ob.TradingState) > 0 && ob.TradingState != types.TradingStateTrading {
+		state["state"] = ob.TradingState
+	}
+
+	ob.Depth.Notification.Enqueue("market_state", state)
+}
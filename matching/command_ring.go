@@ -0,0 +1,79 @@
+package matching
+
+import "sync"
+
+// CommandRing is a bounded ring buffer of commands. Any goroutine can push commands,
+// only the engine goroutine pops them. A push waits while the ring is full, so a slow
+// engine slows down its senders instead of growing without limit.
+type CommandRing struct {
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	commands []func()
+	head     int
+	size     int
+	closed   bool
+}
+
+func NewCommandRing(capacity int) *CommandRing {
+	ring := &CommandRing{
+		commands: make([]func(), capacity),
+	}
+
+	ring.notEmpty = sync.NewCond(&ring.mutex)
+	ring.notFull = sync.NewCond(&ring.mutex)
+
+	return ring
+}
+
+// Push appends a command to the ring, it returns false if the ring is closed.
+func (r *CommandRing) Push(command func()) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for r.size == len(r.commands) && !r.closed {
+		r.notFull.Wait()
+	}
+
+	if r.closed {
+		return false
+	}
+
+	r.commands[(r.head+r.size)%len(r.commands)] = command
+	r.size++
+	r.notEmpty.Signal()
+
+	return true
+}
+
+// Pop removes and returns the oldest command, it returns false once the ring is closed and empty.
+func (r *CommandRing) Pop() (func(), bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for r.size == 0 && !r.closed {
+		r.notEmpty.Wait()
+	}
+
+	if r.size == 0 {
+		return nil, false
+	}
+
+	command := r.commands[r.head]
+	r.commands[r.head] = nil
+	r.head = (r.head + 1) % len(r.commands)
+	r.size--
+	r.notFull.Signal()
+
+	return command, true
+}
+
+// Close stops accepting commands, the commands already queued are still popped.
+func (r *CommandRing) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+	r.notEmpty.Broadcast()
+	r.notFull.Broadcast()
+}
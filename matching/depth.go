@@ -1,14 +1,15 @@
 package matching
 
 import (
+	"hash/crc32"
+	"math"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/emirpasic/gods/trees/redblacktree"
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 
-	"github.com/zsmartex/finex/config"
 	"github.com/zsmartex/pkg"
 	GrpcEngine "github.com/zsmartex/pkg/Grpc/engine"
 	GrpcSymbol "github.com/zsmartex/pkg/Grpc/symbol"
@@ -20,12 +21,22 @@ var MAX_PERIOD_TO_SNAPSHOT = 60 * time.Second
 var MIN_INCREMENT_COUNT_TO_SNAPSHOT int64 = 20
 
 type Depth struct {
-	depthMutex sync.RWMutex
-
 	Symbol       pkg.Symbol
 	Asks         *redblacktree.Tree
 	Bids         *redblacktree.Tree
 	Notification *Notification
+	L3           *L3Publisher
+
+	// orders are the orders of the book by UUID, an order is found whatever price the key it is
+	// looked up with has, the key of an order amended by the engine has its price before the amend
+	orders map[uuid.UUID]*Order
+
+	// PriceScale and AmountScale are the scales of the prices and the quantities of the book
+	PriceScale  Scale
+	AmountScale Scale
+
+	// prioritySequence gives the time priority of orders entering the book
+	prioritySequence int64
 
 	// default peatio ws
 	SnapshotTime   time.Time
@@ -34,121 +45,266 @@ type Depth struct {
 }
 
 func NewDepth(symbol pkg.Symbol) *Depth {
+	return newDepth(symbol, NewNotification(symbol), NewL3Publisher(symbol))
+}
+
+// NewOfflineDepth creates a depth whose changes are never sent to the websocket.
+func NewOfflineDepth(symbol pkg.Symbol) *Depth {
+	return newDepth(symbol, newNotification(symbol), newOfflineL3Publisher(symbol))
+}
+
+func newDepth(symbol pkg.Symbol, notification *Notification, l3 *L3Publisher) *Depth {
 	depth := &Depth{
 		Symbol:       symbol,
 		Asks:         redblacktree.NewWith(makeComparator),
 		Bids:         redblacktree.NewWith(makeComparator),
-		Notification: NewNotification(symbol),
+		Notification: notification,
+		L3:           l3,
+		orders:       make(map[uuid.UUID]*Order),
 	}
 
 	return depth
 }
 
-func (d *Depth) Add(o *pkg.Order) {
-	d.depthMutex.Lock()
-	defer d.depthMutex.Unlock()
-	var price_levels *redblacktree.Tree
-	if o.Side == pkg.SideSell {
-		price_levels = d.Asks
-	} else {
-		price_levels = d.Bids
+// priceLevels returns the price levels of the side.
+func (d *Depth) priceLevels(side pkg.OrderSide) *redblacktree.Tree {
+	if side == pkg.SideSell {
+		return d.Asks
 	}
 
-	pl := NewPriceLevel(o.Side, o.Price)
-
-	value, found := price_levels.Get(pl.Key())
+	return d.Bids
+}
 
+// priceLevel returns the price level of the side at the price, nil if there is none.
+func (d *Depth) priceLevel(side pkg.OrderSide, price Fixed) *PriceLevel {
+	value, found := d.priceLevels(side).Get(&PriceLevelKey{Side: side, Price: price})
 	if !found {
-		pl.Add(o)
-		price_levels.Put(pl.Key(), pl)
-		d.Notification.Publish(pl.Side, pl.Price, pl.Total())
+		return nil
+	}
+
+	return value.(*PriceLevel)
+}
+
+// publish sends the quantity of a price level to the websocket.
+func (d *Depth) publish(side pkg.OrderSide, price, amount Fixed) {
+	d.Notification.Publish(side, d.PriceScale.Decimal(price), d.AmountScale.Decimal(amount))
+}
+
+// publishL3 sends the change of an order of the book to the L3 feed.
+func (d *Depth) publishL3(message_type string, o *Order, quantity Fixed) {
+	d.L3.publish(message_type, o, d.PriceScale.Decimal(o.price), d.AmountScale.Decimal(quantity))
+}
+
+func (d *Depth) Add(o *Order) {
+	d.prioritySequence++
+	o.Priority = d.prioritySequence
+
+	price_level := d.priceLevel(o.Side, o.price)
+	if price_level == nil {
+		price_level = NewPriceLevel(o.Side, o.price)
+		d.priceLevels(o.Side).Put(price_level.Key(), price_level)
+	}
+
+	price_level.Add(o)
+	d.orders[o.UUID] = o
+	d.publish(price_level.Side, price_level.Price, price_level.VisibleTotal())
+	d.publishL3(L3Add, o, o.Visible())
+}
+
+// Requeue moves the order behind the others of its price level, it loses its time priority.
+func (d *Depth) Requeue(o *Order) {
+	price_level := d.priceLevel(o.Side, o.price)
+	if price_level == nil {
 		return
 	}
 
-	price_level := value.(*PriceLevel)
+	price_level.Remove(o.UUID)
+
+	d.prioritySequence++
+	o.Priority = d.prioritySequence
+
+	// the L3 feed removed the order once its displayed slice was executed, it is added again
 	price_level.Add(o)
-	d.Notification.Publish(price_level.Side, price_level.Price, price_level.Total())
+	d.publish(price_level.Side, price_level.Price, price_level.VisibleTotal())
+	d.publishL3(L3Add, o, o.Visible())
 }
 
-func (d *Depth) Remove(key *pkg.OrderKey) {
-	d.depthMutex.Lock()
-	defer d.depthMutex.Unlock()
-	var price_levels *redblacktree.Tree
-	if key.Side == pkg.SideSell {
-		price_levels = d.Asks
-	} else {
-		price_levels = d.Bids
+// RemoveOrder removes an order of the book.
+func (d *Depth) RemoveOrder(o *Order) {
+	if d.orders[o.UUID] != o {
+		return
 	}
 
-	pl := NewPriceLevel(key.Side, key.Price)
+	delete(d.orders, o.UUID)
 
-	value, found := price_levels.Get(pl.Key())
+	price_level := d.priceLevel(o.Side, o.price)
+	if price_level == nil {
+		return
+	}
 
-	if !found {
+	remain_quantity := price_level.Remove(o.UUID)
+
+	// the L3 feed removes a filled order with its last execute message
+	if o.Cancelled || !o.Filled() {
+		d.publishL3(L3Cancel, o, o.Visible())
+	}
+
+	if price_level.Empty() || remain_quantity == 0 {
+		d.priceLevels(o.Side).Remove(price_level.Key())
+		d.publish(o.Side, o.price, 0)
 		return
 	}
 
-	price_level := value.(*PriceLevel)
-	remain_quantity := price_level.Remove(key)
+	d.publish(o.Side, o.price, price_level.VisibleTotal())
+}
+
+// Get returns the order of the book with the UUID of the key, nil if it isn't in the book.
+func (d *Depth) Get(key *pkg.OrderKey) *Order {
+	return d.orders[key.UUID]
+}
 
-	if price_level.Empty() || remain_quantity.IsZero() {
-		price_levels.Remove(pl.Key())
+// Refresh counts the current quantity of an order of the book once it was filled or reduced,
+// and publishes the quantity of its price level.
+func (d *Depth) Refresh(o *Order) {
+	price_level := d.priceLevel(o.Side, o.price)
+	if price_level == nil {
+		return
 	}
 
-	d.Notification.Publish(pl.Side, pl.Price, remain_quantity)
+	price_level.Update(o)
+	d.publish(price_level.Side, price_level.Price, price_level.VisibleTotal())
 }
 
-func (d *Depth) FetchOrderBook(limit int64) *GrpcEngine.FetchOrderBookResponse {
-	d.depthMutex.Lock()
-	defer d.depthMutex.Unlock()
+// Reduce refreshes an order of the book whose quantity was reduced without trading.
+func (d *Depth) Reduce(o *Order) {
+	d.Refresh(o)
+	d.publishL3(L3Modify, o, o.Visible())
+}
+
+// Execute sends a trade against an order of the book to the L3 feed, it is called
+// before the order is refreshed or removed.
+func (d *Depth) Execute(o *Order, quantity Fixed) {
+	d.publishL3(L3Execute, o, quantity)
+}
 
-	result := &GrpcEngine.FetchOrderBookResponse{
+// FetchOrderBook returns the price levels of each side from the best price, limit is the number of
+// levels returned. When group is positive the levels are merged by multiples of group, bids rounded
+// down and asks rounded up so a merged level never crosses the spread.
+func (d *Depth) FetchOrderBook(limit int64, group Fixed) *GrpcEngine.FetchOrderBookResponse {
+	return &GrpcEngine.FetchOrderBookResponse{
 		Symbol:   &GrpcSymbol.Symbol{BaseCurrency: d.Symbol.BaseCurrency, QuoteCurrency: d.Symbol.QuoteCurrency},
-		Asks:     make([]*GrpcEngine.BookOrder, 0),
-		Bids:     make([]*GrpcEngine.BookOrder, 0),
-		Sequence: d.Notification.Sequence,
+		Asks:     d.bookOrders(d.Asks, pkg.SideSell, limit, group),
+		Bids:     d.bookOrders(d.Bids, pkg.SideBuy, limit, group),
+		Sequence: d.Notification.CurrentSequence(),
 	}
+}
 
-	ait := d.Asks.Iterator()
-	ait.End()
-	var i int64
-	for i = 0; ait.Prev() && i < limit; i++ {
-		price_level := ait.Value().(*PriceLevel)
-		price := price_level.Price
-		quantity := price_level.Total()
-
-		result.Asks = append(result.Asks, &GrpcEngine.BookOrder{
+func (d *Depth) bookOrders(price_levels *redblacktree.Tree, side pkg.OrderSide, limit int64, group Fixed) []*GrpcEngine.BookOrder {
+	book_orders := make([]*GrpcEngine.BookOrder, 0)
+	appendLevel := func(price, amount Fixed) {
+		book_orders = append(book_orders, &GrpcEngine.BookOrder{
 			PriceQuantity: []*GrpcUtils.Decimal{
-				{
-					Val: price.CoefficientInt64(),
-					Exp: price.Exponent(),
-				},
-				{
-					Val: quantity.CoefficientInt64(),
-					Exp: quantity.Exponent(),
-				},
+				d.PriceScale.Grpc(price),
+				d.AmountScale.Grpc(amount),
 			},
 		})
 	}
 
-	bit := d.Bids.Iterator()
-	bit.End()
-	for i = 0; bit.Prev() && i < limit; i++ {
-		price_level := bit.Value().(*PriceLevel)
-		price := price_level.Price
-		quantity := price_level.Total()
+	var price, amount Fixed
+	started := false
 
-		result.Bids = append(result.Bids, &GrpcEngine.BookOrder{
-			PriceQuantity: []*GrpcUtils.Decimal{
-				{
-					Val: price.CoefficientInt64(),
-					Exp: price.Exponent(),
-				},
-				{
-					Val: quantity.CoefficientInt64(),
-					Exp: quantity.Exponent(),
-				},
-			},
+	it := price_levels.Iterator()
+	for it.Next() {
+		price_level := it.Value().(*PriceLevel)
+		level_price := groupPrice(side, price_level.Price, group)
+
+		if started && level_price == price {
+			amount += price_level.VisibleTotal()
+			continue
+		}
+
+		if started {
+			appendLevel(price, amount)
+		}
+
+		if int64(len(book_orders)) >= limit {
+			return book_orders
+		}
+
+		price, amount, started = level_price, price_level.VisibleTotal(), true
+	}
+
+	if started {
+		appendLevel(price, amount)
+	}
+
+	return book_orders
+}
+
+// groupPrice returns the price of the merged level holding a price, rounded down to a multiple of
+// group for bids and up for asks.
+func groupPrice(side pkg.OrderSide, price, group Fixed) Fixed {
+	if group <= 0 {
+		return price
+	}
+
+	remainder := price % group
+	if remainder == 0 {
+		return price
+	}
+
+	if side == pkg.SideBuy || price-remainder > math.MaxInt64-group {
+		return price - remainder
+	}
+
+	return price - remainder + group
+}
+
+// DEPTH_CHECKSUM_LEVELS is the number of price levels of each side in the checksum of the depth events.
+const DEPTH_CHECKSUM_LEVELS = 25
+
+// Flush sends the price levels changed since the previous flush to the websocket, with the
+// checksum of the book as it is now.
+func (d *Depth) Flush() {
+	d.Notification.Flush(func() uint32 {
+		return d.Checksum(DEPTH_CHECKSUM_LEVELS)
+	})
+}
+
+// Checksum returns the CRC32 of the best levels of each side with a visible amount. The string hashed
+// has the price and the amount of the best bid, then of the best ask, then of the second bid and so
+// on, written as in the depth events and separated by colons. A side with fewer levels is skipped
+// once it has none left.
+func (d *Depth) Checksum(levels int) uint32 {
+	bids, asks := d.checksumLevels(d.Bids, levels), d.checksumLevels(d.Asks, levels)
+
+	values := make([]string, 0, 2*(len(bids)+len(asks)))
+	for i := 0; i < len(bids) || i < len(asks); i++ {
+		if i < len(bids) {
+			values = append(values, bids[i]...)
+		}
+
+		if i < len(asks) {
+			values = append(values, asks[i]...)
+		}
+	}
+
+	return crc32.ChecksumIEEE([]byte(strings.Join(values, ":")))
+}
+
+func (d *Depth) checksumLevels(price_levels *redblacktree.Tree, levels int) [][]string {
+	result := make([][]string, 0, levels)
+
+	it := price_levels.Iterator()
+	for len(result) < levels && it.Next() {
+		price_level := it.Value().(*PriceLevel)
+		if price_level.VisibleTotal() <= 0 {
+			continue
+		}
+
+		result = append(result, []string{
+			d.PriceScale.Decimal(price_level.Price).String(),
+			d.AmountScale.Decimal(price_level.VisibleTotal()).String(),
 		})
 	}
 
@@ -166,7 +322,7 @@ func (d *Depth) PublishSnapshot() {
 		i++
 		pl := r.(*PriceLevel)
 
-		asks_depth = append(asks_depth, []decimal.Decimal{pl.Price, pl.Total()})
+		asks_depth = append(asks_depth, []decimal.Decimal{d.PriceScale.Decimal(pl.Price), d.AmountScale.Decimal(pl.VisibleTotal())})
 		if i >= 300 {
 			break
 		}
@@ -177,13 +333,13 @@ func (d *Depth) PublishSnapshot() {
 		i++
 		pl := r.(*PriceLevel)
 
-		bids_depth = append(bids_depth, []decimal.Decimal{pl.Price, pl.Total()})
+		bids_depth = append(bids_depth, []decimal.Decimal{d.PriceScale.Decimal(pl.Price), d.AmountScale.Decimal(pl.VisibleTotal())})
 		if i >= 300 {
 			break
 		}
 	}
 
-	config.RangoClient.EnqueueEvent(pkg.EnqueueEventKindPublic, strings.ToLower(d.Symbol.ToSymbol("")), "ob-snap", pkg.DepthJSON{
+	d.Notification.Enqueue("ob-snap", pkg.DepthJSON{
 		Asks:     asks_depth,
 		Bids:     bids_depth,
 		Sequence: d.Notification.Sequence,
@@ -195,16 +351,16 @@ func makeComparator(a, b interface{}) int {
 	bPriceLevel := b.(*PriceLevelKey)
 
 	switch {
-	case aPriceLevel.Side == pkg.SideSell && aPriceLevel.Price.LessThan(bPriceLevel.Price):
+	case aPriceLevel.Side == pkg.SideSell && aPriceLevel.Price < bPriceLevel.Price:
 		return -1
 
-	case aPriceLevel.Side == pkg.SideSell && aPriceLevel.Price.GreaterThan(bPriceLevel.Price):
+	case aPriceLevel.Side == pkg.SideSell && aPriceLevel.Price > bPriceLevel.Price:
 		return 1
 
-	case aPriceLevel.Side == pkg.SideBuy && aPriceLevel.Price.LessThan(bPriceLevel.Price):
+	case aPriceLevel.Side == pkg.SideBuy && aPriceLevel.Price < bPriceLevel.Price:
 		return 1
 
-	case aPriceLevel.Side == pkg.SideBuy && aPriceLevel.Price.GreaterThan(bPriceLevel.Price):
+	case aPriceLevel.Side == pkg.SideBuy && aPriceLevel.Price > bPriceLevel.Price:
 		return -1
 
 	default:
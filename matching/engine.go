@@ -1,46 +1,320 @@
 package matching
 
 import (
-	"sync"
+	"errors"
+	"sync/atomic"
+	"time"
 
 	"github.com/shopspring/decimal"
 	"github.com/zsmartex/pkg"
+	GrpcEngine "github.com/zsmartex/pkg/Grpc/engine"
+
+	"github.com/zsmartex/finex/types"
+)
+
+var (
+	// ErrInvalidPriceGroup is returned when the price group of a depth isn't a multiple of the price precision.
+	ErrInvalidPriceGroup = errors.New("price group must be a multiple of the price precision")
+	// ErrEngineStopped is returned by the commands sent to an engine once it is stopped, they aren't run.
+	ErrEngineStopped = errors.New("engine is stopped")
 )
 
+// ENGINE_COMMANDS_CAP is the number of commands an engine queues before their senders wait.
+var ENGINE_COMMANDS_CAP = 1024
+
+// Engine runs the order book of a symbol in a dedicated goroutine, it is the only one to
+// touch the book. Inputs and queries are commands queued in a bounded ring buffer and
+// executed one at a time in the order they were queued.
 type Engine struct {
-	MatchingMutex sync.RWMutex
-	Symbol        pkg.Symbol
-	OrderBook     *OrderBook
-	Initialized   bool
+	Symbol pkg.Symbol
+	// OrderBook must only be used by the commands of the engine once it is started
+	OrderBook *OrderBook
+
+	// initialized is 1 once the orders of the market are loaded, it is read by the gRPC handlers
+	initialized int32
+
+	commands *CommandRing
+	stopped  chan struct{}
 }
 
-func NewEngine(symbol pkg.Symbol, price decimal.Decimal) *Engine {
+func NewEngine(symbol pkg.Symbol, price decimal.Decimal, market_config MarketConfig) *Engine {
+	return newEngine(symbol, NewOrderBook(
+		symbol,
+		price,
+		market_config,
+	))
+}
+
+// NewOfflineEngine creates an engine which runs without Kafka, Redis or Quantex,
+// its events are sent to the given producer.
+func NewOfflineEngine(symbol pkg.Symbol, price decimal.Decimal, market_config MarketConfig, producer Producer) *Engine {
+	return newEngine(symbol, NewOfflineOrderBook(symbol, price, market_config, producer))
+}
+
+func newEngine(symbol pkg.Symbol, order_book *OrderBook) *Engine {
 	engine := &Engine{
-		Symbol: symbol,
-		OrderBook: NewOrderBook(
-			symbol,
-			price,
-		),
-		Initialized: false,
+		Symbol:    symbol,
+		OrderBook: order_book,
+		commands:  NewCommandRing(ENGINE_COMMANDS_CAP),
+		stopped:   make(chan struct{}),
+	}
+
+	go engine.run()
+
+	if order_book.Depth.Notification.Publisher != nil {
+		go engine.notify()
 	}
 
 	return engine
 }
 
-func (e *Engine) Submit(o *pkg.Order) {
-	e.MatchingMutex.Lock()
-	defer e.MatchingMutex.Unlock()
+// SetInitialized marks the engine ready once the orders of its market are loaded.
+func (e *Engine) SetInitialized() {
+	atomic.StoreInt32(&e.initialized, 1)
+}
+
+// IsInitialized returns true if the orders of the market are loaded.
+func (e *Engine) IsInitialized() bool {
+	return atomic.LoadInt32(&e.initialized) == 1
+}
+
+func (e *Engine) run() {
+	defer close(e.stopped)
+
+	for {
+		command, ok := e.commands.Pop()
+		if !ok {
+			return
+		}
+
+		command()
+	}
+}
+
+// notify flushes the depth events of the book every NOTIFICATION_PERIOD. The flush is a command
+// so the checksum of an event is the one of the book its changes were made to. The halt of the
+// market is resumed by the same command once it is over, with the state of the market in the flush.
+func (e *Engine) notify() {
+	ticker := time.NewTicker(NOTIFICATION_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stopped:
+			return
+		case <-ticker.C:
+			e.commands.Push(func() {
+				e.OrderBook.ResumeHalt(time.Now())
+				e.OrderBook.Depth.Flush()
+			})
+		}
+	}
+}
+
+// Execute runs the command in the engine goroutine and waits until it's done. Commands
+// must not call Execute themselves. Nothing is run once the engine is stopped, ErrEngineStopped
+// is returned instead. A market whose halt is over at the time of the book is resumed first,
+// the engines without the notification ticker are resumed by their commands.
+func (e *Engine) Execute(command func(ob *OrderBook)) error {
+	done := make(chan struct{})
+
+	if !e.commands.Push(func() {
+		defer close(done)
+
+		e.OrderBook.ResumeHalt(e.OrderBook.now())
+		command(e.OrderBook)
+	}) {
+		return ErrEngineStopped
+	}
+
+	<-done
+
+	return nil
+}
+
+// Stop runs the commands already queued and stops the engine goroutine.
+func (e *Engine) Stop() {
+	e.commands.Close()
+	<-e.stopped
+}
+
+func (e *Engine) Submit(o *Order) error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.Submit(o)
+	})
+}
+
+// Load adds an order already resting in the market when the engine starts, the trading
+// rules may have changed since it was placed so they aren't checked again.
+func (e *Engine) Load(o *Order) error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.Add(o)
+	})
+}
+
+// SubmitOco submits both orders of an OCO pair in a single pass.
+func (e *Engine) SubmitOco(o, oco *Order) error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.SubmitOco(o, oco)
+	})
+}
+
+// Amend changes the price and the quantity of the order with the given key.
+func (e *Engine) Amend(key *pkg.OrderKey, o *Order) error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.Amend(key, o)
+	})
+}
+
+// StartAuction collects the orders of the market without matching them until EndAuction.
+func (e *Engine) StartAuction() error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.StartAuction()
+	})
+}
+
+// EndAuction uncrosses the book and resumes the continuous matching.
+func (e *Engine) EndAuction() error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.EndAuction()
+	})
+}
+
+// SetTradingState switches the market to a trading state, the book is kept.
+func (e *Engine) SetTradingState(state types.TradingState) error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.SetTradingState(state)
+	})
+}
+
+// MassCancel cancels the orders selected by the mass cancel and returns how many were cancelled.
+func (e *Engine) MassCancel(mass_cancel *MassCancel) (count int, err error) {
+	err = e.Execute(func(ob *OrderBook) {
+		count = ob.MassCancel(mass_cancel)
+	})
+
+	return count, err
+}
+
+func (e *Engine) CancelWithKey(key *pkg.OrderKey) error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.Remove(key)
+	})
+}
+
+func (e *Engine) Cancel(o *Order) error {
+	return e.CancelWithKey(o.Key())
+}
+
+// SetSilent stops or resumes the events sent by the order book to the settlement workers.
+func (e *Engine) SetSilent(silent bool) error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.Silent = silent
+	})
+}
+
+// Snapshot copies the state of the order book.
+func (e *Engine) Snapshot() (snapshot *OrderBookSnapshot, err error) {
+	err = e.Execute(func(ob *OrderBook) {
+		snapshot = ob.Snapshot()
+	})
+
+	return snapshot, err
+}
+
+// Restore loads a snapshot into the empty order book of the engine.
+func (e *Engine) Restore(snapshot *OrderBookSnapshot) error {
+	return e.Execute(func(ob *OrderBook) {
+		ob.Restore(snapshot)
+	})
+}
+
+// FetchOrder returns a copy of the order of the book or of the stop order with the given key.
+func (e *Engine) FetchOrder(key *pkg.OrderKey) (order *Order, err error) {
+	err = e.Execute(func(ob *OrderBook) {
+		o := ob.FindStopOrder(key)
+		if o == nil {
+			o = ob.Depth.Get(key)
+		}
 
-	e.OrderBook.Add(o)
+		if o != nil {
+			order = ob.export(o)
+		}
+	})
+
+	return order, err
+}
+
+// FetchStopOrders returns the stop orders of a member waiting for their trigger price.
+func (e *Engine) FetchStopOrders(member_id int64) ([]*Order, error) {
+	orders := make([]*Order, 0)
+
+	err := e.Execute(func(ob *OrderBook) {
+		for _, o := range ob.StopOrders(member_id) {
+			orders = append(orders, ob.export(o))
+		}
+	})
+
+	return orders, err
 }
 
-func (e *Engine) CancelWithKey(key *pkg.OrderKey) {
-	e.MatchingMutex.Lock()
-	defer e.MatchingMutex.Unlock()
+// MarketPrice returns the price of the last trade of the market.
+func (e *Engine) MarketPrice() (price decimal.Decimal, err error) {
+	err = e.Execute(func(ob *OrderBook) {
+		price = ob.Config.PriceScale().Decimal(ob.MarketPrice)
+	})
 
-	e.OrderBook.Remove(key)
+	return price, err
 }
 
-func (e *Engine) Cancel(o *pkg.Order) {
-	e.CancelWithKey(o.Key())
+// FetchOrderBook returns the price levels of the book merged by multiples of group, see
+// Depth.FetchOrderBook. A zero group returns the levels as they are.
+func (e *Engine) FetchOrderBook(limit int64, group decimal.Decimal) (response *GrpcEngine.FetchOrderBookResponse, err error) {
+	if group.IsNegative() {
+		return nil, ErrInvalidPriceGroup
+	}
+
+	if execute_err := e.Execute(func(ob *OrderBook) {
+		var price_group Fixed
+		if price_group, err = ob.Depth.PriceScale.FromDecimal(group); err != nil {
+			err = ErrInvalidPriceGroup
+			return
+		}
+
+		response = ob.Depth.FetchOrderBook(limit, price_group)
+	}); execute_err != nil {
+		return nil, execute_err
+	}
+
+	return response, err
+}
+
+// FetchDepthDeltas returns the depth events from sequence from to sequence to, see Notification.Deltas.
+func (e *Engine) FetchDepthDeltas(from, to int64) (deltas []DepthDelta, err error) {
+	if execute_err := e.Execute(func(ob *OrderBook) {
+		deltas, err = ob.Depth.Notification.Deltas(from, to)
+	}); execute_err != nil {
+		return nil, execute_err
+	}
+
+	return deltas, err
+}
+
+// FetchL3OrderBook returns the resting orders of the book, see Depth.L3Snapshot.
+func (e *Engine) FetchL3OrderBook(limit int64) (snapshot *L3Snapshot, err error) {
+	err = e.Execute(func(ob *OrderBook) {
+		snapshot = ob.Depth.L3Snapshot(limit)
+	})
+
+	return snapshot, err
+}
+
+func (e *Engine) CalcMarketOrder(side pkg.OrderSide, quantity decimal.NullDecimal, volume decimal.NullDecimal) (response *GrpcEngine.CalcMarketOrderResponse, err error) {
+	if execute_err := e.Execute(func(ob *OrderBook) {
+		response, err = ob.CalcMarketOrder(side, quantity, volume)
+	}); execute_err != nil {
+		return nil, execute_err
+	}
+
+	return response, err
 }
@@ -0,0 +1,259 @@
+package matching
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"math/bits"
+
+	"github.com/shopspring/decimal"
+
+	GrpcUtils "github.com/zsmartex/pkg/Grpc/utils"
+)
+
+var (
+	// ErrFixedOverflow is returned when a value doesn't fit the integer it is converted to.
+	ErrFixedOverflow = errors.New("fixed point value overflows")
+	// ErrFixedPrecision is returned when a value has more decimals than its scale.
+	ErrFixedPrecision = errors.New("fixed point value has more decimals than its scale")
+)
+
+// MAX_FIXED_SCALE is the largest number of decimals of a fixed point value.
+const MAX_FIXED_SCALE = 18
+
+// PERCENT_SCALE is the scale of the percentages of the markets and of the orders, like the price
+// band or the trailing percent of a stop order. The decimals beyond it are rounded down.
+const PERCENT_SCALE Scale = 8
+
+// hundredPercent is 100 percent at PERCENT_SCALE.
+const hundredPercent Fixed = 100 * 1e8
+
+// Fixed is a decimal stored as a count of the smallest unit of its scale, the prices of a
+// market are scaled by its price precision and the quantities by its amount precision.
+// Values of the same scale are added, subtracted and compared as integers.
+type Fixed int64
+
+// Scale is the number of decimals of fixed point values.
+type Scale int32
+
+var pow10 = [MAX_FIXED_SCALE + 1]int64{
+	1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9,
+	1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18,
+}
+
+// FromDecimal converts a decimal to the scale, it must not have more decimals than the scale.
+func (s Scale) FromDecimal(d decimal.Decimal) (Fixed, error) {
+	if s < 0 || s > MAX_FIXED_SCALE {
+		return 0, ErrFixedOverflow
+	}
+
+	// the decimals of the orders have small coefficients, they are converted without big.Int arithmetic
+	if coefficient := d.Coefficient(); coefficient.IsInt64() {
+		value, shift := coefficient.Int64(), int(d.Exponent())+int(s)
+
+		switch {
+		case shift >= 0 && shift <= MAX_FIXED_SCALE:
+			hi, lo := bits.Mul64(uint64(abs(value)), uint64(pow10[shift]))
+			if hi != 0 || lo > math.MaxInt64 {
+				return 0, ErrFixedOverflow
+			}
+
+			if value < 0 {
+				return -Fixed(lo), nil
+			}
+
+			return Fixed(lo), nil
+		case shift < 0 && shift >= -MAX_FIXED_SCALE:
+			if value%pow10[-shift] != 0 {
+				return 0, ErrFixedPrecision
+			}
+
+			return Fixed(value / pow10[-shift]), nil
+		}
+	}
+
+	shifted := d.Shift(int32(s))
+	if !shifted.Equal(shifted.Truncate(0)) {
+		return 0, ErrFixedPrecision
+	}
+
+	coefficient := shifted.BigInt()
+	if !coefficient.IsInt64() {
+		return 0, ErrFixedOverflow
+	}
+
+	return Fixed(coefficient.Int64()), nil
+}
+
+// Floor converts a decimal to the scale, the decimals beyond the scale are rounded down.
+func (s Scale) Floor(d decimal.Decimal) (Fixed, error) {
+	return s.FromDecimal(d.Shift(int32(s)).Floor().Shift(-int32(s)))
+}
+
+// Ceil converts a decimal to the scale, the decimals beyond the scale are rounded up.
+func (s Scale) Ceil(d decimal.Decimal) (Fixed, error) {
+	return s.FromDecimal(d.Shift(int32(s)).Ceil().Shift(-int32(s)))
+}
+
+// Decimal converts a fixed point value of the scale back to a decimal.
+func (s Scale) Decimal(f Fixed) decimal.Decimal {
+	return decimal.New(int64(f), -int32(s))
+}
+
+// Grpc converts a fixed point value of the scale to its gRPC representation, it can't overflow.
+func (s Scale) Grpc(f Fixed) *GrpcUtils.Decimal {
+	return &GrpcUtils.Decimal{
+		Val: int64(f),
+		Exp: -int32(s),
+	}
+}
+
+// GrpcDecimal converts a decimal to its gRPC representation, the trailing zeros of its coefficient
+// are dropped until it fits an int64.
+func GrpcDecimal(d decimal.Decimal) (*GrpcUtils.Decimal, error) {
+	coefficient, exponent := d.Coefficient(), d.Exponent()
+
+	ten := big.NewInt(10)
+	for !coefficient.IsInt64() {
+		quotient, remainder := new(big.Int).QuoRem(coefficient, ten, new(big.Int))
+		if remainder.Sign() != 0 {
+			return nil, ErrFixedOverflow
+		}
+
+		coefficient = quotient
+		exponent++
+	}
+
+	return &GrpcUtils.Decimal{
+		Val: coefficient.Int64(),
+		Exp: exponent,
+	}, nil
+}
+
+func abs(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+
+	return value
+}
+
+// MinFixed returns the smallest of the values.
+func MinFixed(first Fixed, rest ...Fixed) Fixed {
+	min := first
+	for _, f := range rest {
+		if f < min {
+			min = f
+		}
+	}
+
+	return min
+}
+
+// Wide is a positive 128 bits fixed point value, it holds the totals of a market which are
+// prices multiplied by quantities, scaled by the sum of the price and the amount precisions.
+type Wide struct {
+	hi uint64
+	lo uint64
+}
+
+// MulFixed returns the product of two positive values, the total of a quantity at a price.
+func MulFixed(price, quantity Fixed) Wide {
+	if price <= 0 || quantity <= 0 {
+		return Wide{}
+	}
+
+	hi, lo := bits.Mul64(uint64(price), uint64(quantity))
+
+	return Wide{hi: hi, lo: lo}
+}
+
+// WideFromDecimal converts a positive decimal to the scale.
+func WideFromDecimal(d decimal.Decimal, s Scale) (Wide, error) {
+	if d.IsNegative() {
+		return Wide{}, ErrFixedOverflow
+	}
+
+	shifted := d.Shift(int32(s))
+	if !shifted.Equal(shifted.Truncate(0)) {
+		return Wide{}, ErrFixedPrecision
+	}
+
+	coefficient := shifted.BigInt()
+	if coefficient.BitLen() > 128 {
+		return Wide{}, ErrFixedOverflow
+	}
+
+	lo := new(big.Int).And(coefficient, new(big.Int).SetUint64(math.MaxUint64))
+	hi := new(big.Int).Rsh(coefficient, 64)
+
+	return Wide{hi: hi.Uint64(), lo: lo.Uint64()}, nil
+}
+
+// Decimal converts the value of the scale back to a decimal.
+func (w Wide) Decimal(s Scale) decimal.Decimal {
+	coefficient := new(big.Int).SetUint64(w.hi)
+	coefficient.Lsh(coefficient, 64)
+	coefficient.Or(coefficient, new(big.Int).SetUint64(w.lo))
+
+	return decimal.NewFromBigInt(coefficient, -int32(s))
+}
+
+func (w Wide) IsZero() bool {
+	return w.hi == 0 && w.lo == 0
+}
+
+// Cmp returns -1, 0 or 1 if w is lower than, equal to or greater than v.
+func (w Wide) Cmp(v Wide) int {
+	switch {
+	case w.hi < v.hi || w.hi == v.hi && w.lo < v.lo:
+		return -1
+	case w.hi == v.hi && w.lo == v.lo:
+		return 0
+	default:
+		return 1
+	}
+}
+
+func (w Wide) Add(v Wide) Wide {
+	lo, carry := bits.Add64(w.lo, v.lo, 0)
+	hi, _ := bits.Add64(w.hi, v.hi, carry)
+
+	return Wide{hi: hi, lo: lo}
+}
+
+// Sub returns w - v, or zero when v is greater than w.
+func (w Wide) Sub(v Wide) Wide {
+	if w.Cmp(v) <= 0 {
+		return Wide{}
+	}
+
+	lo, borrow := bits.Sub64(w.lo, v.lo, 0)
+	hi, _ := bits.Sub64(w.hi, v.hi, borrow)
+
+	return Wide{hi: hi, lo: lo}
+}
+
+// Div returns w divided by the value rounded down, the quantity a total buys at a price. The
+// quotient is capped to the largest fixed point value when it doesn't fit one.
+func (w Wide) Div(f Fixed) Fixed {
+	if f <= 0 {
+		return 0
+	}
+
+	if w.hi >= uint64(f) {
+		return math.MaxInt64
+	}
+
+	quotient, _ := bits.Div64(w.hi, w.lo, uint64(f))
+	if quotient > math.MaxInt64 {
+		return math.MaxInt64
+	}
+
+	return Fixed(quotient)
+}
+
+// percentOf returns the percentage of a positive value rounded down, the percent is scaled by PERCENT_SCALE.
+func percentOf(value, percent Fixed) Fixed {
+	return MulFixed(value, percent).Div(hundredPercent)
+}
@@ -0,0 +1,198 @@
+package matching
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/zsmartex/pkg"
+)
+
+func TestScaleFromDecimal(t *testing.T) {
+	for _, test := range []struct {
+		scale Scale
+		value string
+		fixed Fixed
+		err   error
+	}{
+		{2, "1.23", 123, nil},
+		{2, "-1.5", -150, nil},
+		{2, "0", 0, nil},
+		{0, "42", 42, nil},
+		{4, "0.0001", 1, nil},
+		{2, "1.234", 0, ErrFixedPrecision},
+		{0, "0.5", 0, ErrFixedPrecision},
+		// the coefficient doesn't fit an int64 but its trailing zeros are dropped by the scale
+		{2, "0.1000000000000000000000", 10, nil},
+		{0, "9223372036854775807", math.MaxInt64, nil},
+		{0, "9223372036854775808", 0, ErrFixedOverflow},
+		{2, "92233720368547758.08", 0, ErrFixedOverflow},
+		{18, "10", 0, ErrFixedOverflow},
+		{0, "123456789012345678901234567890", 0, ErrFixedOverflow},
+		{MAX_FIXED_SCALE + 1, "1", 0, ErrFixedOverflow},
+		{-1, "1", 0, ErrFixedOverflow},
+	} {
+		fixed, err := test.scale.FromDecimal(decimal.RequireFromString(test.value))
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s at scale %d returned error %v, expected %v", test.value, test.scale, err, test.err)
+		}
+
+		if err == nil && fixed != test.fixed {
+			t.Fatalf("%s at scale %d is %d, expected %d", test.value, test.scale, fixed, test.fixed)
+		}
+	}
+}
+
+func TestScaleRounding(t *testing.T) {
+	scale := Scale(2)
+
+	for _, test := range []struct {
+		value       string
+		floor, ceil Fixed
+	}{
+		{"1.239", 123, 124},
+		{"1.23", 123, 123},
+		{"-1.231", -124, -123},
+	} {
+		value := decimal.RequireFromString(test.value)
+
+		if floor, err := scale.Floor(value); err != nil || floor != test.floor {
+			t.Fatalf("floor of %s is %d (%v), expected %d", test.value, floor, err, test.floor)
+		}
+
+		if ceil, err := scale.Ceil(value); err != nil || ceil != test.ceil {
+			t.Fatalf("ceil of %s is %d (%v), expected %d", test.value, ceil, err, test.ceil)
+		}
+	}
+
+	if value := scale.Decimal(-150); !value.Equal(decimal.RequireFromString("-1.5")) {
+		t.Fatalf("-150 at scale 2 is %s, expected -1.5", value)
+	}
+}
+
+func TestWideFromDecimal(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		err   error
+	}{
+		{"0", nil},
+		{"1.0001", nil},
+		{"-0.0001", ErrFixedOverflow},
+		{"1.00001", ErrFixedPrecision},
+		// 2^128 - 1 and 2^128 at scale 4
+		{"34028236692093846346337460743176821.1455", nil},
+		{"34028236692093846346337460743176821.1456", ErrFixedOverflow},
+	} {
+		wide, err := WideFromDecimal(decimal.RequireFromString(test.value), 4)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s returned error %v, expected %v", test.value, err, test.err)
+		}
+
+		if err == nil && !wide.Decimal(4).Equal(decimal.RequireFromString(test.value)) {
+			t.Fatalf("%s was converted back to %s", test.value, wide.Decimal(4))
+		}
+	}
+
+	// the largest total of two fixed point values is converted back and forth
+	total := MulFixed(math.MaxInt64, math.MaxInt64)
+	wide, err := WideFromDecimal(total.Decimal(6), 6)
+	if err != nil || wide.Cmp(total) != 0 {
+		t.Fatalf("%s was converted to %s (%v)", total.Decimal(6), wide.Decimal(6), err)
+	}
+}
+
+func TestWideArithmetic(t *testing.T) {
+	if total := MulFixed(150, 3); total.Cmp(Wide{lo: 450}) != 0 {
+		t.Fatalf("150 * 3 is %s", total.Decimal(0))
+	}
+
+	if total := MulFixed(-150, 3); !total.IsZero() {
+		t.Fatalf("the total of a negative price is %s", total.Decimal(0))
+	}
+
+	if carry := (Wide{lo: math.MaxUint64}).Add(Wide{lo: 1}); carry.Cmp(Wide{hi: 1}) != 0 {
+		t.Fatalf("the addition lost its carry, %s", carry.Decimal(0))
+	}
+
+	if borrow := (Wide{hi: 1}).Sub(Wide{lo: 1}); borrow.Cmp(Wide{lo: math.MaxUint64}) != 0 {
+		t.Fatalf("the subtraction lost its borrow, %s", borrow.Decimal(0))
+	}
+
+	if rest := (Wide{lo: 1}).Sub(Wide{lo: 2}); !rest.IsZero() {
+		t.Fatalf("1 - 2 is %s, expected it to stop at zero", rest.Decimal(0))
+	}
+}
+
+func TestWideDiv(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		wide     Wide
+		divisor  Fixed
+		quotient Fixed
+	}{
+		{"exact", MulFixed(150, 3), 150, 3},
+		{"rounded down", Wide{lo: 449}, 150, 2},
+		{"zero divisor", Wide{lo: 450}, 0, 0},
+		{"negative divisor", Wide{lo: 450}, -150, 0},
+		{"high bits above the divisor", Wide{hi: 1}, 1, math.MaxInt64},
+		{"quotient above an int64", Wide{lo: math.MaxUint64}, 1, math.MaxInt64},
+		{"largest quotient", MulFixed(math.MaxInt64, 7), 7, math.MaxInt64},
+		{"high bits below the divisor", Wide{hi: 1}, 4, 1 << 62},
+	} {
+		if quotient := test.wide.Div(test.divisor); quotient != test.quotient {
+			t.Fatalf("%s: %s / %d is %d, expected %d", test.name, test.wide.Decimal(0), test.divisor, quotient, test.quotient)
+		}
+	}
+}
+
+func TestGrpcDecimal(t *testing.T) {
+	// the trailing zeros of a coefficient which doesn't fit an int64 are moved to the exponent
+	value, err := GrpcDecimal(decimal.RequireFromString("100000000000000000000"))
+	if err != nil || value.Val != 1e18 || value.Exp != 2 {
+		t.Fatalf("1e20 is %v (%v)", value, err)
+	}
+
+	if _, err := GrpcDecimal(decimal.RequireFromString("100000000000000000001")); !errors.Is(err, ErrFixedOverflow) {
+		t.Fatalf("a coefficient which doesn't fit an int64 returned %v", err)
+	}
+}
+
+// TestOrderToFixed converts the orders entering the engine, only the budget of an order placed by
+// quote volume is scaled to the totals of the market.
+func TestOrderToFixed(t *testing.T) {
+	market_config := DefaultMarketConfig()
+	market_config.PricePrecision = 2
+	market_config.AmountPrecision = 4
+
+	order := newBenchmarkOrder(1, pkg.SideBuy, 100, 2)
+	order.FilledQuantity = decimal.RequireFromString("0.5")
+	if err := order.toFixed(market_config); err != nil {
+		t.Fatalf("limit order refused: %v", err)
+	}
+
+	if order.price != 10000 || order.quantity != 20000 || order.UnfilledQuantity() != 15000 || order.IsQuote() {
+		t.Fatalf("limit order converted to price %d quantity %d unfilled %d", order.price, order.quantity, order.UnfilledQuantity())
+	}
+
+	order.QuoteQuantity = decimal.RequireFromString("10.5")
+	order.FilledQuoteQuantity = decimal.RequireFromString("0.25")
+	if err := order.toFixed(market_config); err != nil {
+		t.Fatalf("quote order refused: %v", err)
+	}
+
+	if !order.IsQuote() || !order.UnfilledQuoteQuantity().Decimal(market_config.TotalScale()).Equal(decimal.RequireFromString("10.25")) {
+		t.Fatalf("quote order has %s left to spend", order.UnfilledQuoteQuantity().Decimal(market_config.TotalScale()))
+	}
+
+	for _, field := range []*decimal.Decimal{&order.Price, &order.Quantity, &order.FilledQuoteQuantity} {
+		value := *field
+		*field = decimal.RequireFromString("-0.000001")
+
+		if err := order.toFixed(market_config); err == nil {
+			t.Fatalf("order with a value of %s accepted", *field)
+		}
+
+		*field = value
+	}
+}
@@ -0,0 +1,129 @@
+package matching
+
+import (
+	"github.com/emirpasic/gods/trees/redblacktree"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/zsmartex/pkg"
+)
+
+// L3 messages sent to the websocket with the l3 event.
+const (
+	// L3Add is a new order resting in the book behind the others of its price
+	L3Add = "add"
+	// L3Modify is a resting order whose quantity was reduced, it keeps its priority
+	L3Modify = "modify"
+	// L3Cancel is an order which left the book without being filled
+	L3Cancel = "cancel"
+	// L3Execute is a trade against a resting order, the order leaves the book when nothing is left of it
+	L3Execute = "execute"
+)
+
+// L3Message is an order by order change of the book. Orders are identified by their UUID,
+// never by their member, and only the displayed quantity of iceberg orders is sent.
+type L3Message struct {
+	Sequence int64         `json:"sequence"`
+	Type     string        `json:"type"`
+	OrderID  uuid.UUID     `json:"order_id"`
+	Side     pkg.OrderSide `json:"side"`
+	// Price is the price the order rests at, the trades of an auction are made at the auction price
+	Price decimal.Decimal `json:"price"`
+	// Quantity is the quantity displayed in the book, or the executed quantity for an execute message
+	Quantity decimal.Decimal `json:"quantity"`
+}
+
+// L3Order is a resting order of the L3 snapshot.
+type L3Order struct {
+	OrderID  uuid.UUID       `json:"order_id"`
+	Price    decimal.Decimal `json:"price"`
+	Quantity decimal.Decimal `json:"quantity"`
+}
+
+// L3Snapshot is the book order by order, in priority order from the best price. Sequence is
+// the sequence of the last message applied to it.
+type L3Snapshot struct {
+	Symbol   pkg.Symbol `json:"symbol"`
+	Sequence int64      `json:"sequence"`
+	Asks     []L3Order  `json:"asks"`
+	Bids     []L3Order  `json:"bids"`
+}
+
+// L3Publisher sends the order by order changes of the book to the websocket, next to the
+// price levels sent by Notification. Each message has the next sequence so a gap tells the
+// client to fetch a new snapshot.
+type L3Publisher struct {
+	Symbol   pkg.Symbol
+	Sequence int64
+	// Publisher sends the messages to the websocket, they are only counted when it is nil
+	Publisher Publisher
+}
+
+func NewL3Publisher(symbol pkg.Symbol) *L3Publisher {
+	return &L3Publisher{
+		Symbol:    symbol,
+		Publisher: RangoPublisher{},
+	}
+}
+
+// newOfflineL3Publisher creates a publisher which only counts its messages.
+func newOfflineL3Publisher(symbol pkg.Symbol) *L3Publisher {
+	return &L3Publisher{
+		Symbol: symbol,
+	}
+}
+
+func (p *L3Publisher) publish(message_type string, o *Order, price, quantity decimal.Decimal) {
+	p.Sequence++
+
+	if p.Publisher == nil {
+		return
+	}
+
+	p.Publisher.Publish(p.Symbol, "l3", L3Message{
+		Sequence: p.Sequence,
+		Type:     message_type,
+		OrderID:  o.UUID,
+		Side:     o.Side,
+		Price:    price,
+		Quantity: quantity,
+	})
+}
+
+// L3Snapshot returns the resting orders of the book with their displayed quantity, limit is the
+// number of price levels of each side, every level is returned if it isn't positive.
+func (d *Depth) L3Snapshot(limit int64) *L3Snapshot {
+	return &L3Snapshot{
+		Symbol:   d.Symbol,
+		Sequence: d.L3.Sequence,
+		Asks:     d.l3Orders(d.Asks, limit),
+		Bids:     d.l3Orders(d.Bids, limit),
+	}
+}
+
+func (d *Depth) l3Orders(price_levels *redblacktree.Tree, limit int64) []L3Order {
+	orders := make([]L3Order, 0)
+
+	var i int64
+	it := price_levels.Iterator()
+	for it.Next() && (limit <= 0 || i < limit) {
+		price_level := it.Value().(*PriceLevel)
+		price := d.PriceScale.Decimal(price_level.Price)
+
+		for o := price_level.Top(); o != nil; o = price_level.Next(o) {
+			if o.Visible() <= 0 {
+				continue
+			}
+
+			orders = append(orders, L3Order{
+				OrderID:  o.UUID,
+				Price:    price,
+				Quantity: d.AmountScale.Decimal(o.Visible()),
+			})
+		}
+
+		i++
+	}
+
+	return orders
+}
@@ -0,0 +1,66 @@
+package matching
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/zsmartex/finex/types"
+)
+
+// DEFAULT_PRECISION is the number of decimals of the prices and the quantities of a market which has no settings.
+const DEFAULT_PRECISION = 8
+
+// MarketConfig holds the per market settings enforced by the engine.
+type MarketConfig struct {
+	SelfTradePrevention types.SelfTradePrevention
+
+	// TradingState is the state the market starts in, it is changed by ActionSetTradingState
+	TradingState types.TradingState
+
+	// MatchingAlgorithm is how the quantity taken from a price level is split between its orders
+	MatchingAlgorithm types.MatchingAlgorithm
+
+	// PricePrecision and AmountPrecision are the number of decimals of the prices and the quantities,
+	// the engine matches them as fixed point values of these scales. Orders placed by quote volume
+	// buy quantities rounded down to the amount precision.
+	PricePrecision  int32
+	AmountPrecision int32
+
+	// TradingRules are checked again by the engine on the orders submitted to the market,
+	// the orders loaded when the engine starts were checked when they were placed
+	TradingRules TradingRules
+
+	// PriceBand is the largest deviation from the market price, in percent, an order can trade at
+	PriceBand decimal.Decimal
+
+	// CircuitBreakerPercent halts the market for CircuitBreakerHalt when its price
+	// moves by more than this percent within CircuitBreakerWindow
+	CircuitBreakerPercent decimal.Decimal
+	CircuitBreakerWindow  time.Duration
+	CircuitBreakerHalt    time.Duration
+}
+
+// DefaultMarketConfig returns the settings used when the market has none.
+func DefaultMarketConfig() MarketConfig {
+	return MarketConfig{
+		SelfTradePrevention: types.SelfTradePreventionNone,
+		MatchingAlgorithm:   types.MatchingAlgorithmFIFO,
+		TradingState:        types.TradingStateTrading,
+		PricePrecision:      DEFAULT_PRECISION,
+		AmountPrecision:     DEFAULT_PRECISION,
+	}
+}
+
+func (c MarketConfig) PriceScale() Scale {
+	return Scale(c.PricePrecision)
+}
+
+func (c MarketConfig) AmountScale() Scale {
+	return Scale(c.AmountPrecision)
+}
+
+// TotalScale is the scale of the prices multiplied by the quantities.
+func (c MarketConfig) TotalScale() Scale {
+	return Scale(c.PricePrecision + c.AmountPrecision)
+}
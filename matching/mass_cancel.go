@@ -0,0 +1,129 @@
+package matching
+
+import (
+	"math"
+
+	"github.com/emirpasic/gods/trees/redblacktree"
+	"github.com/shopspring/decimal"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/pkg"
+)
+
+// MassCancel selects the orders cancelled by ActionMassCancel, the zero values select every order.
+type MassCancel struct {
+	MemberID int64         `json:"member_id,omitempty"`
+	Side     pkg.OrderSide `json:"side,omitempty"`
+	// PriceFrom and PriceTo bound the limit price of the cancelled orders, both are included.
+	// The orders without limit price aren't cancelled when a bound is given.
+	PriceFrom decimal.Decimal `json:"price_from"`
+	PriceTo   decimal.Decimal `json:"price_to"`
+	// RequestID identifies the mass cancel to its sender, which fetches how many orders it cancelled
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// priceRange returns the bounds of the prices of the cancelled orders in the scale of the market.
+func (m *MassCancel) priceRange(scale Scale) (low, high Fixed, err error) {
+	low, high = 0, math.MaxInt64
+
+	if m.PriceFrom.IsPositive() {
+		if low, err = scale.Ceil(m.PriceFrom); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if m.PriceTo.IsPositive() {
+		if high, err = scale.Floor(m.PriceTo); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return low, high, nil
+}
+
+// selects returns true if the order is cancelled by the mass cancel, the fake orders are never cancelled.
+func (m *MassCancel) selects(o *Order, low, high Fixed) bool {
+	if o.IsFake() {
+		return false
+	}
+
+	if m.MemberID != 0 && o.MemberID != m.MemberID {
+		return false
+	}
+
+	if len(m.Side) > 0 && o.Side != m.Side {
+		return false
+	}
+
+	return o.price >= low && o.price <= high
+}
+
+// MassCancel cancels the orders of the book and the stop orders selected by the mass cancel in a
+// single pass, each of them is sent to order_processor. It returns how many orders were cancelled,
+// the other orders of their OCO pairs are cancelled with them but aren't counted.
+func (ob *OrderBook) MassCancel(mass_cancel *MassCancel) int {
+	if !ob.TradingState.AcceptsCancels() {
+		config.Logger.Debugf("[oceanbook.orderbook] mass cancel ignored, the market is %s", ob.TradingState)
+		return 0
+	}
+
+	low, high, err := mass_cancel.priceRange(ob.Config.PriceScale())
+	if err != nil {
+		config.Logger.Errorf("[oceanbook.orderbook] mass cancel ignored, %s", err)
+		return 0
+	}
+
+	resting := make([]*Order, 0)
+	for _, price_levels := range []*redblacktree.Tree{ob.Depth.Asks, ob.Depth.Bids} {
+		it := price_levels.Iterator()
+		for it.Next() {
+			price_level := it.Value().(*PriceLevel)
+			if price_level.Price < low || price_level.Price > high {
+				continue
+			}
+
+			for o := price_level.Top(); o != nil; o = price_level.Next(o) {
+				if mass_cancel.selects(o, low, high) {
+					resting = append(resting, o)
+				}
+			}
+		}
+	}
+
+	stops := make([]*Order, 0)
+	for _, book := range []*redblacktree.Tree{ob.StopAsks, ob.StopBids, ob.TrailingStops} {
+		it := book.Iterator()
+		for it.Next() {
+			if o := it.Value().(*Order); mass_cancel.selects(o, low, high) {
+				stops = append(stops, o)
+			}
+		}
+	}
+
+	count := 0
+	for i, o := range append(resting, stops...) {
+		// the order was already cancelled with the other order of its OCO pair
+		if o.Cancelled {
+			continue
+		}
+
+		o.Cancelled = true
+		if i < len(resting) {
+			ob.Depth.RemoveOrder(o)
+		} else {
+			ob.removeStopOrder(o)
+		}
+
+		ob.cancelAfterTrades(o, nil)
+		ob.cancelOcoOrder(o)
+		count++
+	}
+
+	if ob.Auction && count > 0 {
+		ob.PublishIndicativePrice()
+	}
+
+	config.Logger.Debugf("[oceanbook.orderbook] mass cancel of member %d cancelled %d orders", mass_cancel.MemberID, count)
+
+	return count
+}
@@ -1,6 +1,7 @@
 package matching
 
 import (
+	"errors"
 	"strconv"
 	"strings"
 	"sync"
@@ -11,6 +12,25 @@ import (
 	"github.com/zsmartex/pkg"
 )
 
+// NOTIFICATION_PERIOD is the period between two depth events of a market.
+var NOTIFICATION_PERIOD = 100 * time.Millisecond
+
+// DEPTH_REPLAY_CAP is the number of depth events kept to be sent again to the clients which missed some.
+var DEPTH_REPLAY_CAP int64 = 600
+
+// ErrDepthReplayUnavailable is returned when depth events to replay are no longer kept.
+var ErrDepthReplayUnavailable = errors.New("depth events are no longer available")
+
+// DepthDelta is a depth event, the price levels changed since the previous one with their new
+// amount, zero for a removed level. Checksum is the one of the book once they are applied,
+// see Depth.Checksum.
+type DepthDelta struct {
+	Asks     [][]decimal.Decimal `json:"asks"`
+	Bids     [][]decimal.Decimal `json:"bids"`
+	Sequence int64               `json:"sequence"`
+	Checksum uint32              `json:"checksum"`
+}
+
 type Book struct {
 	Asks [][]decimal.Decimal
 	Bids [][]decimal.Decimal
@@ -20,19 +40,19 @@ type Notification struct {
 	Symbol    pkg.Symbol // instrument name
 	Sequence  int64
 	BookCache *Book // cache for notify to websocket
+	// Publisher sends the events to the websocket, they are dropped when it is nil
+	Publisher Publisher
+	// persistent keeps the sequence in Redis so it goes on after a restart
+	persistent bool
+
+	// deltas are the last depth events, indexed by their sequence modulo DEPTH_REPLAY_CAP
+	deltas []DepthDelta
 
 	NotifyMutex sync.RWMutex
 }
 
 func NewNotification(symbol pkg.Symbol) *Notification {
-	notification := &Notification{
-		Symbol:   symbol,
-		Sequence: 0,
-		BookCache: &Book{
-			Asks: make([][]decimal.Decimal, 0),
-			Bids: make([][]decimal.Decimal, 0),
-		},
-	}
+	notification := newNotification(symbol)
 
 	exist, _ := config.Redis.Exist("finex:" + strings.ToLower(symbol.ToSymbol("")) + ":depth:sequence")
 	if exist {
@@ -49,44 +69,101 @@ func NewNotification(symbol pkg.Symbol) *Notification {
 		notification.Sequence = sq
 	}
 
-	notification.Start()
+	notification.Publisher = RangoPublisher{}
+	notification.persistent = true
 
 	return notification
 }
 
-func (n *Notification) Start() {
-	go n.StartLoop()
+func newNotification(symbol pkg.Symbol) *Notification {
+	return &Notification{
+		Symbol:   symbol,
+		Sequence: 0,
+		BookCache: &Book{
+			Asks: make([][]decimal.Decimal, 0),
+			Bids: make([][]decimal.Decimal, 0),
+		},
+		deltas: make([]DepthDelta, DEPTH_REPLAY_CAP),
+	}
 }
 
-func (n *Notification) StartLoop() {
-	for {
-		time.Sleep(100 * time.Millisecond)
+// Enqueue sends a public event of the market to the websocket, it is dropped if there is no publisher.
+func (n *Notification) Enqueue(event string, payload interface{}) {
+	if n.Publisher == nil {
+		return
+	}
 
-		if len(n.BookCache.Asks) == 0 && len(n.BookCache.Bids) == 0 {
-			continue
-		}
+	n.Publisher.Publish(n.Symbol, event, payload)
+}
+
+// Flush sends the price levels changed since the previous flush as the next depth event and keeps
+// it to be replayed. Checksum is only called when there are changes.
+func (n *Notification) Flush(checksum func() uint32) {
+	n.NotifyMutex.Lock()
+	defer n.NotifyMutex.Unlock()
+
+	if len(n.BookCache.Asks) == 0 && len(n.BookCache.Bids) == 0 {
+		return
+	}
 
-		n.NotifyMutex.Lock()
+	n.Sequence++
 
-		n.Sequence++
+	delta := DepthDelta{
+		Asks:     n.BookCache.Asks,
+		Bids:     n.BookCache.Bids,
+		Sequence: n.Sequence,
+		Checksum: checksum(),
+	}
+	n.deltas[n.Sequence%DEPTH_REPLAY_CAP] = delta
+
+	n.BookCache.Asks = make([][]decimal.Decimal, 0)
+	n.BookCache.Bids = make([][]decimal.Decimal, 0)
+
+	if n.persistent {
 		config.Redis.Set("finex:"+strings.ToLower(n.Symbol.ToSymbol(""))+":depth:sequence", n.Sequence, 0)
+	}
+
+	n.Enqueue("depth", delta)
+}
 
-		asks_depth := make([][]decimal.Decimal, 0)
-		bids_depth := make([][]decimal.Decimal, 0)
+// Deltas returns the depth events from sequence from to sequence to included, or up to the last one
+// when to isn't positive. The events sent before the last DEPTH_REPLAY_CAP ones or before the engine
+// started are gone, the client has to fetch the depth again.
+func (n *Notification) Deltas(from, to int64) ([]DepthDelta, error) {
+	n.NotifyMutex.RLock()
+	defer n.NotifyMutex.RUnlock()
 
-		asks_depth = append(asks_depth, n.BookCache.Asks...)
-		bids_depth = append(bids_depth, n.BookCache.Bids...)
+	if to <= 0 || to > n.Sequence {
+		to = n.Sequence
+	}
 
-		config.RangoClient.EnqueueEvent(pkg.EnqueueEventKindPublic, strings.ToLower(n.Symbol.ToSymbol("")), "depth", pkg.DepthJSON{
-			Asks:     asks_depth,
-			Bids:     bids_depth,
-			Sequence: n.Sequence,
-		})
+	deltas := make([]DepthDelta, 0)
+	if from > to {
+		return deltas, nil
+	}
 
-		n.BookCache.Asks = make([][]decimal.Decimal, 0)
-		n.BookCache.Bids = make([][]decimal.Decimal, 0)
-		n.NotifyMutex.Unlock()
+	if from <= 0 || to-from >= DEPTH_REPLAY_CAP {
+		return nil, ErrDepthReplayUnavailable
 	}
+
+	for sequence := from; sequence <= to; sequence++ {
+		delta := n.deltas[sequence%DEPTH_REPLAY_CAP]
+		if delta.Sequence != sequence {
+			return nil, ErrDepthReplayUnavailable
+		}
+
+		deltas = append(deltas, delta)
+	}
+
+	return deltas, nil
+}
+
+// CurrentSequence returns the sequence of the last depth event sent to the websocket.
+func (n *Notification) CurrentSequence() int64 {
+	n.NotifyMutex.RLock()
+	defer n.NotifyMutex.RUnlock()
+
+	return n.Sequence
 }
 
 func (n *Notification) Publish(side pkg.OrderSide, price, amount decimal.Decimal) {
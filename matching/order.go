@@ -0,0 +1,317 @@
+package matching
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/zsmartex/finex/types"
+	"github.com/zsmartex/pkg"
+)
+
+// Order is the order kept by the engine, it wraps pkg.Order with the
+// attributes that only the finex matching engine knows about.
+type Order struct {
+	pkg.Order
+	TimeInForce     types.TimeInForce `json:"time_in_force"`
+	DisplayQuantity decimal.Decimal   `json:"display_quantity"`
+	TrailingOffset  decimal.Decimal   `json:"trailing_offset"`
+	TrailingPercent decimal.Decimal   `json:"trailing_percent"`
+
+	// TriggerPrice is the price a stop order is triggered at, it follows the market price for trailing stops
+	TriggerPrice decimal.Decimal `json:"trigger_price"`
+
+	// VisibleQuantity is what is left of the displayed slice of an iceberg order
+	VisibleQuantity decimal.Decimal `json:"visible_quantity,omitempty"`
+	// Priority is the time priority of the order inside its price level, lower goes first
+	Priority int64 `json:"priority,omitempty"`
+
+	// OcoID is the id of the other order of an OCO pair, it is cancelled once this one trades or is triggered
+	OcoID int64 `json:"oco_id,omitempty"`
+
+	// QuoteQuantity is the budget of a buy market order placed by quote volume, the order
+	// is matched until the budget is spent whatever quantity it buys
+	QuoteQuantity decimal.Decimal `json:"quote_quantity,omitempty"`
+	// FilledQuoteQuantity is the part of the budget spent by the trades of the order
+	FilledQuoteQuantity decimal.Decimal `json:"filled_quote_quantity,omitempty"`
+
+	// Budget caps the total of the trades of a buy market order placed by quantity, it is what the
+	// order locked, at the trigger price for a stop market order which can be triggered higher
+	Budget decimal.Decimal `json:"budget,omitempty"`
+	// FilledBudget is the part of the budget spent by the trades of the order
+	FilledBudget decimal.Decimal `json:"filled_budget,omitempty"`
+
+	// price, quantity... are the fixed point values the order is matched with, the decimal
+	// fields are converted to them when the order enters the engine and back when it leaves it
+	price               Fixed
+	quantity            Fixed
+	filledQuantity      Fixed
+	displayQuantity     Fixed
+	visibleQuantity     Fixed
+	quoteQuantity       Wide
+	filledQuoteQuantity Wide
+	budget              Wide
+	filledBudget        Wide
+
+	// stopPrice, triggerPrice and trailingOffset are scaled by the price precision,
+	// trailingPercent by PERCENT_SCALE
+	stopPrice       Fixed
+	triggerPrice    Fixed
+	trailingOffset  Fixed
+	trailingPercent Fixed
+
+	// prev and next link the order to the others of its price level
+	prev *Order
+	next *Order
+	// levelTotal and levelVisible are the quantities its price level counts for the order
+	levelTotal   Fixed
+	levelVisible Fixed
+}
+
+// toFixed converts the decimals of an order entering the engine to the scales of the market.
+func (o *Order) toFixed(c MarketConfig) (err error) {
+	price, amount, total := c.PriceScale(), c.AmountScale(), c.TotalScale()
+
+	for _, field := range []struct {
+		name  string
+		value decimal.Decimal
+		fixed *Fixed
+	}{
+		{"price", o.Price, &o.price},
+		{"stop price", o.StopPrice, &o.stopPrice},
+		{"trailing offset", o.TrailingOffset, &o.trailingOffset},
+	} {
+		if *field.fixed, err = price.FromDecimal(field.value); err != nil {
+			return fmt.Errorf("%s %s: %w", field.name, field.value, err)
+		}
+	}
+
+	if o.trailingPercent, err = PERCENT_SCALE.Floor(o.TrailingPercent); err != nil {
+		return fmt.Errorf("trailing percent %s: %w", o.TrailingPercent, err)
+	}
+
+	// the trigger price of a stop order restored from a snapshot is rounded as Trail rounds it
+	trigger_price := price.Floor
+	if o.Side == pkg.SideSell {
+		trigger_price = price.Ceil
+	}
+
+	if o.triggerPrice, err = trigger_price(o.TriggerPrice); err != nil {
+		return fmt.Errorf("trigger price %s: %w", o.TriggerPrice, err)
+	}
+
+	for _, field := range []struct {
+		name  string
+		value decimal.Decimal
+		fixed *Fixed
+	}{
+		{"quantity", o.Quantity, &o.quantity},
+		{"filled quantity", o.FilledQuantity, &o.filledQuantity},
+		{"display quantity", o.DisplayQuantity, &o.displayQuantity},
+		{"visible quantity", o.VisibleQuantity, &o.visibleQuantity},
+	} {
+		if *field.fixed, err = amount.FromDecimal(field.value); err != nil {
+			return fmt.Errorf("%s %s: %w", field.name, field.value, err)
+		}
+	}
+
+	if o.quoteQuantity, err = WideFromDecimal(o.QuoteQuantity, total); err != nil {
+		return fmt.Errorf("quote quantity %s: %w", o.QuoteQuantity, err)
+	}
+
+	if o.filledQuoteQuantity, err = WideFromDecimal(o.FilledQuoteQuantity, total); err != nil {
+		return fmt.Errorf("filled quote quantity %s: %w", o.FilledQuoteQuantity, err)
+	}
+
+	if o.budget, err = WideFromDecimal(o.Budget, total); err != nil {
+		return fmt.Errorf("budget %s: %w", o.Budget, err)
+	}
+
+	if o.filledBudget, err = WideFromDecimal(o.FilledBudget, total); err != nil {
+		return fmt.Errorf("filled budget %s: %w", o.FilledBudget, err)
+	}
+
+	return nil
+}
+
+// toDecimal writes the fixed point values the engine changes back to the decimals of the order.
+func (o *Order) toDecimal(c MarketConfig) {
+	o.Quantity = c.AmountScale().Decimal(o.quantity)
+	o.FilledQuantity = c.AmountScale().Decimal(o.filledQuantity)
+	o.VisibleQuantity = c.AmountScale().Decimal(o.visibleQuantity)
+	o.TriggerPrice = c.PriceScale().Decimal(o.triggerPrice)
+
+	if o.IsQuote() {
+		o.FilledQuoteQuantity = o.filledQuoteQuantity.Decimal(c.TotalScale())
+	}
+
+	if o.HasBudget() {
+		o.FilledBudget = o.filledBudget.Decimal(c.TotalScale())
+	}
+}
+
+// Copy returns a copy of the order which isn't linked to its price level.
+func (o *Order) Copy() *Order {
+	order := *o
+	order.prev = nil
+	order.next = nil
+
+	return &order
+}
+
+// IsPostOnly returns true if the order must never take liquidity.
+func (o *Order) IsPostOnly() bool {
+	return o.TimeInForce == types.TimeInForcePostOnly
+}
+
+// IsImmediate returns true if the unfilled quantity must not rest in the book.
+func (o *Order) IsImmediate() bool {
+	return o.TimeInForce == types.TimeInForceIOC || o.TimeInForce == types.TimeInForceFOK
+}
+
+// IsFillOrKill returns true if the order must be filled completely or not at all.
+func (o *Order) IsFillOrKill() bool {
+	return o.TimeInForce == types.TimeInForceFOK
+}
+
+// IsIceberg returns true if only a slice of the order is shown in the book.
+func (o *Order) IsIceberg() bool {
+	return o.displayQuantity > 0 && o.displayQuantity < o.quantity
+}
+
+// IsCrossed returns true if the order can trade at the price.
+func (o *Order) IsCrossed(price Fixed) bool {
+	if o.Type == pkg.TypeMarket {
+		return true
+	}
+
+	if o.Side == pkg.SideBuy {
+		return price <= o.price
+	}
+
+	return price >= o.price
+}
+
+// UnfilledQuantity returns the quantity left to match.
+func (o *Order) UnfilledQuantity() Fixed {
+	return o.quantity - o.filledQuantity
+}
+
+// Visible returns the quantity of the order exposed in the public book.
+func (o *Order) Visible() Fixed {
+	if !o.IsIceberg() {
+		return o.UnfilledQuantity()
+	}
+
+	return MinFixed(o.visibleQuantity, o.UnfilledQuantity())
+}
+
+// Replenish shows a new slice of an iceberg order.
+func (o *Order) Replenish() {
+	o.visibleQuantity = MinFixed(o.displayQuantity, o.UnfilledQuantity())
+}
+
+// Fill fills the order and consumes the displayed slice of an iceberg order.
+func (o *Order) Fill(quantity Fixed) {
+	o.filledQuantity += quantity
+
+	if o.IsIceberg() {
+		o.visibleQuantity -= quantity
+	}
+}
+
+// IsQuote returns true if the order is matched against a quote budget instead of a quantity.
+func (o *Order) IsQuote() bool {
+	return !o.quoteQuantity.IsZero()
+}
+
+// UnfilledQuoteQuantity returns what is left of the budget of an order placed by quote volume.
+func (o *Order) UnfilledQuoteQuantity() Wide {
+	return o.quoteQuantity.Sub(o.filledQuoteQuantity)
+}
+
+// HasBudget returns true if the total of the trades of an order placed by quantity is capped.
+func (o *Order) HasBudget() bool {
+	return !o.budget.IsZero()
+}
+
+// UnfilledBudget returns what is left of the budget of an order placed by quantity.
+func (o *Order) UnfilledBudget() Wide {
+	return o.budget.Sub(o.filledBudget)
+}
+
+// Filled returns true if nothing is left to match, an order placed by quote volume is filled once its budget is spent.
+func (o *Order) Filled() bool {
+	if o.IsQuote() {
+		return o.UnfilledQuoteQuantity().IsZero()
+	}
+
+	if o.HasBudget() && o.UnfilledBudget().IsZero() {
+		return true
+	}
+
+	return o.filledQuantity >= o.quantity
+}
+
+// Spend records the quote quantity spent by a trade of an order with a budget.
+func (o *Order) Spend(total Wide) {
+	if o.IsQuote() {
+		o.filledQuoteQuantity = o.filledQuoteQuantity.Add(total)
+	}
+
+	if o.HasBudget() {
+		o.filledBudget = o.filledBudget.Add(total)
+	}
+}
+
+// IsStop returns true if the order waits for its trigger price before being matched.
+func (o *Order) IsStop() bool {
+	return o.stopPrice > 0 || o.IsTrailing()
+}
+
+// IsTrailing returns true if the trigger price of the order follows the market price.
+func (o *Order) IsTrailing() bool {
+	return o.trailingOffset > 0 || o.trailingPercent > 0
+}
+
+// IsTriggered returns true if a stop order must be matched at the given market price,
+// sell stops are triggered when the price falls to the trigger price and buy stops when it rises to it.
+func (o *Order) IsTriggered(price Fixed) bool {
+	if o.Side == pkg.SideSell {
+		return price <= o.triggerPrice
+	}
+
+	return price >= o.triggerPrice
+}
+
+// Trail moves the trigger price of a trailing stop behind the market price, it only moves
+// up for sell orders and down for buy orders. The distance of a trailing percent is rounded
+// down to the price precision.
+func (o *Order) Trail(price Fixed) {
+	distance := o.trailingOffset
+	if distance <= 0 {
+		distance = percentOf(price, o.trailingPercent)
+	}
+
+	if o.Side == pkg.SideSell {
+		trigger_price := price - distance
+		if o.triggerPrice == 0 || trigger_price > o.triggerPrice {
+			o.triggerPrice = trigger_price
+		}
+	} else {
+		trigger_price := price + distance
+		if o.triggerPrice == 0 || trigger_price < o.triggerPrice {
+			o.triggerPrice = trigger_price
+		}
+	}
+}
+
+// stopKey returns the key of a stop order waiting for its trigger price in the stop orders of its side.
+func (o *Order) stopKey() *StopKey {
+	return &StopKey{
+		ID:        o.ID,
+		Side:      o.Side,
+		StopPrice: o.stopPrice,
+		CreatedAt: o.CreatedAt,
+	}
+}
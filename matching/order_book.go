@@ -3,32 +3,59 @@ package matching
 import (
 	"os"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/emirpasic/gods/trees/redblacktree"
+	"github.com/emirpasic/gods/utils"
 	"github.com/shopspring/decimal"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/types"
 	"github.com/zsmartex/pkg"
 	GrpcEngine "github.com/zsmartex/pkg/Grpc/engine"
 	GrpcOrder "github.com/zsmartex/pkg/Grpc/order"
 	GrpcQuantex "github.com/zsmartex/pkg/Grpc/quantex"
 	GrpcSymbol "github.com/zsmartex/pkg/Grpc/symbol"
-	GrpcUtils "github.com/zsmartex/pkg/Grpc/utils"
 	clientQuantex "github.com/zsmartex/pkg/client/quantex"
 )
 
 type OrderBook struct {
-	matchMutex         sync.Mutex
-	orderMutex         sync.Mutex
 	Symbol             pkg.Symbol
-	MarketPrice        decimal.Decimal
+	MarketPrice        Fixed
 	Depth              *Depth
 	StopBids           *redblacktree.Tree
 	StopAsks           *redblacktree.Tree
+	TrailingStops      *redblacktree.Tree
+	Config             MarketConfig
+	Producer           Producer
 	pendingOrdersQueue *OrderQueue
 	quantexClient      *clientQuantex.GrpcQuantexClient
+
+	// ocoOrders are the orders of OCO pairs which neither traded nor were triggered yet, by id
+	ocoOrders map[int64]*Order
+
+	// TradingState is what the market accepts, see SetTradingState
+	TradingState types.TradingState
+	// Auction is true while the orders are collected without being matched, see StartAuction
+	Auction bool
+	// HaltedUntil is the end of the halt of the market after its circuit breaker tripped
+	HaltedUntil time.Time
+	// tradePrices are the prices of the trades inside the circuit breaker window
+	tradePrices []tradePrice
+	// Clock returns the time the circuit breaker is checked at, the time of the message being
+	// processed so a replay sees the same time as the engine. It is time.Now if nil.
+	Clock func() time.Time
+
+	// Silent drops the events sent to the settlement workers, it is set while replaying
+	// messages which were already processed before the engine restarted.
+	Silent bool
+
+	// tradingRules, priceBandPercent and circuitBreakerPercent are the settings of Config the orders are
+	// checked against, converted to fixed point values when the book is built
+	tradingRules          tradingRules
+	priceBandPercent      Fixed
+	circuitBreakerPercent Fixed
 }
 
 const (
@@ -36,10 +63,19 @@ const (
 	pendingOrdersCap int64 = 1024
 )
 
-// StopComparator is used for comparing Key.
+// StopKey is the key of a stop order waiting for its trigger price, its stop price is scaled by the price precision.
+type StopKey struct {
+	ID        int64
+	Side      pkg.OrderSide
+	StopPrice Fixed
+	CreatedAt time.Time
+}
+
+// StopComparator is used for comparing StopKey, the stop order triggered first is on the left:
+// the highest sell stop, the lowest buy stop and the oldest one when they have the same stop price.
 func StopComparator(a, b interface{}) (result int) {
-	this := a.(*pkg.OrderKey)
-	that := b.(*pkg.OrderKey)
+	this := a.(*StopKey)
+	that := b.(*StopKey)
 
 	if this.Side != that.Side {
 		config.Logger.Errorf("[oceanbook.orderbook] compare order with different sides")
@@ -49,32 +85,31 @@ func StopComparator(a, b interface{}) (result int) {
 		return
 	}
 
-	// based on ask
 	switch {
-	case this.Side == pkg.SideSell && this.StopPrice.LessThan(that.StopPrice):
-		result = 1
-
-	case this.Side == pkg.SideSell && this.StopPrice.GreaterThan(that.StopPrice):
+	case this.Side == pkg.SideSell && this.StopPrice > that.StopPrice:
 		result = -1
 
-	case this.Side == pkg.SideBuy && this.StopPrice.LessThan(that.StopPrice):
+	case this.Side == pkg.SideSell && this.StopPrice < that.StopPrice:
+		result = 1
+
+	case this.Side == pkg.SideBuy && this.StopPrice < that.StopPrice:
 		result = -1
 
-	case this.Side == pkg.SideBuy && this.StopPrice.GreaterThan(that.StopPrice):
+	case this.Side == pkg.SideBuy && this.StopPrice > that.StopPrice:
 		result = 1
 
 	default:
-		if this.CreatedAt.Before(that.CreatedAt) {
-			result = 1
-		} else {
+		if this.CreatedAt.Before(that.CreatedAt) || this.CreatedAt.Equal(that.CreatedAt) && this.ID < that.ID {
 			result = -1
+		} else {
+			result = 1
 		}
 	}
 
 	return
 }
 
-func NewOrderBook(symbol pkg.Symbol, market_price decimal.Decimal) *OrderBook {
+func NewOrderBook(symbol pkg.Symbol, market_price decimal.Decimal, market_config MarketConfig) *OrderBook {
 	var quantex_client *clientQuantex.GrpcQuantexClient
 	quantexEnabled, _ := strconv.ParseBool(os.Getenv("QUANTEX_ENABLED"))
 
@@ -82,21 +117,59 @@ func NewOrderBook(symbol pkg.Symbol, market_price decimal.Decimal) *OrderBook {
 		quantex_client = clientQuantex.NewQuantexClient()
 	}
 
+	return newOrderBook(symbol, market_price, market_config, NewDepth(symbol), config.KafkaProducer, quantex_client)
+}
+
+// NewOfflineOrderBook creates an order book which only sends its events to the given producer,
+// it does not talk to Redis, Rango or Quantex. Its websocket events are dropped unless publishers
+// are set on its notification and L3 feed.
+func NewOfflineOrderBook(symbol pkg.Symbol, market_price decimal.Decimal, market_config MarketConfig, producer Producer) *OrderBook {
+	return newOrderBook(symbol, market_price, market_config, NewOfflineDepth(symbol), producer, nil)
+}
+
+func newOrderBook(symbol pkg.Symbol, market_price decimal.Decimal, market_config MarketConfig, depth *Depth, producer Producer, quantex_client *clientQuantex.GrpcQuantexClient) *OrderBook {
+	depth.PriceScale = market_config.PriceScale()
+	depth.AmountScale = market_config.AmountScale()
+
 	ob := &OrderBook{
 		Symbol:             symbol,
-		MarketPrice:        market_price,
-		Depth:              NewDepth(symbol),
+		Depth:              depth,
 		StopBids:           redblacktree.NewWith(StopComparator),
 		StopAsks:           redblacktree.NewWith(StopComparator),
+		TrailingStops:      redblacktree.NewWith(utils.Int64Comparator),
+		Config:             market_config,
+		TradingState:       market_config.TradingState,
+		Producer:           producer,
 		pendingOrdersQueue: NewOrderQueue(pendingOrdersCap),
 		quantexClient:      quantex_client,
+		ocoOrders:          make(map[int64]*Order),
+		tradingRules:       market_config.TradingRules.toFixed(market_config),
 	}
 
+	// a percentage only overflows beyond billions of percents
+	ob.priceBandPercent, _ = PERCENT_SCALE.Floor(market_config.PriceBand)
+	ob.circuitBreakerPercent, _ = PERCENT_SCALE.Floor(market_config.CircuitBreakerPercent)
+	ob.loadMarketPrice(market_price)
+
 	return ob
 }
 
-func (ob *OrderBook) CalcMarketOrder(side pkg.OrderSide, quantity decimal.NullDecimal, volume decimal.NullDecimal) *GrpcEngine.CalcMarketOrderResponse {
-	zero := decimal.Zero
+// loadMarketPrice sets the market price of the book from the price of the last trade of the
+// market, it is rounded to the price precision.
+func (ob *OrderBook) loadMarketPrice(market_price decimal.Decimal) {
+	price, err := ob.Config.PriceScale().FromDecimal(market_price.Round(ob.Config.PricePrecision))
+	if err != nil {
+		config.Logger.Errorf("[oceanbook.orderbook] market price %s of %s ignored, %s", market_price, ob.Symbol.String(), err)
+		return
+	}
+
+	ob.MarketPrice = price
+}
+
+// CalcMarketOrder returns the quantity a market order of the given quantity or volume would trade
+// and the funds it locks, both are zero when the book can't fill it.
+func (ob *OrderBook) CalcMarketOrder(side pkg.OrderSide, quantity decimal.NullDecimal, volume decimal.NullDecimal) (*GrpcEngine.CalcMarketOrderResponse, error) {
+	amount_scale, total_scale := ob.Config.AmountScale(), ob.Config.TotalScale()
 
 	var book *redblacktree.Tree
 	if side == pkg.SideSell {
@@ -105,158 +178,288 @@ func (ob *OrderBook) CalcMarketOrder(side pkg.OrderSide, quantity decimal.NullDe
 		book = ob.Depth.Asks
 	}
 
-	var expected decimal.Decimal
-	required := decimal.Zero
+	// the expected quantity, or the expected volume of an order placed by quote volume
+	var expected Fixed
+	var expected_volume Wide
+	var err error
+
 	if quantity.Valid {
-		expected = quantity.Decimal
+		expected, err = amount_scale.FromDecimal(quantity.Decimal)
 	} else {
-		expected = volume.Decimal
+		expected_volume, err = WideFromDecimal(volume.Decimal, total_scale)
 	}
 
-	if expected.IsZero() {
-		return &GrpcEngine.CalcMarketOrderResponse{
-			Quantity: &GrpcUtils.Decimal{
-				Val: zero.CoefficientInt64(),
-				Exp: zero.Exponent(),
-			},
-			Locked: &GrpcUtils.Decimal{
-				Val: zero.CoefficientInt64(),
-				Exp: zero.Exponent(),
-			},
-		}
+	if err != nil {
+		return nil, err
 	}
 
-	order_quantity := decimal.Zero
+	// a sell order locks the quantity it sells, a buy order the total it spends
+	var order_quantity Fixed
+	var required Wide
+
 	it := book.Iterator()
-	for it.Next() && expected.IsPositive() {
+	for it.Next() && (expected > 0 || !expected_volume.IsZero()) {
 		pl := it.Value().(*PriceLevel)
 
 		if quantity.Valid {
-			v := decimal.Min(pl.Total(), expected)
-			order_quantity = order_quantity.Add(v)
-			expected = expected.Sub(v)
+			v := MinFixed(pl.Total(), expected)
+			order_quantity += v
+			expected -= v
 
-			if pl.Side == pkg.SideSell {
-				required = required.Add(pl.Price.Mul(v))
-			} else {
-				required = required.Add(v)
+			if side == pkg.SideBuy {
+				required = required.Add(MulFixed(pl.Price, v))
 			}
 		} else {
-			// Not ready now
-			v := decimal.Min(pl.Price.Mul(pl.Total()), expected)
+			// the quote volume is spent from the best price level
+			v := MulFixed(pl.Price, pl.Total())
+			if expected_volume.Cmp(v) < 0 {
+				v = expected_volume
+			}
+			q := v.Div(pl.Price)
 
-			required = required.Add(v)
-			expected = expected.Sub(v)
-			order_quantity = order_quantity.Add(v.Div(pl.Price))
+			expected_volume = expected_volume.Sub(v)
+			order_quantity += q
+
+			if side == pkg.SideBuy {
+				required = required.Add(v)
+			}
 		}
 	}
 
-	if !expected.IsZero() {
+	if expected > 0 || !expected_volume.IsZero() || order_quantity == 0 {
 		return &GrpcEngine.CalcMarketOrderResponse{
-			Quantity: &GrpcUtils.Decimal{
-				Val: zero.CoefficientInt64(),
-				Exp: zero.Exponent(),
-			},
-			Locked: &GrpcUtils.Decimal{
-				Val: zero.CoefficientInt64(),
-				Exp: zero.Exponent(),
-			},
+			Quantity: amount_scale.Grpc(0),
+			Locked:   amount_scale.Grpc(0),
+		}, nil
+	}
+
+	locked := amount_scale.Grpc(order_quantity)
+	if side == pkg.SideBuy {
+		if locked, err = GrpcDecimal(required.Decimal(total_scale)); err != nil {
+			return nil, err
 		}
 	}
 
 	return &GrpcEngine.CalcMarketOrderResponse{
-		Quantity: &GrpcUtils.Decimal{
-			Val: order_quantity.CoefficientInt64(),
-			Exp: order_quantity.Exponent(),
-		},
-		Locked: &GrpcUtils.Decimal{
-			Val: required.CoefficientInt64(),
-			Exp: required.Exponent(),
-		},
-	}
+		Quantity: amount_scale.Grpc(order_quantity),
+		Locked:   locked,
+	}, nil
 }
 
-func (ob *OrderBook) setMarketPrice(newPrice decimal.Decimal) {
-	previousPrice := ob.MarketPrice
+func (ob *OrderBook) setMarketPrice(newPrice Fixed) {
 	ob.MarketPrice = newPrice
 
-	if previousPrice.IsZero() {
-		return
-	}
+	ob.triggerStopOrders(newPrice)
+}
 
-	switch {
-	case newPrice.LessThan(previousPrice):
-		// price gone done, check stop asks
+// triggerStopOrders moves the stop orders reached by the market price into the pending orders queue.
+func (ob *OrderBook) triggerStopOrders(price Fixed) {
+	for _, book := range []*redblacktree.Tree{ob.StopAsks, ob.StopBids} {
 		for {
-			best := ob.StopBids.Right()
+			best := book.Left()
 			if best == nil {
 				break
 			}
 
-			bestOrder := best.Value.(*pkg.Order)
-			if bestOrder.StopPrice.LessThan(newPrice) {
+			bestOrder := best.Value.(*Order)
+			if !bestOrder.IsTriggered(price) {
 				break
 			}
 
-			config.Logger.Debugf("[oceanbook.orderbook] bid order %d with stop price %s enqueued", bestOrder.ID, bestOrder.Price)
+			config.Logger.Debugf("[oceanbook.orderbook] %s order %d with trigger price %s enqueued", bestOrder.Side, bestOrder.ID, ob.Config.PriceScale().Decimal(bestOrder.triggerPrice))
 
-			ob.StopBids.Remove(best.Key)
-			ob.pendingOrdersQueue.Push(bestOrder)
+			book.Remove(best.Key)
+			ob.triggerStopOrder(bestOrder)
 		}
+	}
 
-	case newPrice.GreaterThan(previousPrice):
-		// price gone done, check stop asks
-		for {
-			best := ob.StopAsks.Right()
-			if best == nil {
-				break
-			}
+	triggered := make([]*Order, 0)
+	it := ob.TrailingStops.Iterator()
+	for it.Next() {
+		order := it.Value().(*Order)
+		order.Trail(price)
 
-			bestOrder := best.Value.(*pkg.Order)
-			if bestOrder.StopPrice.GreaterThan(newPrice) {
-				break
-			}
+		if order.IsTriggered(price) {
+			triggered = append(triggered, order)
+		}
+	}
 
-			config.Logger.Debugf("[oceanbook.orderbook] ask order %d with stop price %s enqueued", bestOrder.ID, bestOrder.Price)
+	for _, order := range triggered {
+		config.Logger.Debugf("[oceanbook.orderbook] trailing %s order %d with trigger price %s enqueued", order.Side, order.ID, ob.Config.PriceScale().Decimal(order.triggerPrice))
 
-			ob.StopAsks.Remove(best.Key)
-			ob.pendingOrdersQueue.Push(bestOrder)
-		}
+		ob.TrailingStops.Remove(order.ID)
+		ob.triggerStopOrder(order)
+	}
+}
 
-	default:
-		// previous price equals to new price
+// triggerStopOrder queues a triggered stop order to be matched, the other order of its OCO pair is cancelled.
+func (ob *OrderBook) triggerStopOrder(o *Order) {
+	ob.PublishTrigger(o)
+	ob.cancelOcoOrder(o)
+	ob.pendingOrdersQueue.Push(o)
+}
+
+// removeStopOrder removes a stop order which waits for its trigger price.
+func (ob *OrderBook) removeStopOrder(o *Order) {
+	if o.IsTrailing() {
+		ob.TrailingStops.Remove(o.ID)
+	} else if o.Side == pkg.SideSell {
+		ob.StopAsks.Remove(o.stopKey())
+	} else {
+		ob.StopBids.Remove(o.stopKey())
+	}
+}
+
+// cancelOcoOrder cancels the other order of the OCO pair of an order which traded, was triggered
+// or left the book, the other order is removed from the book or from the stop orders.
+func (ob *OrderBook) cancelOcoOrder(o *Order) {
+	if o.OcoID == 0 {
+		return
+	}
+
+	delete(ob.ocoOrders, o.ID)
+
+	oco, found := ob.ocoOrders[o.OcoID]
+	if !found {
 		return
 	}
+
+	delete(ob.ocoOrders, oco.ID)
+
+	config.Logger.Debugf("[oceanbook.orderbook] order %d cancelled by its oco order %d", oco.ID, o.ID)
+
+	oco.Cancelled = true
+	if oco.IsStop() {
+		ob.removeStopOrder(oco)
+	} else {
+		ob.Depth.RemoveOrder(oco)
+	}
+
+	ob.PublishCancel(oco.Key())
 }
 
-func (ob *OrderBook) Add(o *pkg.Order) {
-	ob.orderMutex.Lock()
-	defer ob.orderMutex.Unlock()
+// addStopOrder keeps a stop order until the market price reaches its trigger price.
+func (ob *OrderBook) addStopOrder(o *Order) {
+	if ob.refuseOrder(o) {
+		return
+	}
+
+	if o.IsTrailing() {
+		if ob.MarketPrice <= 0 {
+			config.Logger.Debugf("[oceanbook.orderbook] trailing stop order %d rejected, the market has no price", o.ID)
 
-	if o.StopPrice.IsPositive() {
-		var book *redblacktree.Tree
-		switch o.Side {
-		case pkg.SideSell:
-			book = ob.StopAsks
-		case pkg.SideBuy:
-			book = ob.StopBids
+			ob.PublishReject(o.Key())
+			ob.cancelOcoOrder(o)
+			return
 		}
 
-		_, found := book.Get(o.Key())
-		if found {
+		if _, found := ob.TrailingStops.Get(o.ID); found {
 			return
 		}
 
-		book.Put(o.Key(), o)
+		o.Trail(ob.MarketPrice)
+		ob.TrailingStops.Put(o.ID, o)
+
+		return
+	}
+
+	var book *redblacktree.Tree
+	switch o.Side {
+	case pkg.SideSell:
+		book = ob.StopAsks
+	case pkg.SideBuy:
+		book = ob.StopBids
+	}
+
+	if _, found := book.Get(o.stopKey()); found {
+		return
+	}
+
+	o.triggerPrice = o.stopPrice
+
+	// a stop order already reached by the market price is triggered right away
+	if ob.MarketPrice > 0 && o.IsTriggered(ob.MarketPrice) {
+		ob.triggerStopOrder(o)
+		return
+	}
+
+	book.Put(o.stopKey(), o)
+}
+
+// load converts an order entering the engine to the scales of the market, it is rejected
+// when its values don't fit them.
+func (ob *OrderBook) load(o *Order) bool {
+	if err := o.toFixed(ob.Config); err != nil {
+		config.Logger.Errorf("[oceanbook.orderbook] order %d rejected, %s", o.ID, err)
+
+		ob.PublishReject(o.Key())
+		return false
+	}
+
+	return true
+}
+
+// export returns a copy of an order of the engine with its decimals up to date.
+func (ob *OrderBook) export(o *Order) *Order {
+	order := o.Copy()
+	order.toDecimal(ob.Config)
+
+	return order
+}
 
+// admit loads an order submitted to the market, it is rejected when it breaks the trading rules.
+func (ob *OrderBook) admit(o *Order) bool {
+	if !ob.load(o) {
+		return false
+	}
+
+	if err := ob.tradingRules.Check(o); err != nil {
+		config.Logger.Debugf("[oceanbook.orderbook] order %d rejected, %s", o.ID, err)
+
+		ob.PublishReject(o.Key())
+		return false
+	}
+
+	return true
+}
+
+// Add adds an order already resting in the market, like the orders loaded when the engine starts.
+func (ob *OrderBook) Add(o *Order) {
+	if !ob.load(o) {
+		return
+	}
+
+	ob.add(o)
+}
+
+// Submit adds a new order of the market, it is checked against the trading rules first.
+func (ob *OrderBook) Submit(o *Order) {
+	if !ob.admit(o) {
 		return
 	}
 
-	ob.Match(o)
+	ob.add(o)
+}
+
+func (ob *OrderBook) add(o *Order) {
+	if o.OcoID != 0 {
+		ob.ocoOrders[o.ID] = o
+	}
+
+	if o.IsStop() {
+		ob.addStopOrder(o)
+	} else {
+		ob.Match(o)
+	}
+
+	ob.matchPendingOrders()
+}
 
-	pendingOrders := ob.pendingOrdersQueue.Values()
-	for i := range pendingOrders {
-		pendingOrder := pendingOrders[i]
+// matchPendingOrders matches the stop orders triggered by the last order,
+// the stop orders they trigger are matched in the same pass.
+func (ob *OrderBook) matchPendingOrders() {
+	for ob.pendingOrdersQueue.Size() > 0 {
+		pendingOrder := ob.pendingOrdersQueue.Pop()
 
 		config.Logger.Debugf("[oceanbook.orderbook] insert stop order with id %d - %s * %s, side %s", pendingOrder.ID, pendingOrder.Price, pendingOrder.Quantity, pendingOrder.Side)
 
@@ -265,29 +468,373 @@ func (ob *OrderBook) Add(o *pkg.Order) {
 	ob.pendingOrdersQueue.Clear()
 }
 
+// AddOco adds both orders of an OCO pair, the second one is cancelled instead
+// when the first one already traded or was triggered.
+func (ob *OrderBook) AddOco(o, oco *Order) {
+	ob.addOco(o, oco, ob.load)
+}
+
+// SubmitOco adds both orders of a new OCO pair, the pair is rejected when one of them breaks the trading rules.
+func (ob *OrderBook) SubmitOco(o, oco *Order) {
+	ob.addOco(o, oco, ob.admit)
+}
+
+func (ob *OrderBook) addOco(o, oco *Order, load func(*Order) bool) {
+	if !load(o) {
+		ob.PublishReject(oco.Key())
+		return
+	}
+
+	if !load(oco) {
+		ob.PublishReject(o.Key())
+		return
+	}
+
+	ob.ocoOrders[o.ID] = o
+	ob.ocoOrders[oco.ID] = oco
+
+	ob.add(o)
+
+	if !oco.Cancelled {
+		ob.add(oco)
+	}
+}
+
+// FindStopOrder returns the stop order waiting for its trigger price with the given key.
+func (ob *OrderBook) FindStopOrder(key *pkg.OrderKey) *Order {
+	if value, found := ob.TrailingStops.Get(key.ID); found {
+		return value.(*Order)
+	}
+
+	// a stop price which doesn't fit the market can't be the one of a waiting order
+	stop_price, err := ob.Config.PriceScale().FromDecimal(key.StopPrice)
+	if err != nil {
+		return nil
+	}
+
+	var book *redblacktree.Tree
+	if key.Side == pkg.SideSell {
+		book = ob.StopAsks
+	} else {
+		book = ob.StopBids
+	}
+
+	if value, found := book.Get(&StopKey{ID: key.ID, Side: key.Side, StopPrice: stop_price, CreatedAt: key.CreatedAt}); found {
+		return value.(*Order)
+	}
+
+	return nil
+}
+
+// StopOrders returns the stop orders of a member waiting for their trigger price, the ones
+// triggered first come first on each side.
+func (ob *OrderBook) StopOrders(member_id int64) []*Order {
+	orders := make([]*Order, 0)
+
+	for _, book := range []*redblacktree.Tree{ob.StopAsks, ob.StopBids, ob.TrailingStops} {
+		it := book.Iterator()
+		for it.Next() {
+			if o := it.Value().(*Order); o.MemberID == member_id {
+				orders = append(orders, o)
+			}
+		}
+	}
+
+	return orders
+}
+
+// Amend changes the price and the quantity of a resting order. An order whose quantity is only
+// reduced keeps its time priority, otherwise it leaves the book and is matched again as a new order.
+// The values the order rests with are sent to trade_executor before its next trades, an amend which
+// is dropped sends the values the order kept so the funds locked for the amend are released.
+func (ob *OrderBook) Amend(key *pkg.OrderKey, amended *Order) {
+	order := ob.Depth.Get(key)
+	if order == nil {
+		// the order left the book, the funds locked for the amend are released when it is closed
+		config.Logger.Debugf("[oceanbook.orderbook] order %d can't be amended, it isn't in the book", key.ID)
+		return
+	}
+
+	if !ob.TradingState.AcceptsOrders() {
+		config.Logger.Debugf("[oceanbook.orderbook] order %d can't be amended, the market is %s", key.ID, ob.TradingState)
+
+		ob.PublishAmend(order)
+		return
+	}
+
+	// the new values don't fit the market or break its trading rules
+	err := amended.toFixed(ob.Config)
+	if err == nil {
+		err = ob.tradingRules.Check(amended)
+	}
+
+	if err != nil {
+		config.Logger.Errorf("[oceanbook.orderbook] order %d can't be amended, %s", key.ID, err)
+
+		ob.PublishAmend(order)
+		return
+	}
+
+	// the order traded more than its new quantity
+	if amended.quantity <= order.filledQuantity {
+		order.Cancelled = true
+		ob.Depth.RemoveOrder(order)
+		ob.cancelAfterTrades(order, nil)
+		ob.cancelOcoOrder(order)
+		return
+	}
+
+	if amended.price == order.price && amended.quantity <= order.quantity {
+		order.Quantity = amended.Quantity
+		order.quantity = amended.quantity
+		if order.IsIceberg() {
+			order.visibleQuantity = MinFixed(order.visibleQuantity, order.UnfilledQuantity())
+		}
+
+		ob.Depth.Reduce(order)
+		ob.PublishAmend(order)
+		return
+	}
+
+	ob.Depth.RemoveOrder(order)
+
+	order.Price = amended.Price
+	order.price = amended.price
+	order.Quantity = amended.Quantity
+	order.quantity = amended.quantity
+
+	ob.PublishAmend(order)
+	ob.Match(order)
+	ob.matchPendingOrders()
+}
+
 func (ob *OrderBook) Remove(key *pkg.OrderKey) {
-	ob.orderMutex.Lock()
-	ob.matchMutex.Lock()
-	defer ob.orderMutex.Unlock()
-	defer ob.matchMutex.Unlock()
+	if !ob.TradingState.AcceptsCancels() {
+		config.Logger.Debugf("[oceanbook.orderbook] order %d can't be cancelled, the market is %s", key.ID, ob.TradingState)
+		return
+	}
+
+	// a stop order waiting for its trigger price isn't in the book yet
+	o := ob.FindStopOrder(key)
+	if o != nil {
+		o.Cancelled = true
+		ob.removeStopOrder(o)
+	} else if o = ob.Depth.Get(key); o != nil {
+		o.Cancelled = true
+		ob.Depth.RemoveOrder(o)
+	} else {
+		// the order already left the book, it is closed by the event which took it out
+		config.Logger.Debugf("[oceanbook.orderbook] order %d can't be cancelled, it isn't in the book", key.ID)
+		return
+	}
 
-	ob.Depth.Remove(key)
+	// cancelling an order of an OCO pair cancels the other one
+	ob.cancelOcoOrder(o)
 
 	if !key.Fake {
-		ob.PublishCancel(key)
+		ob.cancelAfterTrades(o, nil)
+	}
+
+	if ob.Auction {
+		ob.PublishIndicativePrice()
 	}
 }
 
 func (ob *OrderBook) PublishCancel(key *pkg.OrderKey) {
-	config.KafkaProducer.Produce("order_processor", map[string]interface{}{
+	if ob.Silent {
+		return
+	}
+
+	ob.Producer.Produce("order_processor", map[string]interface{}{
 		"action": pkg.ActionCancel,
 		"id":     key.ID,
 	})
 }
 
-func (ob *OrderBook) Match(order *pkg.Order) {
-	ob.matchMutex.Lock()
-	defer ob.matchMutex.Unlock()
+// PublishAmend sends the price and the quantity an amended order rests with to trade_executor,
+// they are settled in order with its trades so each trade is checked against the price it was made at.
+func (ob *OrderBook) PublishAmend(o *Order) {
+	if ob.Silent {
+		return
+	}
+
+	ob.Producer.Produce("trade_executor", map[string]interface{}{
+		"action":   ActionAmend,
+		"id":       o.ID,
+		"price":    ob.Config.PriceScale().Decimal(o.price),
+		"quantity": ob.Config.AmountScale().Decimal(o.quantity),
+	})
+}
+
+// PublishSettledCancel sends the cancel of an order to trade_executor, it is settled after the
+// trades already sent for the order.
+func (ob *OrderBook) PublishSettledCancel(key *pkg.OrderKey) {
+	if ob.Silent {
+		return
+	}
+
+	ob.Producer.Produce("trade_executor", map[string]interface{}{
+		"action": pkg.ActionCancel,
+		"id":     key.ID,
+	})
+}
+
+func (ob *OrderBook) PublishReject(key *pkg.OrderKey) {
+	if ob.Silent {
+		return
+	}
+
+	ob.Producer.Produce("order_processor", map[string]interface{}{
+		"action": ActionReject,
+		"id":     key.ID,
+	})
+}
+
+// PublishTrigger tells order_processor a stop order reached its trigger price and is matched.
+func (ob *OrderBook) PublishTrigger(o *Order) {
+	if ob.Silent {
+		return
+	}
+
+	ob.Producer.Produce("order_processor", map[string]interface{}{
+		"action": ActionTrigger,
+		"id":     o.ID,
+		"price":  ob.Config.PriceScale().Decimal(o.triggerPrice),
+	})
+}
+
+func (ob *OrderBook) PublishDecrement(key *pkg.OrderKey, quantity decimal.Decimal) {
+	if ob.Silent {
+		return
+	}
+
+	ob.Producer.Produce("order_processor", map[string]interface{}{
+		"action":   ActionDecrement,
+		"id":       key.ID,
+		"quantity": quantity,
+	})
+}
+
+// isSelfTrade returns true if both orders belong to the same member and the market prevents it.
+func (ob *OrderBook) isSelfTrade(order, counter_order *Order) bool {
+	switch ob.Config.SelfTradePrevention {
+	case "", types.SelfTradePreventionNone:
+		return false
+	}
+
+	if order.IsFake() || counter_order.IsFake() {
+		return false
+	}
+
+	return order.MemberID == counter_order.MemberID
+}
+
+// preventSelfTrade applies the self trade prevention mode of the market instead of matching
+// the orders, it returns which of the taker and the maker have to be cancelled.
+func (ob *OrderBook) preventSelfTrade(order, counter_order *Order, quantity Fixed) (cancel_taker, cancel_maker bool) {
+	switch ob.Config.SelfTradePrevention {
+	case types.SelfTradePreventionCancelNewest:
+		return true, false
+	case types.SelfTradePreventionCancelOldest:
+		return false, true
+	case types.SelfTradePreventionCancelBoth:
+		return true, true
+	case types.SelfTradePreventionDecrementAndCancel:
+		// the budget of an order placed by quote volume isn't decremented by quantities
+		if order.IsQuote() {
+			return true, false
+		}
+
+		order.quantity -= quantity
+		counter_order.quantity -= quantity
+
+		cancel_taker = order.UnfilledQuantity() <= 0
+		cancel_maker = counter_order.UnfilledQuantity() <= 0
+
+		if !cancel_taker {
+			ob.PublishDecrement(order.Key(), ob.Config.AmountScale().Decimal(quantity))
+		}
+
+		if !cancel_maker {
+			ob.PublishDecrement(counter_order.Key(), ob.Config.AmountScale().Decimal(quantity))
+			ob.Depth.Reduce(counter_order)
+		}
+
+		return cancel_taker, cancel_maker
+	}
+
+	return false, false
+}
+
+// isCrossing returns true if the order would take liquidity from the best offer.
+func (ob *OrderBook) isCrossing(order *Order, offers *redblacktree.Tree) bool {
+	best := offers.Left()
+	if best == nil {
+		return false
+	}
+
+	price_level := best.Value.(*PriceLevel)
+
+	return order.Type == pkg.TypeMarket || order.IsCrossed(price_level.Price)
+}
+
+// isFillable returns true if the crossing offers hold enough quantity to fill the whole order.
+func (ob *OrderBook) isFillable(order *Order, offers *redblacktree.Tree) bool {
+	expected := order.UnfilledQuantity()
+	expected_volume := order.UnfilledQuoteQuantity()
+	budget := order.UnfilledBudget()
+
+	filled := func() bool {
+		if order.IsQuote() {
+			return expected_volume.IsZero()
+		}
+
+		return expected <= 0
+	}
+
+	iter := offers.Iterator()
+	for iter.Next() && !filled() {
+		price_level := iter.Value().(*PriceLevel)
+
+		if order.Type == pkg.TypeLimit && !order.IsCrossed(price_level.Price) {
+			break
+		}
+
+		if order.IsQuote() {
+			expected_volume = expected_volume.Sub(MulFixed(price_level.Price, price_level.Total()))
+		} else if order.HasBudget() {
+			// the order is killed when its budget can't buy its whole quantity
+			taken := MinFixed(price_level.Total(), budget.Div(price_level.Price))
+			budget = budget.Sub(MulFixed(price_level.Price, taken))
+			expected -= taken
+
+			if taken < price_level.Total() {
+				break
+			}
+		} else {
+			expected -= price_level.Total()
+		}
+	}
+
+	return filled()
+}
+
+// affordableQuantity returns the quantity the order can still take at the price, what is left of the
+// budget of an order placed by quote volume or of a buy market order placed by quantity caps it.
+// The totals are scaled by the sum of the precisions so the quantity is rounded down to the amount precision.
+func (ob *OrderBook) affordableQuantity(order *Order, price Fixed) Fixed {
+	if order.IsQuote() {
+		return order.UnfilledQuoteQuantity().Div(price)
+	}
+
+	if order.HasBudget() {
+		return MinFixed(order.UnfilledQuantity(), order.UnfilledBudget().Div(price))
+	}
+
+	return order.UnfilledQuantity()
+}
+
+func (ob *OrderBook) Match(order *Order) {
 	var offers *redblacktree.Tree
 
 	if order.IsAsk() {
@@ -296,149 +843,296 @@ func (ob *OrderBook) Match(order *pkg.Order) {
 		offers = ob.Depth.Asks
 	}
 
-	if offers.Empty() && order.Price.IsZero() {
+	if ob.refuseOrder(order) {
+		return
+	}
+
+	if ob.Auction {
+		ob.collectOrder(order)
+		return
+	}
+
+	if ob.IsHalted() {
+		config.Logger.Debugf("[oceanbook.orderbook] order %d rejected, the market is halted until %v", order.ID, ob.HaltedUntil)
+
+		ob.PublishReject(order.Key())
+		ob.cancelOcoOrder(order)
+		return
+	}
+
+	band_low, band_high, banded := ob.priceBand()
+	if banded && order.Type == pkg.TypeLimit && isOutsidePriceBand(order, order.price, band_low, band_high) {
+		config.Logger.Debugf("[oceanbook.orderbook] order %d rejected, its price is outside of the price band", order.ID)
+
+		ob.PublishReject(order.Key())
+		ob.cancelOcoOrder(order)
+		return
+	}
+
+	if offers.Empty() && order.price == 0 {
 		ob.PublishCancel(order.Key())
+		ob.cancelOcoOrder(order)
 		return
 	}
 
-	iter := offers.Iterator()
-	for iter.Next() {
-		price_level := iter.Value().(*PriceLevel)
+	if (order.IsPostOnly() || ob.TradingState == types.TradingStatePostOnly) && ob.isCrossing(order, offers) {
+		config.Logger.Debugf("[oceanbook.orderbook] post only order %d rejected, it would cross the book", order.ID)
+
+		ob.PublishReject(order.Key())
+		ob.cancelOcoOrder(order)
+		return
+	}
+
+	if order.IsFillOrKill() && !ob.isFillable(order, offers) {
+		config.Logger.Debugf("[oceanbook.orderbook] fill or kill order %d killed, not enough liquidity", order.ID)
+
+		ob.PublishCancel(order.Key())
+		ob.cancelOcoOrder(order)
+		return
+	}
+
+	// the trades of the order are sent one behind the other so the last one can cancel its remainder
+	var last_trade *Trade
+
+	// the best price level is taken from the tree on each pass since the
+	// levels emptied by the order are removed from it while matching
+	for !order.Filled() && ob.HaltedUntil.IsZero() {
+		best := offers.Left()
+		if best == nil {
+			break
+		}
+
+		price_level := best.Value.(*PriceLevel)
 		if price_level.Size() == 0 {
+			offers.Remove(best.Key)
 			continue
 		}
 
-		if order.Filled() {
+		if order.Type == pkg.TypeLimit && !order.IsCrossed(price_level.Price) {
+			break
+		}
+
+		// a market order stops sweeping the book at the price band
+		if banded && isOutsidePriceBand(order, price_level.Price, band_low, band_high) {
 			break
 		}
 
-		counterIter := price_level.Orders.Iterator()
-		for counterIter.Next() {
-			if order.Filled() {
+		taken := ob.affordableQuantity(order, price_level.Price)
+
+		level_total := price_level.Total()
+		allocations := ob.allocate(price_level, taken)
+
+		// the next order is taken before the counter order leaves the level or is requeued
+		var next *Order
+		for counter_order := price_level.Top(); counter_order != nil; counter_order = next {
+			next = price_level.Next(counter_order)
+
+			if order.Filled() || !ob.HaltedUntil.IsZero() {
 				break
 			}
 
-			counter_order := counterIter.Value().(*pkg.Order)
+			quantity := MinFixed(ob.affordableQuantity(order, counter_order.price), counter_order.Visible())
 
-			quantity := decimal.Min(order.UnfilledQuantity(), counter_order.UnfilledQuantity())
+			// the rest of the budget can't buy anything at this price
+			if quantity <= 0 {
+				break
+			}
+
+			if allocations != nil {
+				quantity = MinFixed(quantity, allocations[counter_order.UUID])
+				if quantity <= 0 {
+					continue
+				}
+			}
 
 			if order.Type == pkg.TypeLimit {
-				if !order.IsCrossed(counter_order.Price) {
+				if !order.IsCrossed(counter_order.price) {
 					break
 				}
 			}
 
+			if ob.isSelfTrade(order, counter_order) {
+				// the decrement takes the whole maker, not only its visible slice or its allocation,
+				// so one of the orders is cancelled and the taker never rests against it
+				cancel_taker, cancel_maker := ob.preventSelfTrade(order, counter_order, MinFixed(ob.affordableQuantity(order, counter_order.price), counter_order.UnfilledQuantity()))
+
+				if cancel_maker {
+					config.Logger.Debugf("[oceanbook.orderbook] order %d cancelled by self trade prevention", counter_order.ID)
+
+					counter_order.Cancelled = true
+					ob.Depth.RemoveOrder(counter_order)
+					ob.cancelAfterTrades(counter_order, nil)
+					ob.cancelOcoOrder(counter_order)
+				}
+
+				if price_level.Total() == 0 {
+					offers.Remove(price_level.Key())
+				}
+
+				if cancel_taker {
+					config.Logger.Debugf("[oceanbook.orderbook] order %d cancelled by self trade prevention", order.ID)
+
+					order.Cancelled = true
+					ob.cancelRemainder(order, last_trade)
+					return
+				}
+
+				continue
+			}
+
 			order.Fill(quantity)
+			order.Spend(MulFixed(counter_order.price, quantity))
 			counter_order.Fill(quantity)
+			ob.Depth.Execute(counter_order, quantity)
+
+			if allocations != nil {
+				allocations[counter_order.UUID] -= quantity
+			}
+
+			// an order of an OCO pair which trades cancels the other one
+			ob.cancelOcoOrder(order)
+			ob.cancelOcoOrder(counter_order)
 
 			if counter_order.Filled() || counter_order.Cancelled {
-				ob.Depth.Remove(counter_order.Key())
-				counterIter.Prev()
+				ob.Depth.RemoveOrder(counter_order)
+			} else if counter_order.IsIceberg() && counter_order.visibleQuantity <= 0 {
+				counter_order.Replenish()
+				ob.Depth.Requeue(counter_order)
+
+				// the last order of the level comes back to the taker with its new slice
+				if next == nil {
+					next = counter_order
+				}
+			} else {
+				ob.Depth.Refresh(counter_order)
 			}
 
-			if price_level.Total().IsZero() {
+			if price_level.Total() == 0 {
 				offers.Remove(price_level.Key())
 			}
 
-			ob.setMarketPrice(counter_order.Price)
+			ob.setMarketPrice(counter_order.price)
+			ob.recordTradePrice(counter_order.price)
 
 			if counter_order.IsFake() {
-				if _, err := ob.quantexClient.UpdateOrder(&GrpcQuantex.UpdateOrderRequest{
-					Order: &GrpcOrder.Order{
-						Id:       counter_order.ID,
-						Uuid:     counter_order.UUID[:],
-						MemberId: counter_order.MemberID,
-						Symbol:   &GrpcSymbol.Symbol{BaseCurrency: counter_order.Symbol.BaseCurrency, QuoteCurrency: counter_order.Symbol.QuoteCurrency},
-						Side:     string(counter_order.Side),
-						Type:     string(counter_order.Type),
-						Price: &GrpcUtils.Decimal{
-							Val: counter_order.Price.CoefficientInt64(),
-							Exp: counter_order.Price.Exponent(),
-						},
-						StopPrice: &GrpcUtils.Decimal{
-							Val: counter_order.StopPrice.CoefficientInt64(),
-							Exp: counter_order.StopPrice.Exponent(),
-						},
-						Quantity: &GrpcUtils.Decimal{
-							Val: counter_order.Quantity.CoefficientInt64(),
-							Exp: counter_order.Quantity.Exponent(),
-						},
-						FilledQuantity: &GrpcUtils.Decimal{
-							Val: counter_order.FilledQuantity.CoefficientInt64(),
-							Exp: counter_order.FilledQuantity.Exponent(),
-						},
-						Fake:      counter_order.Fake,
-						Cancelled: counter_order.Cancelled,
-						CreatedAt: timestamppb.New(counter_order.CreatedAt),
-					},
-				}); err != nil {
-					config.Logger.Errorf("[orderbook] update order %d failed: %s", counter_order.ID, err)
-				}
+				ob.updateQuantexOrder(counter_order)
 			}
 
-			trade := &pkg.Trade{
-				Symbol:   ob.Symbol,
-				Price:    counter_order.Price,
-				Quantity: quantity,
-				Total:    counter_order.Price.Mul(quantity),
-			}
+			ob.PublishTrade(last_trade)
+			last_trade = ob.newTrade(order, counter_order, counter_order.price, quantity)
+		}
 
-			ob.PublishTrade(order, counter_order, trade)
+		// the allocations of the orders cancelled by self trade prevention are shared again
+		if allocations != nil && !order.Filled() && !price_level.Empty() && price_level.Total() < level_total {
+			continue
 		}
+
+		if !price_level.Empty() {
+			break
+		}
+	}
+
+	// the budget a market order can't spend, less than a lot at the best price, is given back
+	// by the cancel of its remainder once its trades are settled
+	if !order.Filled() && order.Type == pkg.TypeMarket {
+		ob.cancelRemainder(order, last_trade)
+		return
 	}
 
-	if order.UnfilledQuantity().IsPositive() && order.Type == pkg.TypeLimit {
+	if order.UnfilledQuantity() > 0 && order.Type == pkg.TypeLimit && order.IsImmediate() {
+		ob.cancelRemainder(order, last_trade)
+		return
+	}
+
+	ob.PublishTrade(last_trade)
+
+	if order.UnfilledQuantity() > 0 && order.Type == pkg.TypeLimit {
+		if order.IsIceberg() {
+			order.Replenish()
+		}
+
 		ob.Depth.Add(order)
 		if order.IsFake() {
-			if _, err := ob.quantexClient.UpdateOrder(&GrpcQuantex.UpdateOrderRequest{
-				Order: &GrpcOrder.Order{
-					Id:       order.ID,
-					Uuid:     order.UUID[:],
-					MemberId: order.MemberID,
-					Symbol:   &GrpcSymbol.Symbol{BaseCurrency: order.Symbol.BaseCurrency, QuoteCurrency: order.Symbol.QuoteCurrency},
-					Side:     string(order.Side),
-					Type:     string(order.Type),
-					Price: &GrpcUtils.Decimal{
-						Val: order.Price.CoefficientInt64(),
-						Exp: order.Price.Exponent(),
-					},
-					StopPrice: &GrpcUtils.Decimal{
-						Val: order.StopPrice.CoefficientInt64(),
-						Exp: order.StopPrice.Exponent(),
-					},
-					Quantity: &GrpcUtils.Decimal{
-						Val: order.Quantity.CoefficientInt64(),
-						Exp: order.Quantity.Exponent(),
-					},
-					FilledQuantity: &GrpcUtils.Decimal{
-						Val: order.FilledQuantity.CoefficientInt64(),
-						Exp: order.FilledQuantity.Exponent(),
-					},
-					Fake:      order.Fake,
-					Cancelled: order.Cancelled,
-					CreatedAt: timestamppb.New(order.CreatedAt),
-				},
-			}); err != nil {
-				config.Logger.Errorf("[orderbook] update order %d failed: %s", order.ID, err)
-			}
+			ob.updateQuantexOrder(order)
 		}
 	}
 }
 
-func (ob *OrderBook) PublishTrade(order, counter_order *pkg.Order, trade *pkg.Trade) {
-	var maker_order pkg.Order
-	var taker_order pkg.Order
+// updateQuantexOrder sends the state of an order of the liquidity bot to Quantex.
+func (ob *OrderBook) updateQuantexOrder(o *Order) {
+	if ob.quantexClient == nil || ob.Silent {
+		return
+	}
+
+	if _, err := ob.quantexClient.UpdateOrder(&GrpcQuantex.UpdateOrderRequest{
+		Order: &GrpcOrder.Order{
+			Id:             o.ID,
+			Uuid:           o.UUID[:],
+			MemberId:       o.MemberID,
+			Symbol:         &GrpcSymbol.Symbol{BaseCurrency: o.Symbol.BaseCurrency, QuoteCurrency: o.Symbol.QuoteCurrency},
+			Side:           string(o.Side),
+			Type:           string(o.Type),
+			Price:          ob.Config.PriceScale().Grpc(o.price),
+			StopPrice:      ob.Config.PriceScale().Grpc(o.stopPrice),
+			Quantity:       ob.Config.AmountScale().Grpc(o.quantity),
+			FilledQuantity: ob.Config.AmountScale().Grpc(o.filledQuantity),
+			Fake:           o.Fake,
+			Cancelled:      o.Cancelled,
+			CreatedAt:      timestamppb.New(o.CreatedAt),
+		},
+	}); err != nil {
+		config.Logger.Errorf("[orderbook] update order %d failed: %s", o.ID, err)
+	}
+}
+
+// newTrade returns the trade of the orders for the quantity at the price, the older order is its maker.
+// The orders are copied as they are after the trade, their decimals are written when the trade is sent.
+func (ob *OrderBook) newTrade(order, counter_order *Order, price, quantity Fixed) *Trade {
+	trade := &Trade{
+		Trade: pkg.Trade{
+			Symbol: ob.Symbol,
+		},
+		price:    price,
+		quantity: quantity,
+	}
 
 	if order.CreatedAt.Before(counter_order.CreatedAt) {
-		maker_order = *order
-		taker_order = *counter_order
+		trade.maker, trade.taker = order.Copy(), counter_order.Copy()
 	} else {
-		maker_order = *counter_order
-		taker_order = *order
+		trade.maker, trade.taker = counter_order.Copy(), order.Copy()
+	}
+
+	return trade
+}
+
+// PublishTrade sends a trade to trade_executor, nothing is sent for a nil trade.
+func (ob *OrderBook) PublishTrade(trade *Trade) {
+	if trade == nil || ob.Silent {
+		return
 	}
 
-	trade.MakerOrder = maker_order
-	trade.TakerOrder = taker_order
+	trade.toDecimal(ob.Config)
 
-	config.KafkaProducer.Produce("trade_executor", trade)
+	ob.Producer.Produce("trade_executor", trade)
+}
+
+// cancelRemainder cancels what is left of an order which doesn't rest in the book and sends its last trade.
+func (ob *OrderBook) cancelRemainder(order *Order, last_trade *Trade) {
+	ob.cancelAfterTrades(order, last_trade)
+	ob.PublishTrade(last_trade)
+	ob.cancelOcoOrder(order)
+}
+
+// cancelAfterTrades cancels an order the engine took out of the book once its trades are settled,
+// order_processor would close it before trade_executor settles them. The cancel is carried by the
+// last trade of the order when it isn't sent yet, and sent to trade_executor when the order traded before.
+func (ob *OrderBook) cancelAfterTrades(order *Order, last_trade *Trade) {
+	switch {
+	case last_trade != nil:
+		last_trade.CancelOrderIDs = append(last_trade.CancelOrderIDs, order.ID)
+	case order.filledQuantity > 0:
+		ob.PublishSettledCancel(order.Key())
+	default:
+		ob.PublishCancel(order.Key())
+	}
 }
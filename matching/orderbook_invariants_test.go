@@ -0,0 +1,868 @@
+package matching
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/types"
+	"github.com/zsmartex/pkg"
+)
+
+// recorder is the output of the order book under test, it keeps the trades and counts the
+// other events by order.
+type recorder struct {
+	trades  []*Trade
+	cancels map[int64]int
+	// traded and closed are the orders which traded and the ones order_processor cancelled during
+	// the last operation, the cancel of an order could be settled before its trades
+	traded   map[int64]bool
+	closed   map[int64]bool
+	rejects  map[int64]int
+	triggers map[int64]int
+	// amends are the prices amended orders were sent to trade_executor with
+	amends map[int64][]decimal.Decimal
+	events map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		cancels:  make(map[int64]int),
+		traded:   make(map[int64]bool),
+		closed:   make(map[int64]bool),
+		rejects:  make(map[int64]int),
+		triggers: make(map[int64]int),
+		amends:   make(map[int64][]decimal.Decimal),
+		events:   make(map[string]int),
+	}
+}
+
+func (r *recorder) Produce(topic string, payload interface{}) error {
+	switch topic {
+	case "trade_executor":
+		if message, ok := payload.(map[string]interface{}); ok {
+			id := message["id"].(int64)
+			switch message["action"] {
+			case ActionAmend:
+				r.amends[id] = append(r.amends[id], message["price"].(decimal.Decimal))
+			case pkg.ActionCancel:
+				r.cancels[id]++
+			}
+			break
+		}
+
+		trade := payload.(*Trade)
+		r.trades = append(r.trades, trade)
+		r.traded[trade.MakerOrder.ID] = true
+		r.traded[trade.TakerOrder.ID] = true
+
+		for _, id := range trade.CancelOrderIDs {
+			r.cancels[id]++
+		}
+	case "order_processor":
+		message := payload.(map[string]interface{})
+		switch message["action"] {
+		case pkg.ActionCancel:
+			r.cancels[message["id"].(int64)]++
+			r.closed[message["id"].(int64)] = true
+		case ActionReject:
+			r.rejects[message["id"].(int64)]++
+		case ActionTrigger:
+			r.triggers[message["id"].(int64)]++
+		}
+	}
+
+	return nil
+}
+
+func (r *recorder) Publish(symbol pkg.Symbol, event string, payload interface{}) {
+	r.events[event]++
+}
+
+// bookHarness drives an offline order book with operations decoded from bytes and checks the
+// invariants of the book after each of them.
+type bookHarness struct {
+	t   testing.TB
+	ob  *OrderBook
+	out *recorder
+
+	orders  map[int64]*Order
+	nextID  int64
+	created time.Time
+
+	// waiting are the stop orders waiting for their trigger price after the last operation and
+	// triggered counts the times a stop order left them
+	waiting   map[int64]bool
+	triggered map[int64]int
+	// removed are the stop orders cancelled while waiting for their trigger price, the others
+	// cancelled by self trade prevention were triggered first
+	removed map[int64]bool
+	// checkedTrades is the number of trades the invariants were checked for
+	checkedTrades int
+}
+
+// newBookHarness returns a harness whose book is built from the config of the harness changed by
+// the options. The trading rules reject a part of the orders the operations submit.
+func newBookHarness(t testing.TB, options ...func(*MarketConfig)) *bookHarness {
+	if config.Logger == nil {
+		logger := logrus.New()
+		logger.SetLevel(logrus.WarnLevel)
+		config.Logger = logrus.NewEntry(logger)
+	}
+
+	market_config := DefaultMarketConfig()
+	market_config.PricePrecision = 2
+	market_config.AmountPrecision = 4
+	market_config.TradingRules = TradingRules{
+		TickSize:    decimal.NewFromInt(1),
+		LotSize:     decimal.New(1, -1),
+		MinPrice:    decimal.NewFromInt(96),
+		MinAmount:   decimal.New(2, -1),
+		MaxAmount:   decimal.New(48, -1),
+		MaxNotional: decimal.NewFromInt(450),
+	}
+
+	for _, option := range options {
+		option(&market_config)
+	}
+
+	out := newRecorder()
+	ob := NewOfflineOrderBook(pkg.Symbol{BaseCurrency: "ABC", QuoteCurrency: "XYZ"}, decimal.NewFromInt(100), market_config, out)
+	ob.Depth.Notification.Publisher = out
+	ob.Depth.L3.Publisher = out
+
+	return &bookHarness{
+		t:         t,
+		ob:        ob,
+		out:       out,
+		orders:    make(map[int64]*Order),
+		created:   time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		waiting:   make(map[int64]bool),
+		triggered: make(map[int64]int),
+		removed:   make(map[int64]bool),
+	}
+}
+
+// newOrder returns an order created after all the previous ones, its UUID is derived from its id
+// so a run is reproduced from its bytes.
+func (h *bookHarness) newOrder(side pkg.OrderSide, order_type pkg.OrderType, price, quantity decimal.Decimal) *Order {
+	h.nextID++
+	h.created = h.created.Add(time.Millisecond)
+
+	var id uuid.UUID
+	binary.BigEndian.PutUint64(id[8:], uint64(h.nextID))
+
+	o := &Order{
+		Order: pkg.Order{
+			ID:        h.nextID,
+			UUID:      id,
+			Symbol:    h.ob.Symbol,
+			MemberID:  h.nextID%3 + 1,
+			Side:      side,
+			Type:      order_type,
+			Price:     price,
+			Quantity:  quantity,
+			CreatedAt: h.created,
+		},
+		TimeInForce: types.TimeInForceGTC,
+	}
+	h.orders[o.ID] = o
+
+	return o
+}
+
+// Run applies the operations encoded by data, four bytes each, and checks the book after each one.
+func (h *bookHarness) Run(data []byte) {
+	for len(data) >= 4 {
+		h.out.traded = make(map[int64]bool)
+		h.out.closed = make(map[int64]bool)
+
+		h.apply(data[0], data[1], data[2], data[3])
+		h.ob.Depth.Flush()
+		h.check()
+
+		data = data[4:]
+	}
+}
+
+func (h *bookHarness) apply(op, a, b, c byte) {
+	side := pkg.SideBuy
+	if a&1 == 1 {
+		side = pkg.SideSell
+	}
+
+	// prices stay around the market price so the orders cross often, a few of them are off the tick size
+	price := decimal.New(int64(9500+int(a>>1)%11*100), -2)
+	if b >= 250 {
+		price = price.Add(decimal.New(50, -2))
+	}
+
+	quantity := decimal.New(int64(b%50+1), -1)
+
+	switch op % 7 {
+	case 0, 1:
+		o := h.newOrder(side, pkg.TypeLimit, price, quantity)
+		switch c % 8 {
+		case 0:
+			o.TimeInForce = types.TimeInForceIOC
+		case 1:
+			o.TimeInForce = types.TimeInForceFOK
+		case 2:
+			o.TimeInForce = types.TimeInForcePostOnly
+		case 3:
+			o.DisplayQuantity = decimal.New(int64(c%5+1), -1)
+		}
+
+		h.ob.Submit(o)
+	case 2:
+		h.ob.Submit(h.newOrder(side, pkg.TypeMarket, decimal.Zero, quantity))
+	case 3:
+		order_type := pkg.TypeLimit
+		if c&1 == 1 {
+			order_type = pkg.TypeMarket
+			price = decimal.Zero
+		}
+
+		o := h.newOrder(side, order_type, price, quantity)
+		o.StopPrice = decimal.New(int64(9500+int(c>>1)%11*100), -2)
+
+		h.ob.Submit(o)
+	case 4:
+		o := h.restingOrder(c)
+		if a&4 == 4 {
+			o = h.waitingStopOrder(c)
+		}
+
+		if o != nil {
+			o.Cancelled = true
+			h.ob.Remove(o.Key())
+
+			if a&4 == 4 {
+				h.removed[o.ID] = true
+			}
+		}
+	case 5:
+		if o := h.restingOrder(c); o != nil {
+			amended := &Order{Order: pkg.Order{Price: o.Price, Quantity: quantity}}
+			if a&2 == 2 {
+				amended.Price = price
+			}
+
+			h.ob.Amend(o.Key(), amended)
+		}
+	case 6:
+		// the members of the orders are 1 to 3, member 0 selects all of them
+		mass_cancel := &MassCancel{MemberID: int64(c % 4)}
+		if a&2 == 2 {
+			mass_cancel.Side = side
+		}
+
+		if b&1 == 1 {
+			mass_cancel.PriceFrom = price
+			mass_cancel.PriceTo = price.Add(decimal.New(int64(b%5*100), -2))
+		}
+
+		waiting := make([]*Order, 0)
+		for _, values := range [][]interface{}{h.ob.StopAsks.Values(), h.ob.StopBids.Values()} {
+			for _, value := range values {
+				waiting = append(waiting, value.(*Order))
+			}
+		}
+
+		h.ob.MassCancel(mass_cancel)
+
+		for _, o := range waiting {
+			if o.Cancelled {
+				h.removed[o.ID] = true
+			}
+		}
+	}
+}
+
+// restingOrder returns one of the orders resting in the book, by id order.
+func (h *bookHarness) restingOrder(n byte) *Order {
+	resting := make([]*Order, 0)
+	for _, values := range [][]interface{}{h.ob.Depth.Asks.Values(), h.ob.Depth.Bids.Values()} {
+		for _, value := range values {
+			price_level := value.(*PriceLevel)
+			for o := price_level.Top(); o != nil; o = price_level.Next(o) {
+				resting = append(resting, o)
+			}
+		}
+	}
+
+	if len(resting) == 0 {
+		return nil
+	}
+
+	sort.Slice(resting, func(i, j int) bool {
+		return resting[i].ID < resting[j].ID
+	})
+
+	return resting[int(n)%len(resting)]
+}
+
+// waitingStopOrder returns one of the stop orders waiting for their trigger price, by id order.
+func (h *bookHarness) waitingStopOrder(n byte) *Order {
+	waiting := make([]*Order, 0)
+	for _, values := range [][]interface{}{h.ob.StopAsks.Values(), h.ob.StopBids.Values()} {
+		for _, value := range values {
+			waiting = append(waiting, value.(*Order))
+		}
+	}
+
+	if len(waiting) == 0 {
+		return nil
+	}
+
+	sort.Slice(waiting, func(i, j int) bool {
+		return waiting[i].ID < waiting[j].ID
+	})
+
+	return waiting[int(n)%len(waiting)]
+}
+
+func (h *bookHarness) check() {
+	h.t.Helper()
+
+	if h.ob.pendingOrdersQueue.Size() > 0 {
+		h.t.Fatalf("%d triggered stop orders were left in the pending queue", h.ob.pendingOrdersQueue.Size())
+	}
+
+	in_book := make(map[int64]bool)
+	for _, side := range []pkg.OrderSide{pkg.SideSell, pkg.SideBuy} {
+		h.checkSide(side, in_book)
+	}
+
+	if best_ask, best_bid := h.ob.Depth.Asks.Left(), h.ob.Depth.Bids.Left(); best_ask != nil && best_bid != nil {
+		ask, bid := best_ask.Value.(*PriceLevel).Price, best_bid.Value.(*PriceLevel).Price
+		if bid >= ask {
+			h.t.Fatalf("crossed book, best bid %d best ask %d", bid, ask)
+		}
+	}
+
+	for id := range h.out.closed {
+		if h.out.traded[id] {
+			h.t.Fatalf("order %d traded and was cancelled through order_processor by the same operation", id)
+		}
+	}
+
+	h.checkTrades()
+	h.checkStopOrders(in_book)
+}
+
+// checkSide checks the price levels of a side are in price order and hold their orders in
+// time priority with their totals up to date.
+func (h *bookHarness) checkSide(side pkg.OrderSide, in_book map[int64]bool) {
+	h.t.Helper()
+
+	var previous *PriceLevel
+	for _, value := range h.ob.Depth.priceLevels(side).Values() {
+		price_level := value.(*PriceLevel)
+		if price_level.Side != side {
+			h.t.Fatalf("price level %d of the %s side is a %s level", price_level.Price, side, price_level.Side)
+		}
+
+		if previous != nil && (side == pkg.SideSell) != (previous.Price < price_level.Price) {
+			h.t.Fatalf("%s price levels out of order, %d before %d", side, previous.Price, price_level.Price)
+		}
+		previous = price_level
+
+		var total, visible Fixed
+		var size int
+		var prev *Order
+		for o := price_level.Top(); o != nil; o = price_level.Next(o) {
+			if o.prev != prev {
+				h.t.Fatalf("order %d isn't linked to the previous order of its level", o.ID)
+			}
+
+			if prev != nil && o.Priority <= prev.Priority {
+				h.t.Fatalf("order %d with priority %d rests behind order %d with priority %d", o.ID, o.Priority, prev.ID, prev.Priority)
+			}
+
+			if o.price != price_level.Price || o.Side != side {
+				h.t.Fatalf("order %d at %s %d rests in the %s level %d", o.ID, o.Side, o.price, side, price_level.Price)
+			}
+
+			if o.Filled() || o.Cancelled || o.IsImmediate() || o.Type != pkg.TypeLimit {
+				h.t.Fatalf("order %d rests in the book, filled %v cancelled %v time in force %s type %s", o.ID, o.Filled(), o.Cancelled, o.TimeInForce, o.Type)
+			}
+
+			if in_book[o.ID] {
+				h.t.Fatalf("order %d rests twice in the book", o.ID)
+			}
+			in_book[o.ID] = true
+
+			total += o.UnfilledQuantity()
+			visible += o.Visible()
+			size++
+			prev = o
+		}
+
+		if size == 0 || size != price_level.Size() {
+			h.t.Fatalf("price level %d has %d linked orders and a size of %d", price_level.Price, size, price_level.Size())
+		}
+
+		if total != price_level.Total() || visible != price_level.VisibleTotal() {
+			h.t.Fatalf("price level %d counts %d (%d visible) for orders of %d (%d visible)", price_level.Price, price_level.Total(), price_level.VisibleTotal(), total, visible)
+		}
+	}
+}
+
+// checkTrades checks the new trades are at prices both orders accept and the filled quantity
+// of every order is the sum of its trades.
+func (h *bookHarness) checkTrades() {
+	h.t.Helper()
+
+	for _, trade := range h.out.trades[h.checkedTrades:] {
+		if !trade.Quantity.IsPositive() {
+			h.t.Fatalf("trade of %s between orders %d and %d", trade.Quantity, trade.MakerOrder.ID, trade.TakerOrder.ID)
+		}
+
+		price, err := h.ob.Config.PriceScale().FromDecimal(trade.Price)
+		if err != nil {
+			h.t.Fatalf("trade price %s: %v", trade.Price, err)
+		}
+
+		// the quantity a budget buys at a price is only rounded to the amount precision
+		quantity, err := h.ob.Config.AmountScale().FromDecimal(trade.Quantity)
+		if err != nil {
+			h.t.Fatalf("trade quantity %s: %v", trade.Quantity, err)
+		}
+
+		if taker := h.orders[trade.TakerOrder.ID]; !taker.IsQuote() && !taker.HasBudget() && !multipleOf(quantity, h.ob.tradingRules.lotSize) {
+			h.t.Fatalf("trade of %s between orders %d and %d isn't a multiple of the lot size", trade.Quantity, trade.MakerOrder.ID, trade.TakerOrder.ID)
+		}
+
+		for _, id := range []int64{trade.MakerOrder.ID, trade.TakerOrder.ID} {
+			o := h.orders[id]
+			if o.Type == pkg.TypeLimit && !o.IsCrossed(price) {
+				h.t.Fatalf("order %d %s at %s traded at %s", o.ID, o.Side, o.Price, trade.Price)
+			}
+		}
+
+		if h.orders[trade.MakerOrder.ID].Side == h.orders[trade.TakerOrder.ID].Side {
+			h.t.Fatalf("orders %d and %d of the same side traded", trade.MakerOrder.ID, trade.TakerOrder.ID)
+		}
+	}
+	h.checkedTrades = len(h.out.trades)
+
+	traded := make(map[int64]decimal.Decimal)
+	for _, trade := range h.out.trades {
+		traded[trade.MakerOrder.ID] = traded[trade.MakerOrder.ID].Add(trade.Quantity)
+		traded[trade.TakerOrder.ID] = traded[trade.TakerOrder.ID].Add(trade.Quantity)
+	}
+
+	for _, o := range h.orders {
+		filled := h.ob.Config.AmountScale().Decimal(o.filledQuantity)
+		if !filled.Equal(traded[o.ID]) {
+			h.t.Fatalf("order %d filled %s but traded %s", o.ID, filled, traded[o.ID])
+		}
+
+		if o.filledQuantity > o.quantity {
+			h.t.Fatalf("order %d filled %s of %s", o.ID, filled, o.Quantity)
+		}
+	}
+}
+
+// checkStopOrders checks a stop order leaves the stop books once, when the market price reaches its
+// trigger price, and is never both waiting and in the book.
+func (h *bookHarness) checkStopOrders(in_book map[int64]bool) {
+	h.t.Helper()
+
+	waiting := make(map[int64]bool)
+	for _, values := range [][]interface{}{h.ob.StopAsks.Values(), h.ob.StopBids.Values()} {
+		for _, value := range values {
+			o := value.(*Order)
+			waiting[o.ID] = true
+
+			if o.IsTriggered(h.ob.MarketPrice) {
+				h.t.Fatalf("stop order %d with trigger price %d is still waiting at the market price %d", o.ID, o.triggerPrice, h.ob.MarketPrice)
+			}
+
+			if in_book[o.ID] {
+				h.t.Fatalf("stop order %d is waiting and rests in the book", o.ID)
+			}
+
+			if o.Cancelled {
+				h.t.Fatalf("stop order %d is waiting after it was cancelled", o.ID)
+			}
+		}
+	}
+
+	for id, o := range h.orders {
+		if !o.IsStop() {
+			continue
+		}
+
+		switch {
+		case waiting[id] && h.triggered[id] > 0:
+			h.t.Fatalf("stop order %d is waiting again after it was triggered", id)
+		case !waiting[id] && (h.waiting[id] || h.triggered[id] == 0):
+			// the order was either triggered, cancelled or rejected by the last operation
+			if h.out.rejects[id] == 0 && !h.removed[id] {
+				h.triggered[id]++
+			}
+		}
+
+		if h.triggered[id] > 1 {
+			h.t.Fatalf("stop order %d was triggered %d times", id, h.triggered[id])
+		}
+
+		if h.out.rejects[id] == 0 && h.out.triggers[id] != h.triggered[id] {
+			h.t.Fatalf("stop order %d was triggered %d times and sent %d trigger events", id, h.triggered[id], h.out.triggers[id])
+		}
+	}
+
+	h.waiting = waiting
+}
+
+// TestOrderBookInvariants runs random operations against the order book, with each matching
+// algorithm and each self trade prevention mode.
+func TestOrderBookInvariants(t *testing.T) {
+	for _, test := range []struct {
+		algorithm types.MatchingAlgorithm
+		stp       types.SelfTradePrevention
+		seeds     int64
+	}{
+		{types.MatchingAlgorithmFIFO, types.SelfTradePreventionNone, 50},
+		{types.MatchingAlgorithmProRata, types.SelfTradePreventionNone, 10},
+		{types.MatchingAlgorithmProRataTopOrder, types.SelfTradePreventionNone, 10},
+		{types.MatchingAlgorithmFIFO, types.SelfTradePreventionCancelNewest, 10},
+		{types.MatchingAlgorithmFIFO, types.SelfTradePreventionCancelOldest, 10},
+		{types.MatchingAlgorithmFIFO, types.SelfTradePreventionCancelBoth, 10},
+		{types.MatchingAlgorithmFIFO, types.SelfTradePreventionDecrementAndCancel, 10},
+		// the allocations of the orders cancelled by self trade prevention are shared again
+		{types.MatchingAlgorithmProRata, types.SelfTradePreventionCancelOldest, 10},
+		{types.MatchingAlgorithmProRataTopOrder, types.SelfTradePreventionDecrementAndCancel, 10},
+	} {
+		t.Run(fmt.Sprintf("%s/%s", test.algorithm, test.stp), func(t *testing.T) {
+			for seed := int64(1); seed <= test.seeds; seed++ {
+				random := rand.New(rand.NewSource(seed))
+
+				data := make([]byte, 4*500)
+				random.Read(data)
+
+				h := newBookHarness(t, func(c *MarketConfig) {
+					c.MatchingAlgorithm = test.algorithm
+					c.SelfTradePrevention = test.stp
+				})
+				h.Run(data)
+			}
+		})
+	}
+}
+
+// TestProRataAllocation splits a quantity between the orders of a level, the allocations are
+// rounded down to the lot and what is left is given lot by lot in time priority.
+func TestProRataAllocation(t *testing.T) {
+	for _, test := range []struct {
+		algorithm   types.MatchingAlgorithm
+		quantities  []int64
+		quantity    Fixed
+		allocations []Fixed
+	}{
+		// 8 lots over 3 + 3 + 3: 2.67 each rounded down to 2, the 2 lots left go to the first orders
+		{types.MatchingAlgorithmProRata, []int64{3, 3, 3}, 8, []Fixed{3, 3, 2}},
+		// 7 lots over 2 + 4 + 6: 1.17, 2.33 and 3.5 rounded down to 1, 2 and 3
+		{types.MatchingAlgorithmProRata, []int64{2, 4, 6}, 7, []Fixed{2, 2, 3}},
+		// the top order is filled first, the 4 lots left are shared by the others: 1.6 and 2.4
+		{types.MatchingAlgorithmProRataTopOrder, []int64{2, 4, 6}, 6, []Fixed{2, 2, 2}},
+		// the quantity fills the top order alone
+		{types.MatchingAlgorithmProRataTopOrder, []int64{2, 4, 6}, 2, []Fixed{2, 0, 0}},
+		// the whole level is taken in time priority
+		{types.MatchingAlgorithmProRata, []int64{2, 4, 6}, 12, nil},
+	} {
+		h := newBookHarness(t, func(c *MarketConfig) {
+			c.MatchingAlgorithm = test.algorithm
+			c.AmountPrecision = 0
+		})
+
+		quantities := test.quantities
+		orders := make([]*Order, len(quantities))
+		for i, quantity := range quantities {
+			orders[i] = h.newOrder(pkg.SideSell, pkg.TypeLimit, decimal.NewFromInt(101), decimal.NewFromInt(quantity))
+			h.ob.Add(orders[i])
+		}
+
+		price, _ := h.ob.Config.PriceScale().FromDecimal(decimal.NewFromInt(101))
+		allocations := h.ob.allocate(h.ob.Depth.priceLevel(pkg.SideSell, price), test.quantity)
+
+		if test.allocations == nil {
+			if allocations != nil {
+				t.Fatalf("%s of %d: allocations %v, expected time priority", test.algorithm, test.quantity, allocations)
+			}
+
+			continue
+		}
+
+		var sum Fixed
+		for i, o := range orders {
+			if allocations[o.UUID] != test.allocations[i] {
+				t.Fatalf("%s of %d over %v: order %d allocated %d, expected %d", test.algorithm, test.quantity, quantities, i, allocations[o.UUID], test.allocations[i])
+			}
+
+			sum += allocations[o.UUID]
+		}
+
+		if sum != test.quantity {
+			t.Fatalf("%s of %d: allocations sum to %d", test.algorithm, test.quantity, sum)
+		}
+	}
+}
+
+// TestProRataAllocationLotSize splits a quantity between the orders of a level in multiples of the
+// lot size of the market, which is larger than the smallest unit of the amount precision.
+func TestProRataAllocationLotSize(t *testing.T) {
+	h := newBookHarness(t, func(c *MarketConfig) {
+		c.MatchingAlgorithm = types.MatchingAlgorithmProRata
+		c.AmountPrecision = 2
+		c.TradingRules.LotSize = decimal.New(5, -1)
+	})
+
+	orders := make([]*Order, 3)
+	for i := range orders {
+		orders[i] = h.newOrder(pkg.SideSell, pkg.TypeLimit, decimal.NewFromInt(101), decimal.New(15, -1))
+		h.ob.Submit(orders[i])
+	}
+
+	// 3.5 over 1.5 + 1.5 + 1.5: 1.1666 each rounded down to 1, the lot left goes to the first order
+	taker := h.newOrder(pkg.SideBuy, pkg.TypeLimit, decimal.NewFromInt(101), decimal.New(35, -1))
+	h.ob.Submit(taker)
+	h.check()
+
+	for i, expected := range []string{"1.5", "1", "1"} {
+		if filled := h.ob.Config.AmountScale().Decimal(orders[i].filledQuantity); !filled.Equal(decimal.RequireFromString(expected)) {
+			t.Fatalf("order %d filled %s, expected %s", i, filled, expected)
+		}
+	}
+}
+
+// TestOrderBookAmend amends a resting order, an amend the market doesn't accept keeps the order
+// as it was and sends its values back so the funds locked for the amend are released. The amends
+// and the cancel are sent with the key of the order before it was repriced, as order_processor
+// does until trade_executor updates the order.
+func TestOrderBookAmend(t *testing.T) {
+	h := newBookHarness(t)
+
+	o := h.newOrder(pkg.SideSell, pkg.TypeLimit, decimal.NewFromInt(101), decimal.NewFromInt(2))
+	h.ob.Add(o)
+
+	key := o.Key()
+	amend := func(price, quantity int64) {
+		h.ob.Amend(key, &Order{Order: pkg.Order{Price: decimal.NewFromInt(price), Quantity: decimal.NewFromInt(quantity)}})
+		h.check()
+	}
+
+	amend(101, 1)
+	if resting := h.ob.Depth.Get(o.Key()); resting == nil || !resting.Quantity.Equal(decimal.NewFromInt(1)) {
+		t.Fatalf("reduced order %v", resting)
+	}
+
+	h.ob.SetTradingState(types.TradingStateCancelOnly)
+	amend(102, 1)
+	if resting := h.ob.Depth.Get(o.Key()); resting == nil || !resting.Price.Equal(decimal.NewFromInt(101)) {
+		t.Fatalf("order %v was changed by an amend of a cancel only market", resting)
+	}
+
+	h.ob.SetTradingState(types.TradingStateTrading)
+	amend(102, 1)
+	if resting := h.ob.Depth.Get(o.Key()); resting == nil || !resting.Price.Equal(decimal.NewFromInt(102)) {
+		t.Fatalf("order %v wasn't moved to 102", resting)
+	}
+
+	if prices := h.out.amends[o.ID]; len(prices) != 3 || !prices[0].Equal(decimal.NewFromInt(101)) || !prices[1].Equal(decimal.NewFromInt(101)) || !prices[2].Equal(decimal.NewFromInt(102)) {
+		t.Fatalf("amends sent with prices %v", prices)
+	}
+
+	if h.out.cancels[o.ID] > 0 {
+		t.Fatalf("amended order %d was cancelled", o.ID)
+	}
+
+	amend(103, 1)
+	if resting := h.ob.Depth.Get(key); resting == nil || !resting.Price.Equal(decimal.NewFromInt(103)) {
+		t.Fatalf("order %v wasn't moved to 103 by a second amend", resting)
+	}
+
+	h.ob.Remove(key)
+	h.check()
+	if h.ob.Depth.Get(key) != nil || h.out.cancels[o.ID] != 1 {
+		t.Fatalf("amended order %d left in the book with %d cancels", o.ID, h.out.cancels[o.ID])
+	}
+
+	// the order already left the book, nothing is cancelled again
+	h.ob.Remove(key)
+	if h.out.cancels[o.ID] != 1 {
+		t.Fatalf("order %d cancelled %d times", o.ID, h.out.cancels[o.ID])
+	}
+}
+
+// TestMarketOrderBudget sweeps the book with a buy market order which can't spend more than it
+// locked, what it buys at the last price is rounded down to the amount precision.
+func TestMarketOrderBudget(t *testing.T) {
+	h := newBookHarness(t)
+
+	h.ob.Add(h.newOrder(pkg.SideSell, pkg.TypeLimit, decimal.NewFromInt(60), decimal.NewFromInt(1)))
+	h.ob.Add(h.newOrder(pkg.SideSell, pkg.TypeLimit, decimal.NewFromInt(70), decimal.NewFromInt(5)))
+	h.check()
+
+	o := h.newOrder(pkg.SideBuy, pkg.TypeMarket, decimal.Zero, decimal.NewFromInt(3))
+	o.Budget = decimal.NewFromInt(100)
+	h.ob.Add(o)
+	h.check()
+
+	if len(h.out.trades) != 2 || !h.out.trades[1].Quantity.Equal(decimal.RequireFromString("0.5714")) {
+		t.Fatalf("trades %v, expected 1 at 60 and 0.5714 at 70", h.out.trades)
+	}
+
+	if last := h.out.trades[1]; !last.Cancels(o.ID) {
+		t.Fatalf("the remainder of order %d wasn't cancelled by its last trade", o.ID)
+	}
+
+	if filled_budget := o.filledBudget.Decimal(h.ob.Config.TotalScale()); !filled_budget.Equal(decimal.RequireFromString("99.998")) {
+		t.Fatalf("order spent %s of its budget", filled_budget)
+	}
+}
+
+// TestResumeHalt resumes a halted market without any order coming in once its halt is over.
+func TestResumeHalt(t *testing.T) {
+	h := newBookHarness(t)
+
+	halted_until := time.Date(2022, 1, 1, 0, 5, 0, 0, time.UTC)
+	h.ob.HaltedUntil = halted_until
+
+	h.ob.ResumeHalt(halted_until.Add(-time.Second))
+	if !h.ob.HaltedUntil.Equal(halted_until) {
+		t.Fatalf("market resumed before the end of its halt")
+	}
+
+	h.ob.ResumeHalt(halted_until)
+	if !h.ob.HaltedUntil.IsZero() {
+		t.Fatalf("market still halted until %v", h.ob.HaltedUntil)
+	}
+}
+
+// TestEngineResumeHalt resumes the halt of an engine without the notification ticker when it
+// runs a command after the end of the halt, at the time of its book.
+func TestEngineResumeHalt(t *testing.T) {
+	h := newBookHarness(t)
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	halted_until := now.Add(time.Minute)
+
+	engine := NewOfflineEngine(h.ob.Symbol, decimal.NewFromInt(100), h.ob.Config, h.out)
+	defer engine.Stop()
+
+	halted := func() (halted bool) {
+		engine.Execute(func(ob *OrderBook) {
+			halted = !ob.HaltedUntil.IsZero()
+		})
+
+		return halted
+	}
+
+	engine.Execute(func(ob *OrderBook) {
+		ob.Clock = func() time.Time { return now }
+		ob.HaltedUntil = halted_until
+	})
+
+	if !halted() {
+		t.Fatalf("market resumed before the end of its halt")
+	}
+
+	now = halted_until
+	if halted() {
+		t.Fatalf("market still halted at the end of its halt")
+	}
+}
+
+// TestEngineStopped sends commands to a stopped engine, they aren't run and their senders are told.
+func TestEngineStopped(t *testing.T) {
+	h := newBookHarness(t)
+
+	engine := NewOfflineEngine(h.ob.Symbol, decimal.NewFromInt(100), h.ob.Config, h.out)
+	engine.Stop()
+
+	o := h.newOrder(pkg.SideSell, pkg.TypeLimit, decimal.NewFromInt(101), decimal.NewFromInt(1))
+	if err := engine.Submit(o); !errors.Is(err, ErrEngineStopped) {
+		t.Fatalf("submit to a stopped engine returned %v", err)
+	}
+
+	if order, err := engine.FetchOrder(o.Key()); order != nil || !errors.Is(err, ErrEngineStopped) {
+		t.Fatalf("fetch from a stopped engine returned %v, %v", order, err)
+	}
+
+	if response, err := engine.FetchOrderBook(10, decimal.Zero); response != nil || !errors.Is(err, ErrEngineStopped) {
+		t.Fatalf("order book of a stopped engine returned %v, %v", response, err)
+	}
+}
+
+// TestAuctionSelfTradePrevention uncrosses an auction where a member has orders on both sides,
+// an order cancelled after it traded in the auction is cancelled by its last trade.
+func TestAuctionSelfTradePrevention(t *testing.T) {
+	for _, test := range []struct {
+		mode      types.SelfTradePrevention
+		cancelled int64
+		traded    string
+	}{
+		// the bid 1 trades the older ask 2 then meets the ask 3 of its member, the newest of the two
+		{types.SelfTradePreventionCancelNewest, 3, "1"},
+		{types.SelfTradePreventionCancelOldest, 1, "1"},
+	} {
+		h := newBookHarness(t, func(c *MarketConfig) {
+			c.SelfTradePrevention = test.mode
+		})
+		h.ob.StartAuction()
+
+		for _, order := range []struct {
+			side      pkg.OrderSide
+			price     int64
+			quantity  int64
+			member_id int64
+		}{
+			{pkg.SideBuy, 101, 2, 7},
+			{pkg.SideSell, 100, 1, 8},
+			{pkg.SideSell, 100, 1, 7},
+		} {
+			o := h.newOrder(order.side, pkg.TypeLimit, decimal.NewFromInt(order.price), decimal.NewFromInt(order.quantity))
+			o.MemberID = order.member_id
+			h.ob.Add(o)
+		}
+
+		h.ob.EndAuction()
+		h.check()
+
+		if len(h.out.trades) != 1 || !h.out.trades[0].Quantity.Equal(decimal.RequireFromString(test.traded)) {
+			t.Fatalf("%s: trades %v, expected one of %s", test.mode, h.out.trades, test.traded)
+		}
+
+		if h.out.cancels[test.cancelled] != 1 || !h.orders[test.cancelled].Cancelled {
+			t.Fatalf("%s: order %d wasn't cancelled", test.mode, test.cancelled)
+		}
+
+		// the bid traded before it was cancelled, its cancel is settled after its trade
+		if test.cancelled == 1 && !h.out.trades[0].Cancels(1) {
+			t.Fatalf("%s: order 1 was cancelled before its trade was settled", test.mode)
+		}
+	}
+}
+
+// FuzzOrderBook runs the operations generated by the fuzzer against the order book, four bytes each.
+func FuzzOrderBook(f *testing.F) {
+	f.Add([]byte{0, 0, 10, 4, 1, 1, 10, 4, 2, 0, 20, 0})
+	f.Add([]byte{3, 2, 10, 12, 0, 3, 30, 4, 0, 12, 30, 5, 4, 0, 0, 1})
+	f.Add([]byte{0, 8, 40, 3, 1, 9, 20, 3, 5, 2, 10, 0, 2, 1, 49, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		newBookHarness(t).Run(data)
+	})
+}
@@ -5,14 +5,39 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 	"github.com/zsmartex/pkg"
 )
 
+func newBenchmarkOrder(id int64, side pkg.OrderSide, price, quantity int) *Order {
+	return &Order{
+		Order: pkg.Order{
+			ID:        id,
+			UUID:      uuid.New(),
+			Side:      side,
+			Type:      pkg.TypeLimit,
+			Price:     decimal.NewFromInt(int64(price)),
+			Quantity:  decimal.NewFromInt(int64(quantity)),
+			CreatedAt: time.Now(),
+		},
+	}
+}
+
+// newRestingOrders returns sell orders spread over a few price levels, none of them match.
+func newRestingOrders(n, levels int) []*Order {
+	orders := make([]*Order, n)
+	for i := 0; i < n; i++ {
+		orders[i] = newBenchmarkOrder(int64(i), pkg.SideSell, 100+rand.Intn(levels), rand.Intn(10)+1)
+	}
+
+	return orders
+}
+
 func BenchmarkInsertOrder(b *testing.B) {
-	orderBook := NewOrderBook(pkg.Symbol{BaseCurrency: "ABC", QuoteCurrency: "XYZ"}, decimal.Zero)
+	orderBook := NewOrderBook(pkg.Symbol{BaseCurrency: "ABC", QuoteCurrency: "XYZ"}, decimal.Zero, DefaultMarketConfig())
 
-	orders := make([]*pkg.Order, b.N)
+	orders := make([]*Order, b.N)
 	for n := 0; n < b.N; n++ {
 		var side pkg.OrderSide
 		switch rand.Intn(2) {
@@ -22,17 +47,87 @@ func BenchmarkInsertOrder(b *testing.B) {
 			side = pkg.SideBuy
 		}
 
-		price := rand.Intn(10)
-		quantity := rand.Intn(10) + 1
+		orders[n] = newBenchmarkOrder(int64(n), side, rand.Intn(10), rand.Intn(10)+1)
+	}
 
-		orders[n] = &pkg.Order{
-			ID:        int64(n),
-			Side:      side,
-			Price:     decimal.NewFromFloat(float64(price)),
-			Quantity:  decimal.NewFromFloat(float64(quantity)),
-			CreatedAt: time.Now(),
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		orderBook.Add(orders[n])
+	}
+	b.StopTimer()
+}
+
+// BenchmarkInsertDeepLevel queues every order behind the others of a single price level.
+func BenchmarkInsertDeepLevel(b *testing.B) {
+	orderBook := NewOrderBook(pkg.Symbol{BaseCurrency: "ABC", QuoteCurrency: "XYZ"}, decimal.Zero, DefaultMarketConfig())
+	orders := newRestingOrders(b.N, 1)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		orderBook.Add(orders[n])
+	}
+	b.StopTimer()
+}
+
+// BenchmarkCancelOrder cancels the orders of a deep book in random order.
+func BenchmarkCancelOrder(b *testing.B) {
+	orderBook := NewOrderBook(pkg.Symbol{BaseCurrency: "ABC", QuoteCurrency: "XYZ"}, decimal.Zero, DefaultMarketConfig())
+	orders := newRestingOrders(b.N, 10)
+
+	for _, order := range orders {
+		orderBook.Add(order)
+	}
+
+	rand.Shuffle(len(orders), func(i, j int) {
+		orders[i], orders[j] = orders[j], orders[i]
+	})
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		orderBook.Remove(orders[n].Key())
+	}
+	b.StopTimer()
+}
+
+// BenchmarkInsertCancel keeps a deep book where most of the orders are cancelled soon after they are placed.
+func BenchmarkInsertCancel(b *testing.B) {
+	orderBook := NewOrderBook(pkg.Symbol{BaseCurrency: "ABC", QuoteCurrency: "XYZ"}, decimal.Zero, DefaultMarketConfig())
+
+	for _, order := range newRestingOrders(10000, 10) {
+		orderBook.Add(order)
+	}
+
+	orders := newRestingOrders(b.N, 10)
+	live := make([]*Order, 0, b.N)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		orderBook.Add(orders[n])
+		live = append(live, orders[n])
+
+		if rand.Intn(10) > 0 {
+			i := rand.Intn(len(live))
+			orderBook.Remove(live[i].Key())
+			live[i] = live[len(live)-1]
+			live = live[:len(live)-1]
 		}
 	}
+	b.StopTimer()
+}
+
+// BenchmarkMatchDeepLevel sweeps a deep price level with small market orders.
+func BenchmarkMatchDeepLevel(b *testing.B) {
+	orderBook := NewOrderBook(pkg.Symbol{BaseCurrency: "ABC", QuoteCurrency: "XYZ"}, decimal.Zero, DefaultMarketConfig())
+
+	for _, order := range newRestingOrders(b.N, 1) {
+		orderBook.Add(order)
+	}
+
+	orders := make([]*Order, b.N)
+	for n := 0; n < b.N; n++ {
+		orders[n] = newBenchmarkOrder(int64(n), pkg.SideBuy, 0, 1)
+		orders[n].Type = pkg.TypeMarket
+	}
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
@@ -0,0 +1,79 @@
+package matching
+
+import (
+	"github.com/zsmartex/finex/types"
+	"github.com/zsmartex/pkg"
+)
+
+const (
+	// ActionReject is sent to order_processor when the engine refuses an order.
+	ActionReject pkg.PayloadAction = "reject"
+	// ActionDecrement is sent to order_processor when the engine reduces the quantity of an order.
+	ActionDecrement pkg.PayloadAction = "decrement"
+	// ActionTrigger is sent to order_processor when a stop order reaches its trigger price.
+	ActionTrigger pkg.PayloadAction = "trigger"
+	// ActionAmend changes the price and the quantity of an order, it is sent to order_processor to
+	// lock the funds the amend needs and then to the engine with the key of the order before the change,
+	// the engine sends the values the order rests with to trade_executor which updates the order.
+	ActionAmend pkg.PayloadAction = "amend"
+	// ActionStartAuction and ActionEndAuction open and close the call auction of the symbol.
+	ActionStartAuction pkg.PayloadAction = "start_auction"
+	ActionEndAuction   pkg.PayloadAction = "end_auction"
+	// ActionSetTradingState switches the symbol to the trading state of the message.
+	ActionSetTradingState pkg.PayloadAction = "set_trading_state"
+	// ActionMassCancel cancels the orders selected by the mass cancel of the message, in the market
+	// of the symbol or in every market when the message has no symbol.
+	ActionMassCancel pkg.PayloadAction = "mass_cancel"
+)
+
+// MatchingPayloadMessage is the message consumed from the matching topic,
+// the order is decoded as an engine order so its finex attributes are kept.
+// The orders of an OCO pair are submitted together, the second one is OcoOrder.
+type MatchingPayloadMessage struct {
+	pkg.MatchingPayloadMessage
+	Order    *Order `json:"order"`
+	OcoOrder *Order `json:"oco_order,omitempty"`
+	// TradingState is the state set by ActionSetTradingState
+	TradingState types.TradingState `json:"trading_state,omitempty"`
+	// MassCancel selects the orders cancelled by ActionMassCancel
+	MassCancel *MassCancel `json:"mass_cancel,omitempty"`
+}
+
+// Trade is the message sent to trade_executor. An order which doesn't rest in the book after it
+// traded is cancelled by its last trade, order_processor would close it before trade_executor
+// settles its trades since the topics are consumed by different workers.
+type Trade struct {
+	pkg.Trade
+	// CancelOrderIDs are the orders whose remainder is cancelled once the trade is settled
+	CancelOrderIDs []int64 `json:"cancel_order_ids,omitempty"`
+
+	// price, quantity and the copies of the orders are what the engine made the trade with,
+	// they are converted to the decimals of the message when it is sent
+	price    Fixed
+	quantity Fixed
+	maker    *Order
+	taker    *Order
+}
+
+// toDecimal writes the price, the quantity, the total and the orders of the trade to its message.
+func (t *Trade) toDecimal(c MarketConfig) {
+	t.maker.toDecimal(c)
+	t.taker.toDecimal(c)
+
+	t.Price = c.PriceScale().Decimal(t.price)
+	t.Quantity = c.AmountScale().Decimal(t.quantity)
+	t.Total = MulFixed(t.price, t.quantity).Decimal(c.TotalScale())
+	t.MakerOrder = t.maker.Order
+	t.TakerOrder = t.taker.Order
+}
+
+// Cancels returns true if the remainder of the order is cancelled by the trade.
+func (t *Trade) Cancels(id int64) bool {
+	for _, cancel_id := range t.CancelOrderIDs {
+		if cancel_id == id {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,30 +1,34 @@
 package matching
 
 import (
-	"sync"
-
-	"github.com/emirpasic/gods/lists/arraylist"
-	"github.com/shopspring/decimal"
+	"github.com/google/uuid"
 	"github.com/zsmartex/pkg"
 )
 
+// PriceLevel holds the orders of a price in time priority. The orders are linked to each
+// other and indexed by UUID, the quantities of the level are kept up to date as they change
+// so every operation is done in constant time.
 type PriceLevel struct {
-	sync.Mutex
-	Side   pkg.OrderSide
-	Price  decimal.Decimal
-	Orders *arraylist.List
+	Side  pkg.OrderSide
+	Price Fixed
+
+	head    *Order
+	tail    *Order
+	index   map[uuid.UUID]*Order
+	total   Fixed
+	visible Fixed
 }
 
 type PriceLevelKey struct {
 	Side  pkg.OrderSide
-	Price decimal.Decimal
+	Price Fixed
 }
 
-func NewPriceLevel(side pkg.OrderSide, price decimal.Decimal) *PriceLevel {
+func NewPriceLevel(side pkg.OrderSide, price Fixed) *PriceLevel {
 	return &PriceLevel{
-		Side:   side,
-		Price:  price,
-		Orders: arraylist.New(),
+		Side:  side,
+		Price: price,
+		index: make(map[uuid.UUID]*Order),
 	}
 }
 
@@ -35,98 +39,95 @@ func (p *PriceLevel) Key() *PriceLevelKey {
 	}
 }
 
-func (p *PriceLevel) Add(o *pkg.Order) {
-	p.Lock()
-	defer p.Unlock()
+// Add puts the order behind the others of the level, the orders enter the book in priority order.
+func (p *PriceLevel) Add(o *Order) {
+	if _, found := p.index[o.UUID]; found {
+		return
+	}
 
-	index, _ := p.Orders.Find(func(index int, value interface{}) bool {
-		order := value.(*pkg.Order)
+	o.prev = p.tail
+	o.next = nil
+	if p.tail != nil {
+		p.tail.next = o
+	} else {
+		p.head = o
+	}
+	p.tail = o
+	p.index[o.UUID] = o
 
-		return order.UUID == o.UUID
-	})
+	o.levelTotal = o.UnfilledQuantity()
+	o.levelVisible = o.Visible()
+	p.total += o.levelTotal
+	p.visible += o.levelVisible
+}
 
-	if index == -1 {
-		p.Orders.Add(o)
-		p.Orders.Sort(OrderComparator)
+// Update counts the current quantities of an order of the level once it was filled or reduced.
+func (p *PriceLevel) Update(o *Order) {
+	if p.index[o.UUID] != o {
+		return
 	}
-}
 
-func (p *PriceLevel) Get(key *pkg.OrderKey) *pkg.Order {
-	p.Lock()
-	defer p.Unlock()
-	index, value := p.Orders.Find(func(index int, value interface{}) bool {
-		order := value.(*pkg.Order)
+	p.total -= o.levelTotal
+	p.visible -= o.levelVisible
 
-		return order.UUID == key.UUID
-	})
-	if index == -1 {
-		return nil
-	}
+	o.levelTotal = o.UnfilledQuantity()
+	o.levelVisible = o.Visible()
+	p.total += o.levelTotal
+	p.visible += o.levelVisible
+}
 
-	return value.(*pkg.Order)
+// Top returns the order with the highest priority.
+func (p *PriceLevel) Top() *Order {
+	return p.head
 }
 
-func (p *PriceLevel) Top() *pkg.Order {
-	value, found := p.Orders.Get(0)
-	if !found {
-		return nil
-	}
-	return value.(*pkg.Order)
+// Next returns the order behind the given one, nil if it is the last of the level.
+func (p *PriceLevel) Next(o *Order) *Order {
+	return o.next
 }
 
 func (p *PriceLevel) Empty() bool {
-	return p.Orders.Empty()
+	return p.head == nil
 }
 
 func (p *PriceLevel) Size() int {
-	return p.Orders.Size()
+	return len(p.index)
 }
 
-func (p *PriceLevel) Total() decimal.Decimal {
-	p.Lock()
-	defer p.Unlock()
-
-	total := decimal.Zero
-	iterator := p.Orders.Iterator()
-
-	for iterator.Next() {
-		order := iterator.Value().(*pkg.Order)
-		total = total.Add(order.UnfilledQuantity())
-	}
-
-	return total
+func (p *PriceLevel) Total() Fixed {
+	return p.total
 }
 
-func (p *PriceLevel) Remove(key *pkg.OrderKey) decimal.Decimal {
-	total := p.Total()
-
-	p.Lock()
-	defer p.Unlock()
-
-	index, order := p.Orders.Find(func(index int, value interface{}) bool {
-		order := value.(*pkg.Order)
-
-		return order.UUID == key.UUID
-	})
+// VisibleTotal returns the quantity shown in the public book, hidden iceberg quantity excluded.
+func (p *PriceLevel) VisibleTotal() Fixed {
+	return p.visible
+}
 
-	if index >= 0 {
-		p.Orders.Remove(index)
+// Remove unlinks the order with the given UUID and returns the quantity left in the level.
+func (p *PriceLevel) Remove(id uuid.UUID) Fixed {
+	o, found := p.index[id]
+	if !found {
+		return p.total
+	}
 
-		return total.Sub(order.(*pkg.Order).UnfilledQuantity())
+	if o.prev != nil {
+		o.prev.next = o.next
+	} else {
+		p.head = o.next
 	}
 
-	return total
-}
+	if o.next != nil {
+		o.next.prev = o.prev
+	} else {
+		p.tail = o.prev
+	}
 
-func OrderComparator(a, b interface{}) int {
-	aKey := a.(*pkg.Order)
-	bKey := b.(*pkg.Order)
+	o.prev = nil
+	o.next = nil
+	delete(p.index, id)
 
-	if aKey.CreatedAt.Before(bKey.CreatedAt) {
-		return 1
-	} else if aKey.CreatedAt.After(bKey.CreatedAt) {
-		return -1
-	}
+	p.total -= o.levelTotal
+	p.visible -= o.levelVisible
 
-	return 0
+	return p.total
 }
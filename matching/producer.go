@@ -0,0 +1,25 @@
+package matching
+
+import (
+	"strings"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/pkg"
+)
+
+// Producer sends the events of an order book to the settlement workers.
+type Producer interface {
+	Produce(topic string, payload interface{}) error
+}
+
+// Publisher sends the public events of a market to the websocket.
+type Publisher interface {
+	Publish(symbol pkg.Symbol, event string, payload interface{})
+}
+
+// RangoPublisher sends the events to the public stream of the market on Rango.
+type RangoPublisher struct{}
+
+func (RangoPublisher) Publish(symbol pkg.Symbol, event string, payload interface{}) {
+	config.RangoClient.EnqueueEvent(pkg.EnqueueEventKindPublic, strings.ToLower(symbol.ToSymbol("")), event, payload)
+}
@@ -1,28 +1,26 @@
 package matching
 
-import "github.com/zsmartex/pkg"
-
 // OrderQueue is the FIFO queue to store orders.
 type OrderQueue struct {
 	size   int64
-	values []*pkg.Order
+	values []*Order
 }
 
 // NewOrderQueue returns an order queue.
 func NewOrderQueue(size int64) *OrderQueue {
 	return &OrderQueue{
 		size:   size,
-		values: make([]*pkg.Order, 0, size),
+		values: make([]*Order, 0, size),
 	}
 }
 
 // Push appends an order to the end of order queue.
-func (oq *OrderQueue) Push(o *pkg.Order) {
+func (oq *OrderQueue) Push(o *Order) {
 	oq.values = append(oq.values, o)
 }
 
 // First returns the first order in order queue.
-func (oq *OrderQueue) First() *pkg.Order {
+func (oq *OrderQueue) First() *Order {
 	if oq.Size() <= 0 {
 		return nil
 	}
@@ -31,7 +29,7 @@ func (oq *OrderQueue) First() *pkg.Order {
 }
 
 // Pop removes and returns the first order in the order queue.
-func (oq *OrderQueue) Pop() *pkg.Order {
+func (oq *OrderQueue) Pop() *Order {
 	if oq.Size() <= 0 {
 		return nil
 	}
@@ -44,11 +42,11 @@ func (oq *OrderQueue) Pop() *pkg.Order {
 
 // Clear removes all orders.
 func (oq *OrderQueue) Clear() {
-	oq.values = make([]*pkg.Order, 0, oq.size)
+	oq.values = make([]*Order, 0, oq.size)
 }
 
 // Values returns all orders.
-func (oq *OrderQueue) Values() []*pkg.Order {
+func (oq *OrderQueue) Values() []*Order {
 	return oq.values
 }
 
@@ -0,0 +1,194 @@
+package matching
+
+import (
+	"time"
+
+	"github.com/emirpasic/gods/trees/redblacktree"
+	"github.com/shopspring/decimal"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/types"
+	"github.com/zsmartex/pkg"
+)
+
+// OrderBookSnapshot is the state of an order book, it is enough to rebuild
+// the book without matching its orders again.
+type OrderBookSnapshot struct {
+	Symbol           pkg.Symbol
+	MarketPrice      decimal.Decimal
+	Sequence         int64
+	L3Sequence       int64
+	PrioritySequence int64
+	Asks             []*Order
+	Bids             []*Order
+	StopAsks         []*Order
+	StopBids         []*Order
+	TrailingStops    []*Order
+	TradingState     types.TradingState
+	Auction          bool
+	HaltedUntil      time.Time
+	TradePrices      []PricePoint
+}
+
+// Snapshot copies the state of the order book.
+func (ob *OrderBook) Snapshot() *OrderBookSnapshot {
+	return &OrderBookSnapshot{
+		Symbol:           ob.Symbol,
+		MarketPrice:      ob.Config.PriceScale().Decimal(ob.MarketPrice),
+		Sequence:         ob.Depth.Notification.CurrentSequence(),
+		L3Sequence:       ob.Depth.L3.Sequence,
+		PrioritySequence: ob.Depth.prioritySequence,
+		Asks:             ob.snapshotPriceLevels(ob.Depth.Asks),
+		Bids:             ob.snapshotPriceLevels(ob.Depth.Bids),
+		StopAsks:         ob.snapshotStopOrders(ob.StopAsks),
+		StopBids:         ob.snapshotStopOrders(ob.StopBids),
+		TrailingStops:    ob.snapshotStopOrders(ob.TrailingStops),
+		TradingState:     ob.TradingState,
+		Auction:          ob.Auction,
+		HaltedUntil:      ob.HaltedUntil,
+		TradePrices:      ob.snapshotTradePrices(),
+	}
+}
+
+// Restore loads a snapshot into an empty order book, nothing is published. The orders
+// whose values don't fit the scales of the market are dropped.
+func (ob *OrderBook) Restore(snapshot *OrderBookSnapshot) {
+	restored := *snapshot
+	restored.Asks = ob.restoreOrders(snapshot.Asks)
+	restored.Bids = ob.restoreOrders(snapshot.Bids)
+	restored.StopAsks = ob.restoreOrders(snapshot.StopAsks)
+	restored.StopBids = ob.restoreOrders(snapshot.StopBids)
+	restored.TrailingStops = ob.restoreOrders(snapshot.TrailingStops)
+
+	ob.loadMarketPrice(restored.MarketPrice)
+	if len(restored.TradingState) > 0 {
+		ob.TradingState = restored.TradingState
+	}
+	ob.Auction = restored.Auction
+	ob.HaltedUntil = restored.HaltedUntil
+	ob.restoreTradePrices(restored.TradePrices)
+	ob.Depth.Restore(&restored)
+
+	for _, o := range restored.StopAsks {
+		ob.StopAsks.Put(o.stopKey(), o)
+	}
+
+	for _, o := range restored.StopBids {
+		ob.StopBids.Put(o.stopKey(), o)
+	}
+
+	for _, o := range restored.TrailingStops {
+		ob.TrailingStops.Put(o.ID, o)
+	}
+
+	for _, orders := range [][]*Order{restored.Asks, restored.Bids, restored.StopAsks, restored.StopBids, restored.TrailingStops} {
+		for _, o := range orders {
+			if o.OcoID != 0 {
+				ob.ocoOrders[o.ID] = o
+			}
+		}
+	}
+}
+
+// restoreOrders converts the orders of a snapshot to the scales of the market.
+func (ob *OrderBook) restoreOrders(orders []*Order) []*Order {
+	restored := make([]*Order, 0, len(orders))
+
+	for _, o := range orders {
+		if err := o.toFixed(ob.Config); err != nil {
+			config.Logger.Errorf("[oceanbook.orderbook] order %d of the snapshot dropped, %s", o.ID, err)
+			continue
+		}
+
+		restored = append(restored, o)
+	}
+
+	return restored
+}
+
+// snapshotTradePrices converts the prices of the circuit breaker window to decimals.
+func (ob *OrderBook) snapshotTradePrices() []PricePoint {
+	var points []PricePoint
+
+	for _, point := range ob.tradePrices {
+		points = append(points, PricePoint{Price: ob.Config.PriceScale().Decimal(point.price), Time: point.time})
+	}
+
+	return points
+}
+
+// restoreTradePrices converts the prices of the circuit breaker window of a snapshot, the ones
+// which don't fit the price precision are dropped.
+func (ob *OrderBook) restoreTradePrices(points []PricePoint) {
+	ob.tradePrices = nil
+
+	for _, point := range points {
+		price, err := ob.Config.PriceScale().FromDecimal(point.Price)
+		if err != nil {
+			continue
+		}
+
+		ob.tradePrices = append(ob.tradePrices, tradePrice{price: price, time: point.Time})
+	}
+}
+
+// Restore inserts the resting orders of a snapshot keeping their time priority.
+func (d *Depth) Restore(snapshot *OrderBookSnapshot) {
+	for _, o := range snapshot.Asks {
+		d.insert(d.Asks, o)
+	}
+
+	for _, o := range snapshot.Bids {
+		d.insert(d.Bids, o)
+	}
+
+	d.prioritySequence = snapshot.PrioritySequence
+	d.L3.Sequence = snapshot.L3Sequence
+
+	d.Notification.NotifyMutex.Lock()
+	if snapshot.Sequence > d.Notification.Sequence {
+		d.Notification.Sequence = snapshot.Sequence
+	}
+	d.Notification.NotifyMutex.Unlock()
+}
+
+func (d *Depth) insert(price_levels *redblacktree.Tree, o *Order) {
+	d.orders[o.UUID] = o
+
+	pl := NewPriceLevel(o.Side, o.price)
+
+	value, found := price_levels.Get(pl.Key())
+	if !found {
+		pl.Add(o)
+		price_levels.Put(pl.Key(), pl)
+		return
+	}
+
+	value.(*PriceLevel).Add(o)
+}
+
+func (ob *OrderBook) snapshotPriceLevels(price_levels *redblacktree.Tree) []*Order {
+	orders := make([]*Order, 0)
+
+	it := price_levels.Iterator()
+	for it.Next() {
+		price_level := it.Value().(*PriceLevel)
+
+		for o := price_level.Top(); o != nil; o = price_level.Next(o) {
+			orders = append(orders, ob.export(o))
+		}
+	}
+
+	return orders
+}
+
+func (ob *OrderBook) snapshotStopOrders(book *redblacktree.Tree) []*Order {
+	orders := make([]*Order, 0)
+
+	it := book.Iterator()
+	for it.Next() {
+		orders = append(orders, ob.export(it.Value().(*Order)))
+	}
+
+	return orders
+}
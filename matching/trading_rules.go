@@ -0,0 +1,186 @@
+package matching
+
+import (
+	"errors"
+	"math"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// ErrTickSize is returned when the price of an order isn't a multiple of the tick size.
+	ErrTickSize = errors.New("price isn't a multiple of the tick size")
+	// ErrPriceRange is returned when the price of an order is out of the prices of the market.
+	ErrPriceRange = errors.New("price is out of the price range")
+	// ErrLotSize is returned when the quantity of an order isn't a multiple of the lot size.
+	ErrLotSize = errors.New("quantity isn't a multiple of the lot size")
+	// ErrQuantityRange is returned when the quantity of an order is out of the quantities of the market.
+	ErrQuantityRange = errors.New("quantity is out of the quantity range")
+	// ErrNotionalRange is returned when the total of an order is out of the totals of the market.
+	ErrNotionalRange = errors.New("total is out of the notional range")
+)
+
+// TradingRules are the limits of the orders placed in a market, the API checks them first and the
+// engine checks them again when an order is submitted. A zero value disables its rule.
+type TradingRules struct {
+	// TickSize is the step of the prices and LotSize the step of the quantities
+	TickSize decimal.Decimal
+	LotSize  decimal.Decimal
+
+	MinPrice  decimal.Decimal
+	MaxPrice  decimal.Decimal
+	MinAmount decimal.Decimal
+	MaxAmount decimal.Decimal
+
+	// MinNotional and MaxNotional bound the total of an order at its limit price or at its stop price,
+	// the total of an order placed by quote volume is its volume
+	MinNotional decimal.Decimal
+	MaxNotional decimal.Decimal
+}
+
+// tradingRules are the trading rules converted to the scales of the market once when the book is
+// built, the prices and the quantities of the orders are checked as fixed point values.
+type tradingRules struct {
+	tickSize Fixed
+	lotSize  Fixed
+
+	minPrice  Fixed
+	maxPrice  Fixed
+	minAmount Fixed
+	maxAmount Fixed
+
+	minNotional Wide
+	maxNotional Wide
+}
+
+// toFixed converts the rules to the scales of the market. The steps and the minimums are rounded up
+// and the maximums down, so a value of the scale breaks the rule converted as it breaks the rule.
+func (r TradingRules) toFixed(c MarketConfig) tradingRules {
+	price, amount, total := c.PriceScale(), c.AmountScale(), c.TotalScale()
+
+	return tradingRules{
+		tickSize:    ceilRule(price, r.TickSize),
+		lotSize:     ceilRule(amount, r.LotSize),
+		minPrice:    ceilRule(price, r.MinPrice),
+		maxPrice:    floorRule(price, r.MaxPrice),
+		minAmount:   ceilRule(amount, r.MinAmount),
+		maxAmount:   floorRule(amount, r.MaxAmount),
+		minNotional: wideRule(total, r.MinNotional.Shift(int32(total)).Ceil().Shift(-int32(total))),
+		maxNotional: wideRule(total, r.MaxNotional.Shift(int32(total)).Floor().Shift(-int32(total))),
+	}
+}
+
+// ceilRule converts a step or a minimum rounded up, one too large for the scale is the largest value.
+func ceilRule(s Scale, value decimal.Decimal) Fixed {
+	if !value.IsPositive() {
+		return 0
+	}
+
+	fixed, err := s.Ceil(value)
+	if err != nil {
+		return math.MaxInt64
+	}
+
+	return fixed
+}
+
+// floorRule converts a maximum rounded down, one too large for the scale doesn't limit anything.
+func floorRule(s Scale, value decimal.Decimal) Fixed {
+	if !value.IsPositive() {
+		return 0
+	}
+
+	fixed, err := s.Floor(value)
+	if err != nil {
+		return 0
+	}
+
+	return fixed
+}
+
+// wideRule converts a bound of the totals, it is disabled when it doesn't fit.
+func wideRule(s Scale, value decimal.Decimal) Wide {
+	if !value.IsPositive() {
+		return Wide{}
+	}
+
+	wide, err := WideFromDecimal(value, s)
+	if err != nil {
+		return Wide{}
+	}
+
+	return wide
+}
+
+// Check returns the error of the first rule the order breaks, the fake orders aren't checked.
+func (r tradingRules) Check(o *Order) error {
+	if o.IsFake() {
+		return nil
+	}
+
+	for _, price := range []Fixed{o.price, o.stopPrice} {
+		if price <= 0 {
+			continue
+		}
+
+		if !multipleOf(price, r.tickSize) {
+			return ErrTickSize
+		}
+
+		if !between(price, r.minPrice, r.maxPrice) {
+			return ErrPriceRange
+		}
+	}
+
+	// the quantity of an order placed by quote volume is what its trades buy
+	if o.IsQuote() {
+		if !betweenWide(o.quoteQuantity, r.minNotional, r.maxNotional) {
+			return ErrNotionalRange
+		}
+
+		return nil
+	}
+
+	if !multipleOf(o.quantity, r.lotSize) || !multipleOf(o.displayQuantity, r.lotSize) {
+		return ErrLotSize
+	}
+
+	if !between(o.quantity, r.minAmount, r.maxAmount) {
+		return ErrQuantityRange
+	}
+
+	price := o.price
+	if price <= 0 {
+		price = o.stopPrice
+	}
+
+	// the total of a market order is only known once it traded
+	if price > 0 && !betweenWide(MulFixed(price, o.quantity), r.minNotional, r.maxNotional) {
+		return ErrNotionalRange
+	}
+
+	return nil
+}
+
+// multipleOf returns true if the value is a multiple of the step, or the step isn't positive.
+func multipleOf(value, step Fixed) bool {
+	return step <= 0 || value%step == 0
+}
+
+// between returns true if the value is within the bounds, a bound which isn't positive is ignored.
+func between(value, min, max Fixed) bool {
+	if min > 0 && value < min {
+		return false
+	}
+
+	return max <= 0 || value <= max
+}
+
+// betweenWide returns true if the total is within the bounds, a zero bound is ignored.
+func betweenWide(value, min, max Wide) bool {
+	if !min.IsZero() && value.Cmp(min) < 0 {
+		return false
+	}
+
+	return max.IsZero() || value.Cmp(max) <= 0
+}
@@ -0,0 +1,45 @@
+package matching
+
+import (
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/types"
+	"github.com/zsmartex/pkg"
+)
+
+// SetTradingState switches the market to a trading state, the orders resting in the book
+// and the stop orders are kept whatever the state is.
+func (ob *OrderBook) SetTradingState(state types.TradingState) {
+	if !state.IsValid() {
+		config.Logger.Errorf("[oceanbook.orderbook] unknown trading state %s", state)
+		return
+	}
+
+	if ob.TradingState == state {
+		return
+	}
+
+	config.Logger.Infof("[oceanbook.orderbook] %s switched from %s to %s", ob.Symbol.String(), ob.TradingState, state)
+
+	ob.TradingState = state
+
+	ob.PublishMarketState()
+}
+
+// refuseOrder rejects an order the trading state of the market doesn't accept, a post only
+// market only accepts limit orders which can rest in the book. The orders crossing the book
+// of a post only market are rejected while matching.
+func (ob *OrderBook) refuseOrder(order *Order) bool {
+	switch {
+	case !ob.TradingState.AcceptsOrders():
+	case ob.TradingState == types.TradingStatePostOnly && (order.Type != pkg.TypeLimit || order.IsImmediate() || order.IsStop()):
+	default:
+		return false
+	}
+
+	config.Logger.Debugf("[oceanbook.orderbook] order %d rejected, the market is %s", order.ID, ob.TradingState)
+
+	ob.PublishReject(order.Key())
+	ob.cancelOcoOrder(order)
+
+	return true
+}
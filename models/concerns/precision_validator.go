@@ -4,10 +4,22 @@ import (
 	"github.com/shopspring/decimal"
 )
 
+// PrecisionValidator checks the prices and the quantities of the orders against the precisions
+// and the steps of their market.
 type PrecisionValidator struct {
 }
 
+// LessThanOrEqTo returns true if the value has at most precision decimals.
 func (p PrecisionValidator) LessThanOrEqTo(value decimal.Decimal, precision int32) bool {
 	value_rounded := value.Round(precision)
 	return value.Equal(value_rounded)
 }
+
+// MultipleOf returns true if the value is a multiple of the step, any value is when the step isn't positive.
+func (p PrecisionValidator) MultipleOf(value decimal.Decimal, step decimal.Decimal) bool {
+	if !step.IsPositive() {
+		return true
+	}
+
+	return value.Mod(step).IsZero()
+}
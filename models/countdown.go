@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/zsmartex/finex/config"
+)
+
+const (
+	// COUNTDOWN_MIN_TIMEOUT and COUNTDOWN_MAX_TIMEOUT bound the timeout of an armed countdown, in seconds
+	COUNTDOWN_MIN_TIMEOUT int64 = 5
+	COUNTDOWN_MAX_TIMEOUT int64 = 3600
+	// COUNTDOWN_KEY is the sorted set of the members with an armed countdown scored by their deadline,
+	// in unix milliseconds
+	COUNTDOWN_KEY = "finex:countdowns"
+)
+
+// popExpiredCountdowns removes the countdowns whose deadline is before ARGV[1] and returns their
+// members, a countdown refreshed before the script runs isn't expired anymore and stays.
+var popExpiredCountdowns = redis.NewScript(`
+local members = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if #members > 0 then
+	redis.call("ZREM", KEYS[1], unpack(members))
+end
+return members
+`)
+
+// Countdown is the dead man's switch of a member, the resting orders of the member are cancelled
+// when it isn't refreshed before its deadline. A countdown without deadline is disarmed.
+type Countdown struct {
+	MemberID int64     `json:"member_id"`
+	Timeout  int64     `json:"timeout"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// ArmCountdown arms or refreshes the countdown of a member for timeout seconds from now,
+// a zero timeout disarms it.
+func ArmCountdown(member_id, timeout int64, now time.Time) (*Countdown, error) {
+	countdown := &Countdown{
+		MemberID: member_id,
+		Timeout:  timeout,
+	}
+
+	member := strconv.FormatInt(member_id, 10)
+
+	if timeout <= 0 {
+		if err := config.RedisCommands.ZRem(context.Background(), COUNTDOWN_KEY, member).Err(); err != nil {
+			return nil, err
+		}
+
+		return countdown, nil
+	}
+
+	countdown.Deadline = now.Add(time.Duration(timeout) * time.Second)
+
+	if err := config.RedisCommands.ZAdd(context.Background(), COUNTDOWN_KEY, &redis.Z{
+		Score:  float64(countdown.Deadline.UnixMilli()),
+		Member: member,
+	}).Err(); err != nil {
+		return nil, err
+	}
+
+	return countdown, nil
+}
+
+// PopExpiredCountdowns disarms the countdowns expired at now and returns their members,
+// each expired countdown is returned once.
+func PopExpiredCountdowns(now time.Time) ([]int64, error) {
+	members, err := popExpiredCountdowns.Run(context.Background(), config.RedisCommands, []string{COUNTDOWN_KEY}, now.UnixMilli()).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	member_ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		member_id, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			config.Logger.Errorf("invalid member %s in the countdowns: %v", member, err)
+			continue
+		}
+
+		member_ids = append(member_ids, member_id)
+	}
+
+	return member_ids, nil
+}
+
+// IsArmed returns true if the countdown has a deadline.
+func (c *Countdown) IsArmed() bool {
+	return !c.Deadline.IsZero()
+}
+
+// IsExpired returns true if the countdown is armed and its deadline passed.
+func (c *Countdown) IsExpired(now time.Time) bool {
+	return c.IsArmed() && !now.Before(c.Deadline)
+}
@@ -5,33 +5,135 @@ import (
 	"time"
 
 	"github.com/shopspring/decimal"
+	"github.com/zsmartex/finex/matching"
+	"github.com/zsmartex/finex/types"
 	"github.com/zsmartex/pkg"
 )
 
 type Market struct {
-	ID              int64           `json:"id" gorm:"primaryKey"`
-	Symbol          string          `json:"symbol"`
-	Type            string          `json:"type"`
-	BaseUnit        string          `json:"base_unit"`
-	QuoteUnit       string          `json:"quote_unit"`
-	AmountPrecision int             `json:"amount_precision"`
-	PricePrecision  int             `json:"price_precision"`
-	TotalPrecision  int             `json:"total_precision"`
-	MaxPrice        decimal.Decimal `json:"max_price"`
-	MinPrice        decimal.Decimal `json:"min_price"`
-	MinAmount       decimal.Decimal `json:"min_amount"`
-	State           string          `json:"state"`
-	EngineID        int64           `json:"engine_id"`
-	Position        int32           `json:"position"`
-	Data            string          `json:"data"`
-	CreatedAt       time.Time       `json:"created_at"`
-	UpdatedAt       time.Time       `json:"updated_at"`
+	ID                    int64                     `json:"id" gorm:"primaryKey"`
+	Symbol                string                    `json:"symbol"`
+	Type                  string                    `json:"type"`
+	BaseUnit              string                    `json:"base_unit"`
+	QuoteUnit             string                    `json:"quote_unit"`
+	AmountPrecision       int                       `json:"amount_precision"`
+	PricePrecision        int                       `json:"price_precision"`
+	TotalPrecision        int                       `json:"total_precision"`
+	MaxPrice              decimal.Decimal           `json:"max_price"`
+	MinPrice              decimal.Decimal           `json:"min_price"`
+	MinAmount             decimal.Decimal           `json:"min_amount"`
+	MaxAmount             decimal.Decimal           `json:"max_amount" gorm:"default:0.0"`
+	TickSize              decimal.Decimal           `json:"tick_size" gorm:"default:0.0"`
+	LotSize               decimal.Decimal           `json:"lot_size" gorm:"default:0.0"`
+	MinNotional           decimal.Decimal           `json:"min_notional" gorm:"default:0.0"`
+	MaxNotional           decimal.Decimal           `json:"max_notional" gorm:"default:0.0"`
+	State                 string                    `json:"state"`
+	TradingState          types.TradingState        `json:"trading_state" gorm:"default:trading"`
+	SelfTradePrevention   types.SelfTradePrevention `json:"self_trade_prevention" gorm:"default:none"`
+	MatchingAlgorithm     types.MatchingAlgorithm   `json:"matching_algorithm" gorm:"default:fifo"`
+	PriceBand             decimal.Decimal           `json:"price_band" gorm:"default:0.0"`
+	CircuitBreakerPercent decimal.Decimal           `json:"circuit_breaker_percent" gorm:"default:0.0"`
+	CircuitBreakerWindow  int64                     `json:"circuit_breaker_window" gorm:"default:0"`
+	CircuitBreakerHalt    int64                     `json:"circuit_breaker_halt" gorm:"default:0"`
+	EngineID              int64                     `json:"engine_id"`
+	Position              int32                     `json:"position"`
+	Data                  string                    `json:"data"`
+	CreatedAt             time.Time                 `json:"created_at"`
+	UpdatedAt             time.Time                 `json:"updated_at"`
 }
 
 func (m *Market) GetSymbol() pkg.Symbol {
 	return pkg.Symbol{BaseCurrency: strings.ToUpper(m.BaseUnit), QuoteCurrency: strings.ToUpper(m.QuoteUnit)}
 }
 
+// MatchingConfig returns the settings the matching engine enforces on this market
+func (m *Market) MatchingConfig() matching.MarketConfig {
+	market_config := matching.DefaultMarketConfig()
+
+	if len(m.SelfTradePrevention) > 0 {
+		market_config.SelfTradePrevention = m.SelfTradePrevention
+	}
+
+	if len(m.MatchingAlgorithm) > 0 {
+		market_config.MatchingAlgorithm = m.MatchingAlgorithm
+	}
+
+	if len(m.TradingState) > 0 {
+		market_config.TradingState = m.TradingState
+	}
+
+	market_config.PricePrecision = int32(m.PricePrecision)
+	market_config.AmountPrecision = int32(m.AmountPrecision)
+	market_config.TradingRules = m.TradingRules()
+	market_config.PriceBand = m.PriceBand
+	market_config.CircuitBreakerPercent = m.CircuitBreakerPercent
+	market_config.CircuitBreakerWindow = time.Duration(m.CircuitBreakerWindow) * time.Second
+	market_config.CircuitBreakerHalt = time.Duration(m.CircuitBreakerHalt) * time.Second
+
+	return market_config
+}
+
+// TradingRules returns the limits of the orders of this market, the zero values disable their rule.
+func (m *Market) TradingRules() matching.TradingRules {
+	return matching.TradingRules{
+		TickSize:    m.TickSize,
+		LotSize:     m.LotSize,
+		MinPrice:    m.MinPrice,
+		MaxPrice:    m.MaxPrice,
+		MinAmount:   m.MinAmount,
+		MaxAmount:   m.MaxAmount,
+		MinNotional: m.MinNotional,
+		MaxNotional: m.MaxNotional,
+	}
+}
+
+// PriceError returns the error code of a price of an order breaking the rules of this market,
+// field is the name of the price in the code. It's empty if the price is valid.
+func (m Market) PriceError(field string, price decimal.Decimal) string {
+	switch {
+	case !precision_validator.LessThanOrEqTo(price, int32(m.PricePrecision)):
+		return "market.order.invalid_" + field + "_precision"
+	case !precision_validator.MultipleOf(price, m.TickSize):
+		return "market.order.invalid_" + field + "_tick_size"
+	case m.MinPrice.IsPositive() && price.LessThan(m.MinPrice):
+		return "market.order." + field + "_too_low"
+	case m.MaxPrice.IsPositive() && price.GreaterThan(m.MaxPrice):
+		return "market.order." + field + "_too_high"
+	default:
+		return ""
+	}
+}
+
+// AmountError returns the error code of a quantity of an order breaking the rules of this market,
+// field is the name of the quantity in the code. It's empty if the quantity is valid.
+func (m Market) AmountError(field string, amount decimal.Decimal) string {
+	switch {
+	case !precision_validator.LessThanOrEqTo(amount, int32(m.AmountPrecision)):
+		return "market.order.invalid_" + field + "_precision"
+	case !precision_validator.MultipleOf(amount, m.LotSize):
+		return "market.order.invalid_" + field + "_lot_size"
+	case amount.LessThan(m.MinAmount):
+		return "market.order." + field + "_too_low"
+	case m.MaxAmount.IsPositive() && amount.GreaterThan(m.MaxAmount):
+		return "market.order." + field + "_too_high"
+	default:
+		return ""
+	}
+}
+
+// NotionalError returns the error code of the total of an order out of the totals of this market,
+// it's empty if the total is valid.
+func (m Market) NotionalError(notional decimal.Decimal) string {
+	switch {
+	case m.MinNotional.IsPositive() && notional.LessThan(m.MinNotional):
+		return "market.order.notional_too_low"
+	case m.MaxNotional.IsPositive() && notional.GreaterThan(m.MaxNotional):
+		return "market.order.notional_too_high"
+	default:
+		return ""
+	}
+}
+
 func (m Market) round_price(val decimal.Decimal) decimal.Decimal {
 	value_rounded := val.Round(int32(m.PricePrecision))
 
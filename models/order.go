@@ -15,6 +15,7 @@ import (
 
 	"github.com/zsmartex/finex/config"
 	"github.com/zsmartex/finex/controllers/entities"
+	"github.com/zsmartex/finex/matching"
 	"github.com/zsmartex/finex/models/concerns"
 	"github.com/zsmartex/finex/types"
 	"github.com/zsmartex/pkg"
@@ -39,29 +40,36 @@ const (
 )
 
 type Order struct {
-	ID            int64               `json:"id" gorm:"primaryKey"`
-	UUID          uuid.UUID           `json:"uuid" gorm:"default:gen_random_uuid()"`
-	MemberID      int64               `json:"member_id" validate:"required"`
-	Ask           string              `json:"ask" validate:"required"`
-	Bid           string              `json:"bid" validate:"required"`
-	RemoteId      sql.NullString      `json:"remote_id"`
-	Price         decimal.NullDecimal `json:"price" validate:"PriceVaildator"`
-	StopPrice     decimal.NullDecimal `json:"stop_price" validate:"StopPriceVaildator"`
-	Volume        decimal.Decimal     `json:"volume" validate:"required"`
-	OriginVolume  decimal.Decimal     `json:"origin_volume" validate:"OriginVolumeVaildator"`
-	MakerFee      decimal.Decimal     `json:"maker_fee" gorm:"default:0.0"`
-	TakerFee      decimal.Decimal     `json:"taker_fee" gorm:"default:0.0"`
-	MarketID      string              `json:"market_id" validate:"required"`
-	MarketType    types.AccountType   `json:"market_type" gorm:"default:spot" validate:"MarketTypeVaildator"`
-	State         OrderState          `json:"state"`
-	Type          OrderSide           `json:"type" validate:"required"`
-	OrdType       types.OrderType     `json:"ord_type" validate:"OrdTypeVaildator"`
-	Locked        decimal.Decimal     `json:"locked" gorm:"default:0.0"`
-	OriginLocked  decimal.Decimal     `json:"origin_locked" gorm:"default:0.0"`
-	FundsReceived decimal.Decimal     `json:"funds_received" gorm:"default:0.0"`
-	TradesCount   int64               `json:"trades_count" gorm:"default:0"`
-	CreatedAt     time.Time           `json:"created_at"`
-	UpdatedAt     time.Time           `json:"updated_at"`
+	ID              int64               `json:"id" gorm:"primaryKey"`
+	UUID            uuid.UUID           `json:"uuid" gorm:"default:gen_random_uuid()"`
+	MemberID        int64               `json:"member_id" validate:"required"`
+	Ask             string              `json:"ask" validate:"required"`
+	Bid             string              `json:"bid" validate:"required"`
+	RemoteId        sql.NullString      `json:"remote_id"`
+	Price           decimal.NullDecimal `json:"price" validate:"PriceVaildator"`
+	StopPrice       decimal.NullDecimal `json:"stop_price" validate:"StopPriceVaildator"`
+	Volume          decimal.Decimal     `json:"volume" validate:"required"`
+	OriginVolume    decimal.Decimal     `json:"origin_volume" validate:"OriginVolumeVaildator"`
+	DisplayVolume   decimal.NullDecimal `json:"display_volume" validate:"DisplayVolumeVaildator"`
+	TrailingOffset  decimal.NullDecimal `json:"trailing_offset" validate:"TrailingOffsetVaildator"`
+	TrailingPercent decimal.NullDecimal `json:"trailing_percent" validate:"TrailingPercentVaildator"`
+	OcoID           sql.NullInt64       `json:"oco_id"`
+	QuoteVolume     decimal.NullDecimal `json:"quote_volume" validate:"QuoteVolumeVaildator"`
+	MakerFee        decimal.Decimal     `json:"maker_fee" gorm:"default:0.0"`
+	TakerFee        decimal.Decimal     `json:"taker_fee" gorm:"default:0.0"`
+	MarketID        string              `json:"market_id" validate:"required"`
+	MarketType      types.AccountType   `json:"market_type" gorm:"default:spot" validate:"MarketTypeVaildator"`
+	State           OrderState          `json:"state"`
+	Type            OrderSide           `json:"type" validate:"required"`
+	OrdType         types.OrderType     `json:"ord_type" validate:"OrdTypeVaildator"`
+	TimeInForce     types.TimeInForce   `json:"time_in_force" gorm:"default:gtc" validate:"TimeInForceVaildator"`
+	Locked          decimal.Decimal     `json:"locked" gorm:"default:0.0"`
+	OriginLocked    decimal.Decimal     `json:"origin_locked" gorm:"default:0.0"`
+	FundsReceived   decimal.Decimal     `json:"funds_received" gorm:"default:0.0"`
+	TradesCount     int64               `json:"trades_count" gorm:"default:0"`
+	TriggeredAt     sql.NullTime        `json:"triggered_at"`
+	CreatedAt       time.Time           `json:"created_at"`
+	UpdatedAt       time.Time           `json:"updated_at"`
 }
 
 func (o Order) Message() map[string]string {
@@ -73,76 +81,142 @@ func (o Order) Message() map[string]string {
 }
 
 func (o Order) PriceVaildator(Price decimal.NullDecimal) bool {
-	if o.OrdType == types.TypeMarket {
+	if o.OrdType.IsMarket() {
 		return true // skip
 	}
 
-	dPrice := Price.Decimal
+	return Price.Decimal.IsPositive() && o.Market().PriceError("price", Price.Decimal) == ""
+}
 
-	market := o.Market()
-	PricePrecision := int32(market.PricePrecision)
+func (o Order) StopPriceVaildator(StopPrice decimal.NullDecimal) bool {
+	if o.OrdType == types.TypeMarket || o.OrdType == types.TypeTrailingStop {
+		return true // skip
+	}
 
-	if dPrice.LessThanOrEqual(decimal.Zero) {
-		return false
+	return StopPrice.Decimal.IsPositive() && o.Market().PriceError("stop_price", StopPrice.Decimal) == ""
+}
+
+func (o Order) OriginVolumeVaildator(OriginVolume decimal.Decimal) bool {
+	// the volume of an order placed by quote volume grows with its trades
+	if o.QuoteVolume.Valid {
+		return true
 	}
 
-	if !precision_validator.LessThanOrEqTo(dPrice, PricePrecision) {
+	return o.Market().AmountError("quantity", OriginVolume) == ""
+}
+
+func (o Order) QuoteVolumeVaildator(QuoteVolume decimal.NullDecimal) bool {
+	if !QuoteVolume.Valid {
+		return true
+	}
+
+	if o.OrdType != types.TypeMarket || o.Type != SideBuy || !QuoteVolume.Decimal.IsPositive() {
 		return false
 	}
 
-	if dPrice.GreaterThan(market.MaxPrice) && market.MaxPrice.IsPositive() || dPrice.LessThan(market.MinPrice) && market.MinPrice.IsPositive() {
+	market := o.Market()
+	TotalPrecision := int32(market.TotalPrecision)
+
+	return precision_validator.LessThanOrEqTo(QuoteVolume.Decimal, TotalPrecision)
+}
+
+func (o Order) DisplayVolumeVaildator(DisplayVolume decimal.NullDecimal) bool {
+	if !DisplayVolume.Valid {
+		return true
+	}
+
+	if !o.OrdType.IsLimit() || !DisplayVolume.Decimal.IsPositive() || DisplayVolume.Decimal.GreaterThanOrEqual(o.OriginVolume) {
 		return false
 	}
 
-	return true
+	return o.Market().AmountError("display_quantity", DisplayVolume.Decimal) == ""
 }
 
-func (o Order) StopPriceVaildator(StopPrice decimal.NullDecimal) bool {
-	if o.OrdType == types.TypeMarket {
-		return true // skip
+// TradingRulesErrors returns the error codes of the trading rules of the market the order breaks,
+// notional is its total which is zero when it's only known once the order traded.
+func (o *Order) TradingRulesErrors(market Market, notional decimal.Decimal) []string {
+	codes := make([]string, 0)
+	check := func(code string) {
+		if len(code) > 0 {
+			codes = append(codes, code)
+		}
 	}
 
-	dStopPrice := StopPrice.Decimal
+	if o.Price.Valid {
+		check(market.PriceError("price", o.Price.Decimal))
+	}
 
-	market := o.Market()
-	PricePrecision := int32(market.PricePrecision)
+	if o.StopPrice.Valid {
+		check(market.PriceError("stop_price", o.StopPrice.Decimal))
+	}
 
-	if dStopPrice.LessThanOrEqual(decimal.Zero) {
-		return false
+	// the quantity of an order placed by quote volume is what its trades buy
+	if !o.QuoteVolume.Valid {
+		check(market.AmountError("quantity", o.OriginVolume))
 	}
 
-	if !precision_validator.LessThanOrEqTo(dStopPrice, PricePrecision) {
-		return false
+	if o.DisplayVolume.Valid {
+		check(market.AmountError("display_quantity", o.DisplayVolume.Decimal))
 	}
 
-	if dStopPrice.GreaterThan(market.MaxPrice) && market.MaxPrice.IsPositive() || dStopPrice.LessThan(market.MinPrice) && market.MinPrice.IsPositive() {
-		return false
+	if notional.IsPositive() {
+		check(market.NotionalError(notional))
 	}
 
-	return true
+	return codes
 }
 
-func (o Order) OriginVolumeVaildator(OriginVolume decimal.Decimal) bool {
-	market := o.Market()
-	AmountPrecision := int32(market.AmountPrecision)
-
-	if !precision_validator.LessThanOrEqTo(OriginVolume, AmountPrecision) {
+func (o Order) OrdTypeVaildator(ord_type types.OrderType) bool {
+	trailing := o.TrailingOffset.Valid || o.TrailingPercent.Valid
+
+	switch ord_type {
+	case types.TypeMarket:
+		return !o.Price.Valid && !o.StopPrice.Valid && !trailing
+	case types.TypeLimit:
+		return o.Price.Valid && !o.StopPrice.Valid && !trailing
+	case types.TypeStopLimit:
+		return o.Price.Valid && o.StopPrice.Valid && !trailing
+	case types.TypeStopMarket:
+		return !o.Price.Valid && o.StopPrice.Valid && !trailing
+	case types.TypeTrailingStop:
+		return !o.Price.Valid && !o.StopPrice.Valid && o.TrailingOffset.Valid != o.TrailingPercent.Valid
+	default:
 		return false
 	}
+}
+
+func (o Order) TrailingOffsetVaildator(TrailingOffset decimal.NullDecimal) bool {
+	if !TrailingOffset.Valid {
+		return true
+	}
 
-	if OriginVolume.LessThan(market.MinAmount) {
+	if o.OrdType != types.TypeTrailingStop || !TrailingOffset.Decimal.IsPositive() {
 		return false
 	}
 
-	return true
+	market := o.Market()
+	PricePrecision := int32(market.PricePrecision)
+
+	return precision_validator.LessThanOrEqTo(TrailingOffset.Decimal, PricePrecision)
 }
 
-func (o Order) OrdTypeVaildator(ord_type types.OrderType) bool {
-	if o.OrdType == types.TypeMarket {
-		return !o.Price.Valid && !o.StopPrice.Valid
+func (o Order) TrailingPercentVaildator(TrailingPercent decimal.NullDecimal) bool {
+	if !TrailingPercent.Valid {
+		return true
 	}
 
-	return true
+	return o.OrdType == types.TypeTrailingStop && TrailingPercent.Decimal.IsPositive() && TrailingPercent.Decimal.LessThan(decimal.NewFromInt(100))
+}
+
+func (o Order) TimeInForceVaildator(time_in_force types.TimeInForce) bool {
+	switch time_in_force {
+	case types.TimeInForceGTC, types.TimeInForceIOC, types.TimeInForceFOK:
+		return true
+	case types.TimeInForcePostOnly:
+		return o.OrdType.IsLimit()
+	default:
+		return len(time_in_force) == 0
+	}
 }
 
 func (o Order) MarketTypeVaildator(market_type types.AccountType) bool {
@@ -199,9 +273,12 @@ func GetDepth(side OrderSide, market string) [][]decimal.Decimal {
 	return depth
 }
 
+// SubmitOrder lock the funds of a pending order and send it to the matching engine,
+// both orders of an OCO pair are submitted together and their funds are locked once.
 func SubmitOrder(id int64) error {
 	var account *Account
 	var order *Order
+	var oco_order *Order
 
 	err := config.DataBase.Transaction(func(tx *gorm.DB) error {
 		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "orders"}}).Where("id = ?", id).First(&order)
@@ -213,18 +290,38 @@ func SubmitOrder(id int64) error {
 			return nil
 		}
 
+		locked := order.Locked
+		if order.OcoID.Valid {
+			result := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "orders"}}).Where("id = ?", order.OcoID.Int64).First(&oco_order)
+			if result.Error != nil {
+				return fmt.Errorf("can't find oco order by id : %d", order.OcoID.Int64)
+			}
+
+			if oco_order.State != StatePending {
+				return fmt.Errorf("oco order %d isn't pending", oco_order.ID)
+			}
+
+			locked = decimal.Max(order.Locked, oco_order.Locked)
+		}
+
 		account_tx := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "accounts"}})
 		account_tx.Where("member_id = ? AND currency_id = ?", order.MemberID, order.Currency().ID).FirstOrCreate(&account)
-		if err := account.LockFunds(account_tx, order.Locked); err != nil {
+		if err := account.LockFunds(account_tx, locked); err != nil {
 			return err
 		}
 
-		order.RecordSubmitOperations()
+		order.RecordLockOperations(locked)
 
 		order.State = StateWait
 
 		tx.Save(&order)
 
+		if oco_order != nil {
+			oco_order.State = StateWait
+
+			tx.Save(&oco_order)
+		}
+
 		return nil
 	})
 
@@ -237,9 +334,20 @@ func SubmitOrder(id int64) error {
 
 		order.State = StateReject
 		config.DataBase.Save(&order)
+
+		if oco_order := order.OcoOrder(); oco_order != nil && oco_order.State == StatePending {
+			oco_order.State = StateReject
+			config.DataBase.Save(&oco_order)
+		}
 	}
 
-	if err == nil {
+	if err == nil && oco_order != nil {
+		config.KafkaProducer.Produce("matching", map[string]interface{}{
+			"action":    pkg.ActionSubmit,
+			"order":     order.ToMatchingAttributes(),
+			"oco_order": oco_order.ToMatchingAttributes(),
+		})
+	} else if err == nil {
 		config.KafkaProducer.Produce("matching", map[string]interface{}{
 			"action": pkg.ActionSubmit,
 			"order":  order.ToMatchingAttributes(),
@@ -250,6 +358,15 @@ func SubmitOrder(id int64) error {
 }
 
 func CancelOrder(id int64) error {
+	return closeOrder(id, StateCancel)
+}
+
+// RejectOrder release the funds of an order refused by the matching engine
+func RejectOrder(id int64) error {
+	return closeOrder(id, StateReject)
+}
+
+func closeOrder(id int64, state OrderState) error {
 	var account *Account
 	var order *Order
 
@@ -266,13 +383,87 @@ func CancelOrder(id int64) error {
 
 		account_tx := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "accounts"}})
 		account_tx.Where("member_id = ? AND currency_id = ?", order.MemberID, order.Currency().ID).FirstOrCreate(&account)
-		if err := account.UnlockFunds(tx, order.Locked); err != nil {
+
+		if err := order.Close(tx, account, state); err != nil {
 			return err
 		}
 
-		order.RecordCancelOperations()
+		tx.Save(order)
+
+		return nil
+	})
+
+	return err
+}
+
+// Close gives back the funds still locked for the order and moves it to the closed state, the
+// account holding its locked funds must be locked in tx. The order isn't saved.
+func (o *Order) Close(tx *gorm.DB, account *Account, state OrderState) error {
+	unlocked := o.ReleasableFunds(tx)
+	if err := account.UnlockFunds(tx, unlocked); err != nil {
+		return err
+	}
+
+	o.RecordUnlockOperations(unlocked)
+	o.State = state
+
+	return nil
+}
+
+// DecrementOrder reduce the remaining volume of an order and release the funds locked for it
+func DecrementOrder(id int64, quantity decimal.Decimal) error {
+	var account *Account
+	var order *Order
+
+	err := config.DataBase.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "orders"}}).Where("id = ?", id).First(&order)
+
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("can't find order by id : %d", order.ID)
+		}
+
+		if order.State != StateWait || !quantity.IsPositive() {
+			return nil
+		}
+
+		quantity = decimal.Min(quantity, order.Volume)
+
+		account_tx := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "accounts"}})
+		account_tx.Where("member_id = ? AND currency_id = ?", order.MemberID, order.Currency().ID).FirstOrCreate(&account)
+
+		var unlocked decimal.Decimal
+		if quantity.Equal(order.Volume) {
+			unlocked = order.ReleasableFunds(tx)
+		} else if order.OcoID.Valid {
+			// the funds of an OCO pair are kept until the pair is closed
+			unlocked = decimal.Zero
+		} else if order.Type == SideSell {
+			unlocked = quantity
+		} else if order.OrdType.IsLimit() {
+			unlocked = order.Price.Decimal.Mul(quantity)
+		} else {
+			// the budget of a buy market order is what it locked, the engine keeps spending
+			// it so its funds are only given back when it is closed
+			unlocked = decimal.Zero
+		}
+
+		if unlocked.IsPositive() {
+			if err := account.UnlockFunds(tx, unlocked); err != nil {
+				return err
+			}
+
+			order.RecordUnlockOperations(unlocked)
+		}
+
+		order.Volume = order.Volume.Sub(quantity)
+		order.OriginVolume = order.OriginVolume.Sub(quantity)
+		order.Locked = order.Locked.Sub(unlocked)
+		order.OriginLocked = order.OriginLocked.Sub(unlocked)
+
+		if order.Volume.IsZero() {
+			order.State = StateCancel
+		}
 
-		order.State = StateCancel
 		tx.Save(order)
 
 		return nil
@@ -281,11 +472,159 @@ func CancelOrder(id int64) error {
 	return err
 }
 
+// TriggerOrder records the time a stop order reached its trigger price and entered the book.
+func TriggerOrder(id int64) error {
+	return config.DataBase.Model(&Order{}).Where("id = ? AND triggered_at IS NULL", id).Update("triggered_at", time.Now()).Error
+}
+
+// IsTriggerWait returns true if the order is a stop order waiting for its trigger price.
+func (o *Order) IsTriggerWait() bool {
+	return o.State == StateWait && o.OrdType.IsStop() && !o.TriggeredAt.Valid
+}
+
+// AmendOrder locks the funds an open limit order needs more for its new price and volume and sends
+// the amended order to the matching engine. The order keeps its price and volume until the engine
+// amends it, see ApplyAmend.
+func AmendOrder(id int64, price, volume decimal.Decimal) error {
+	var account *Account
+	var order *Order
+	var key *pkg.OrderKey
+	var amended Order
+
+	err := config.DataBase.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "orders"}}).Where("id = ?", id).First(&order)
+
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("can't find order by id : %d", order.ID)
+		}
+
+		if !order.IsAmendable() {
+			return nil
+		}
+
+		executed := order.OriginVolume.Sub(order.Volume)
+		if volume.LessThanOrEqual(executed) {
+			return fmt.Errorf("order %d already executed %s", order.ID, executed)
+		}
+
+		key = order.ToMatchingAttributes().Key()
+
+		// the funds released by the amend are unlocked once the engine amended the order
+		if delta := order.AmendedLocked(price, volume).Sub(order.Locked); delta.IsPositive() {
+			account_tx := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "accounts"}})
+			account_tx.Where("member_id = ? AND currency_id = ?", order.MemberID, order.Currency().ID).FirstOrCreate(&account)
+
+			if err := account.LockFunds(account_tx, delta); err != nil {
+				return err
+			}
+
+			order.RecordLockOperations(delta)
+			order.OriginLocked = order.OriginLocked.Add(delta)
+			order.Locked = order.Locked.Add(delta)
+
+			tx.Save(order)
+		}
+
+		amended = *order
+		amended.Price = decimal.NewNullDecimal(price)
+		amended.OriginVolume = volume
+		amended.Volume = volume.Sub(executed)
+
+		return nil
+	})
+
+	if err == nil && key != nil {
+		config.KafkaProducer.Produce("matching", map[string]interface{}{
+			"action": matching.ActionAmend,
+			"key":    key,
+			"order":  amended.ToMatchingAttributes(),
+		})
+	}
+
+	return err
+}
+
+// ApplyAmend sets the price and the volume the matching engine amended an order with, it is
+// called by trade_executor in order with the trades of the order. The funds locked for the
+// order are adjusted to its remaining volume at the new price.
+func ApplyAmend(id int64, price, volume decimal.Decimal) error {
+	return config.DataBase.Transaction(func(tx *gorm.DB) error {
+		var account *Account
+		var order *Order
+
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "orders"}}).Where("id = ?", id).First(&order)
+
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("can't find order by id : %d", id)
+		}
+
+		if order.State != StateWait {
+			return nil
+		}
+
+		executed := order.OriginVolume.Sub(order.Volume)
+		if volume.LessThanOrEqual(executed) {
+			return fmt.Errorf("order %d already executed %s", order.ID, executed)
+		}
+
+		account_tx := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "accounts"}})
+		account_tx.Where("member_id = ? AND currency_id = ?", order.MemberID, order.Currency().ID).FirstOrCreate(&account)
+
+		locked := order.AmendedLocked(price, volume)
+		delta := locked.Sub(order.Locked)
+		if delta.IsPositive() {
+			if err := account.LockFunds(account_tx, delta); err != nil {
+				return err
+			}
+
+			order.RecordLockOperations(delta)
+		} else if delta.IsNegative() {
+			if err := account.UnlockFunds(tx, delta.Neg()); err != nil {
+				return err
+			}
+
+			order.RecordUnlockOperations(delta.Neg())
+		}
+
+		order.Price = decimal.NewNullDecimal(price)
+		order.OriginVolume = volume
+		order.Volume = volume.Sub(executed)
+		order.OriginLocked = order.OriginLocked.Add(delta)
+		order.Locked = locked
+
+		tx.Save(order)
+
+		return nil
+	})
+}
+
+// IsAmendable returns true if the price and the volume of the order can be changed,
+// only open limit orders in the book which are not part of an OCO pair can be.
+func (o *Order) IsAmendable() bool {
+	return o.State == StateWait && o.OrdType.IsLimit() && !o.IsTriggerWait() && !o.OcoID.Valid
+}
+
+// AmendedLocked returns the funds to lock for the remaining volume of the order once amended.
+func (o *Order) AmendedLocked(price, volume decimal.Decimal) decimal.Decimal {
+	remaining := volume.Sub(o.OriginVolume.Sub(o.Volume))
+
+	if o.Type == SideSell {
+		return remaining
+	}
+
+	return price.Mul(remaining)
+}
+
 // Submit order to matching engine
 func (o *Order) Submit() error {
 	member_balance := o.MemberBalance()
 
-	if member_balance.LessThan(o.Locked) {
+	locked := o.Locked
+	if oco_order := o.OcoOrder(); oco_order != nil {
+		locked = decimal.Max(locked, oco_order.Locked)
+	}
+
+	if member_balance.LessThan(locked) {
 		return errors.New("market.account.insufficient_balance")
 	}
 
@@ -316,8 +655,12 @@ func (o *Order) TriggerEvent() {
 }
 
 func (o *Order) RecordSubmitOperations() {
+	o.RecordLockOperations(o.Locked)
+}
+
+func (o *Order) RecordLockOperations(amount decimal.Decimal) {
 	LiabilityTranfer(
-		o.Locked,
+		amount,
 		o.Currency(),
 		Reference{
 			ID:   o.ID,
@@ -343,6 +686,20 @@ func (o Order) RecordCancelOperations() {
 	)
 }
 
+func (o Order) RecordUnlockOperations(amount decimal.Decimal) {
+	LiabilityTranfer(
+		amount,
+		o.Currency(),
+		Reference{
+			ID:   o.ID,
+			Type: string(o.Type),
+		},
+		"locked",
+		"main",
+		o.MemberID,
+	)
+}
+
 func (o *Order) AskCurrency() *Currency {
 	var currency *Currency
 
@@ -398,6 +755,10 @@ func (o *Order) ComputeLocked() (decimal.Decimal, error) {
 			return o.Volume, nil
 		}
 	} else if o.OrdType == types.TypeMarket {
+		if o.QuoteVolume.Valid {
+			return o.QuoteVolume.Decimal, nil
+		}
+
 		required_funds := decimal.Zero
 		expected_volume := o.Volume
 
@@ -450,6 +811,55 @@ func (o *Order) FundsUsed() decimal.Decimal {
 	return o.OriginLocked.Sub(o.Locked)
 }
 
+// IsQuoteOrder returns true if the order spends a quote volume instead of buying a volume.
+func (o *Order) IsQuoteOrder() bool {
+	return o.QuoteVolume.Valid
+}
+
+// IsFillable returns true if what is left of the order covers the trade, an order placed
+// by quote volume is checked against what is left of its budget.
+func (o *Order) IsFillable(quantity, total decimal.Decimal) bool {
+	if o.IsQuoteOrder() {
+		return o.Locked.GreaterThanOrEqual(total)
+	}
+
+	return o.Volume.GreaterThanOrEqual(quantity)
+}
+
+// OcoOrder returns the other order of the OCO pair of the order, if any.
+func (o *Order) OcoOrder() *Order {
+	if !o.OcoID.Valid {
+		return nil
+	}
+
+	var order *Order
+	if result := config.DataBase.Where("id = ?", o.OcoID.Int64).First(&order); result.Error != nil {
+		return nil
+	}
+
+	return order
+}
+
+// ReleasableFunds returns the locked funds to give back when the order is closed. Both orders of an
+// OCO pair share the funds locked for the largest of them, what was not used by the pair is given back
+// with the last one closed. The account of the order must be locked in tx.
+func (o *Order) ReleasableFunds(tx *gorm.DB) decimal.Decimal {
+	if !o.OcoID.Valid {
+		return o.Locked
+	}
+
+	var oco_order *Order
+	if result := tx.Where("id = ?", o.OcoID.Int64).First(&oco_order); result.Error != nil {
+		return o.Locked
+	}
+
+	if oco_order.State == StatePending || oco_order.State == StateWait {
+		return decimal.Zero
+	}
+
+	return decimal.Max(o.OriginLocked, oco_order.OriginLocked).Sub(o.FundsUsed()).Sub(oco_order.FundsUsed())
+}
+
 func (o *Order) AvgPrice() decimal.Decimal {
 	if o.Type == SideSell && o.FundsUsed().IsZero() || o.Type == SideBuy && o.FundsReceived.IsZero() {
 		return decimal.Zero
@@ -486,6 +896,9 @@ func (o *Order) ToJSON() entities.OrderEntity {
 		StateString = "pending"
 	case StateWait:
 		StateString = "wait"
+		if o.IsTriggerWait() {
+			StateString = "trigger_wait"
+		}
 	case StateDone:
 		StateString = "done"
 	case StateCancel:
@@ -501,16 +914,27 @@ func (o *Order) ToJSON() entities.OrderEntity {
 		SideString = "sell"
 	}
 
+	var oco_uuid *uuid.UUID
+	if oco_order := o.OcoOrder(); oco_order != nil {
+		oco_uuid = &oco_order.UUID
+	}
+
 	return entities.OrderEntity{
 		UUID:            o.UUID,
 		Market:          o.MarketID,
 		Side:            SideString,
 		OrdType:         o.OrdType,
+		TimeInForce:     o.TimeInForce,
 		Price:           o.Price,
 		StopPrice:       o.StopPrice,
 		AvgPrice:        o.AvgPrice(),
 		State:           StateString,
 		OriginVolume:    o.OriginVolume,
+		DisplayVolume:   o.DisplayVolume,
+		TrailingOffset:  o.TrailingOffset,
+		TrailingPercent: o.TrailingPercent,
+		OcoUUID:         oco_uuid,
+		QuoteVolume:     o.QuoteVolume,
 		RemainingVolume: o.Volume,
 		ExecutedVolume:  o.OriginVolume.Sub(o.Volume),
 		TradesCount:     o.TradesCount,
@@ -524,7 +948,12 @@ func FloatToString(input_num float64) string {
 	return strconv.FormatFloat(input_num, 'f', 6, 64)
 }
 
-func (o *Order) ToMatchingAttributes() *pkg.Order {
+func (o *Order) ToMatchingAttributes() *matching.Order {
+	return o.matchingAttributes(o.Market().GetSymbol())
+}
+
+// matchingAttributes returns the order as the matching engine of the symbol receives it.
+func (o *Order) matchingAttributes(symbol pkg.Symbol) *matching.Order {
 	var side pkg.OrderSide
 	if o.Type == SideBuy {
 		side = pkg.SideBuy
@@ -533,27 +962,54 @@ func (o *Order) ToMatchingAttributes() *pkg.Order {
 	}
 
 	var orderType pkg.OrderType
-	if o.OrdType == types.TypeLimit {
+	if o.OrdType.IsLimit() {
 		orderType = pkg.TypeLimit
-	} else if o.OrdType == types.TypeMarket {
+	} else if o.OrdType.IsMarket() {
 		orderType = pkg.TypeMarket
 	}
 
-	market := o.Market()
+	order := &matching.Order{
+		Order: pkg.Order{
+			ID:             o.ID,
+			UUID:           o.UUID,
+			Symbol:         symbol,
+			MemberID:       o.MemberID,
+			Side:           side,
+			Type:           orderType,
+			Price:          o.Price.Decimal,
+			StopPrice:      o.StopPrice.Decimal,
+			Quantity:       o.OriginVolume,
+			FilledQuantity: o.OriginVolume.Sub(o.Volume),
+			Cancelled:      o.State == StateCancel || o.State == StateDone,
+			Fake:           false,
+			CreatedAt:      o.CreatedAt,
+		},
+		TimeInForce:     o.TimeInForce,
+		DisplayQuantity: o.DisplayVolume.Decimal,
+		TrailingOffset:  o.TrailingOffset.Decimal,
+		TrailingPercent: o.TrailingPercent.Decimal,
+		OcoID:           o.OcoID.Int64,
+	}
+
+	// the trades of a resubmitted order placed by quote volume already spent a part of the budget
+	if o.QuoteVolume.Valid {
+		order.QuoteQuantity = o.QuoteVolume.Decimal
+		order.FilledQuoteQuantity = decimal.Max(o.QuoteVolume.Decimal.Sub(o.Locked), decimal.Zero)
+	}
 
-	return &pkg.Order{
-		ID:             o.ID,
-		UUID:           o.UUID,
-		Symbol:         market.GetSymbol(),
-		MemberID:       o.MemberID,
-		Side:           side,
-		Type:           orderType,
-		Price:          o.Price.Decimal,
-		StopPrice:      o.StopPrice.Decimal,
-		Quantity:       o.OriginVolume,
-		FilledQuantity: o.OriginVolume.Sub(o.Volume),
-		Cancelled:      o.State == StateCancel || o.State == StateDone,
-		Fake:           false,
-		CreatedAt:      o.CreatedAt,
+	// a buy market order placed by quantity can't spend more than it locked, a stop market order
+	// locked its funds at its trigger price and could be triggered higher
+	if !o.QuoteVolume.Valid && o.Type == SideBuy && orderType == pkg.TypeMarket {
+		order.Budget = o.OriginLocked
+		order.FilledBudget = decimal.Max(o.FundsUsed(), decimal.Zero)
 	}
+
+	// a stop order already triggered is loaded as the order it became, it doesn't wait again
+	if o.TriggeredAt.Valid {
+		order.StopPrice = decimal.Zero
+		order.TrailingOffset = decimal.Zero
+		order.TrailingPercent = decimal.Zero
+	}
+
+	return order
 }
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
+	"github.com/zsmartex/finex/types"
+	"github.com/zsmartex/pkg"
+)
+
+// engineRecorder is the producer of the order book under test, it keeps the events of the engine.
+type engineRecorder struct {
+	trades  []*matching.Trade
+	actions map[int64][]pkg.PayloadAction
+}
+
+func (r *engineRecorder) Produce(topic string, payload interface{}) error {
+	switch topic {
+	case "trade_executor":
+		if trade, ok := payload.(*matching.Trade); ok {
+			r.trades = append(r.trades, trade)
+		}
+	case "order_processor":
+		message := payload.(map[string]interface{})
+		id := message["id"].(int64)
+		r.actions[id] = append(r.actions[id], message["action"].(pkg.PayloadAction))
+	}
+
+	return nil
+}
+
+// matchingMessage encodes the order as it is sent on the matching topic and decodes it as the engine does.
+func matchingMessage(t *testing.T, action pkg.PayloadAction, key *pkg.OrderKey, order *Order, symbol pkg.Symbol) *matching.MatchingPayloadMessage {
+	body, err := json.Marshal(map[string]interface{}{
+		"action": action,
+		"key":    key,
+		"order":  order.matchingAttributes(symbol),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message *matching.MatchingPayloadMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	return message
+}
+
+func newTestOrder(id int64, side OrderSide, ord_type types.OrderType, price, volume, locked string) *Order {
+	order := &Order{
+		ID:           id,
+		UUID:         uuid.New(),
+		MemberID:     id,
+		MarketID:     "btcusdt",
+		Type:         side,
+		OrdType:      ord_type,
+		TimeInForce:  types.TimeInForceGTC,
+		State:        StateWait,
+		Volume:       decimal.RequireFromString(volume),
+		OriginVolume: decimal.RequireFromString(volume),
+		Locked:       decimal.RequireFromString(locked),
+		OriginLocked: decimal.RequireFromString(locked),
+		CreatedAt:    time.Date(2022, 1, 1, 0, 0, int(id), 0, time.UTC),
+	}
+
+	if len(price) > 0 {
+		order.Price = decimal.NewNullDecimal(decimal.RequireFromString(price))
+	}
+
+	return order
+}
+
+// TestMatchingAttributes runs the orders of the database through the engine the way they are
+// loaded, submitted and amended, none of them must be refused.
+func TestMatchingAttributes(t *testing.T) {
+	if config.Logger == nil {
+		logger := logrus.New()
+		logger.SetLevel(logrus.WarnLevel)
+		config.Logger = logrus.NewEntry(logger)
+	}
+
+	market := &Market{
+		Symbol:          "btcusdt",
+		BaseUnit:        "btc",
+		QuoteUnit:       "usdt",
+		PricePrecision:  2,
+		AmountPrecision: 4,
+		TotalPrecision:  6,
+		MinAmount:       decimal.RequireFromString("0.0001"),
+		TradingState:    types.TradingStateTrading,
+	}
+	symbol := market.GetSymbol()
+
+	out := &engineRecorder{actions: make(map[int64][]pkg.PayloadAction)}
+	ob := matching.NewOfflineOrderBook(symbol, decimal.Zero, market.MatchingConfig(), out)
+
+	// a resting sell order partially executed before the engine restarted
+	resting := newTestOrder(1, SideSell, types.TypeLimit, "100", "1.5", "1.5")
+	resting.OriginVolume = decimal.RequireFromString("2")
+	ob.Add(matchingMessage(t, pkg.ActionSubmit, nil, resting, symbol).Order)
+
+	limit := newTestOrder(2, SideBuy, types.TypeLimit, "100", "0.5", "50")
+	ob.Submit(matchingMessage(t, pkg.ActionSubmit, nil, limit, symbol).Order)
+
+	market_order := newTestOrder(3, SideBuy, types.TypeMarket, "", "0.25", "25")
+	ob.Submit(matchingMessage(t, pkg.ActionSubmit, nil, market_order, symbol).Order)
+
+	// the volume of an order placed by quote volume grows with its trades
+	quote_order := newTestOrder(4, SideBuy, types.TypeMarket, "", "0", "20")
+	quote_order.QuoteVolume = decimal.NewNullDecimal(decimal.RequireFromString("20"))
+	ob.Submit(matchingMessage(t, pkg.ActionSubmit, nil, quote_order, symbol).Order)
+
+	if len(out.trades) != 3 {
+		t.Fatalf("%d trades, expected 3", len(out.trades))
+	}
+
+	for i, quantity := range []string{"0.5", "0.25", "0.2"} {
+		if trade := out.trades[i]; !trade.Quantity.Equal(decimal.RequireFromString(quantity)) || trade.TakerOrder.ID != int64(i+2) {
+			t.Fatalf("trade %d of %s for order %d, expected %s for order %d", i, trade.Quantity, trade.TakerOrder.ID, quantity, i+2)
+		}
+	}
+
+	// the resting order is amended to a new price, it keeps what it executed
+	key := resting.matchingAttributes(symbol).Key()
+	resting.Price = decimal.NewNullDecimal(decimal.RequireFromString("101"))
+	resting.Volume = decimal.RequireFromString("0.55")
+	ob.Amend(key, matchingMessage(t, matching.ActionAmend, key, resting, symbol).Order)
+
+	amended := ob.Depth.Get(resting.matchingAttributes(symbol).Key())
+	if amended == nil || !amended.Price.Equal(decimal.NewFromInt(101)) {
+		t.Fatalf("amended order %v isn't resting at 101", amended)
+	}
+
+	for id, actions := range out.actions {
+		t.Fatalf("order %d was sent %v", id, actions)
+	}
+}
@@ -23,6 +23,7 @@ func SetupRouter() *fiber.App {
 		api_v2_public.Get("/ieo/list", controllers.GetIEOList)
 		api_v2_public.Get("/ieo/:id", controllers.GetIEO)
 		api_v2_public.Get("/markets/:market/depth", controllers.GetDepth)
+		api_v2_public.Get("/markets/:market/depth/deltas", controllers.GetDepthDeltas)
 	}
 
 	api_v2_admin := app.Group("/api/v2/admin", middlewares.Authenticate, middlewares.AdminVaildator)
@@ -36,6 +37,8 @@ func SetupRouter() *fiber.App {
 		api_v2_admin.Post("/ieo/currencies", admin_controllers.AddIEOCurrencies)
 		api_v2_admin.Delete("/ieo/currencies", admin_controllers.RemoveIEOCurrencies)
 
+		api_v2_admin.Put("/markets/:market/trading_state", admin_controllers.UpdateMarketTradingState)
+
 		api_v2_admin.Post("/orders/:uuid/cancel", admin_controllers.CancelOrder)
 		api_v2_admin.Post("/orders/cancel", admin_controllers.CancelAllOrders)
 	}
@@ -43,10 +46,13 @@ func SetupRouter() *fiber.App {
 	api_v2_market := app.Group("/api/v2/market", middlewares.Authenticate)
 	{
 		api_v2_market.Post("/orders", market_controllers.CreateOrder)
+		api_v2_market.Post("/orders/oco", market_controllers.CreateOcoOrder)
 		api_v2_market.Get("/orders", market_controllers.GetOrders)
 		api_v2_market.Get("/orders/:uuid", market_controllers.GetOrderByUUID)
+		api_v2_market.Put("/orders/:uuid", market_controllers.AmendOrderByUUID)
 		api_v2_market.Post("/orders/:uuid/cancel", market_controllers.CancelOrderByUUID)
 		api_v2_market.Post("/orders/cancel", market_controllers.CancelAllOrders)
+		api_v2_market.Post("/countdown", market_controllers.SetCountdown)
 		api_v2_market.Get("/trades", market_controllers.GetTrades)
 	}
 
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/shopspring/decimal"
+	"github.com/zsmartex/pkg"
+	GrpcEngine "github.com/zsmartex/pkg/Grpc/engine"
+
+	"github.com/zsmartex/finex/matching"
+)
+
+// bookEngine returns the engine of the base_currency and quote_currency of a book request.
+func (s *EngineServer) bookEngine(fields map[string]*structpb.Value) (*matching.Engine, error) {
+	return s.readyEngine(pkg.Symbol{
+		BaseCurrency:  fields["base_currency"].GetStringValue(),
+		QuoteCurrency: fields["quote_currency"].GetStringValue(),
+	})
+}
+
+// FetchGroupedOrderBook returns the price levels of a market merged by multiples of the group of
+// the request, a decimal string, it returns the levels as they are when the group is empty.
+func (s *EngineServer) FetchGroupedOrderBook(ctx context.Context, req *structpb.Struct) (*GrpcEngine.FetchOrderBookResponse, error) {
+	fields := req.GetFields()
+
+	engine, err := s.bookEngine(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	group := decimal.Zero
+	if value := fields["group"].GetStringValue(); len(value) > 0 {
+		if group, err = decimal.NewFromString(value); err != nil {
+			return nil, matching.ErrInvalidPriceGroup
+		}
+	}
+
+	return engine.FetchOrderBook(int64(fields["limit"].GetNumberValue()), group)
+}
+
+// FetchL3OrderBook returns the L3 snapshot of a market, the request has its base_currency and
+// quote_currency and optionally the number of price levels of each side in limit.
+func (s *EngineServer) FetchL3OrderBook(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	fields := req.GetFields()
+
+	engine, err := s.bookEngine(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := engine.FetchL3OrderBook(int64(fields["limit"].GetNumberValue()))
+	if err != nil {
+		return nil, err
+	}
+
+	return toStruct(snapshot)
+}
+
+// FetchDepthDeltas returns the depth events of a market kept for replay, the request has its
+// base_currency, quote_currency and the from_sequence and to_sequence of the events.
+func (s *EngineServer) FetchDepthDeltas(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	fields := req.GetFields()
+
+	engine, err := s.bookEngine(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas, err := engine.FetchDepthDeltas(int64(fields["from_sequence"].GetNumberValue()), int64(fields["to_sequence"].GetNumberValue()))
+	if errors.Is(err, matching.ErrDepthReplayUnavailable) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	return toStruct(map[string]interface{}{
+		"deltas": deltas,
+	})
+}
+
+// FetchStopOrders returns the stop orders of a member waiting for their trigger price, the request
+// has the base_currency and quote_currency of the market and the member_id.
+func (s *EngineServer) FetchStopOrders(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	fields := req.GetFields()
+
+	engine, err := s.bookEngine(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	orders, err := engine.FetchStopOrders(int64(fields["member_id"].GetNumberValue()))
+	if err != nil {
+		return nil, err
+	}
+
+	return toStruct(map[string]interface{}{
+		"orders": orders,
+	})
+}
+
+// FetchMassCancel waits until the engine ran the mass cancel with the request_id of the request and
+// returns how many orders it cancelled in count. It fails with the DeadlineExceeded code when the
+// mass cancel isn't run before the deadline of the call.
+func (s *EngineServer) FetchMassCancel(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	request_id := req.GetFields()["request_id"].GetStringValue()
+	if len(request_id) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "request_id is missing")
+	}
+
+	count, err := s.massCancels.Wait(ctx, request_id)
+	if err != nil {
+		return nil, status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	return structpb.NewStruct(map[string]interface{}{
+		"count": count,
+	})
+}
+
+// toStruct converts the JSON of a value to a protobuf struct.
+func toStruct(value interface{}) (*structpb.Struct, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, err
+	}
+
+	return structpb.NewStruct(response)
+}
@@ -0,0 +1,102 @@
+// Package bookrpc is the gRPC service of the matching engine serving the books in the shapes the
+// matching engine service of zsmartex/pkg has no messages for. Its requests are protobuf structs.
+package bookrpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	GrpcEngine "github.com/zsmartex/pkg/Grpc/engine"
+)
+
+const serviceName = "finex.engine.BookService"
+
+// BookServiceServer serves the books of the engines.
+type BookServiceServer interface {
+	// FetchGroupedOrderBook returns the price levels merged by multiples of a price, the request has the
+	// base_currency, quote_currency, limit and group of the book, group is a decimal string.
+	FetchGroupedOrderBook(context.Context, *structpb.Struct) (*GrpcEngine.FetchOrderBookResponse, error)
+	// FetchDepthDeltas returns the JSON of the depth events kept for replay in deltas, the request has
+	// the base_currency, quote_currency, from_sequence and to_sequence of the events. It fails with
+	// the NotFound code once the events are gone.
+	FetchDepthDeltas(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	// FetchL3OrderBook returns the JSON of the order by order snapshot, the request has the
+	// base_currency, quote_currency and limit of the book.
+	FetchL3OrderBook(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	// FetchStopOrders returns the JSON of the untriggered stop orders of a member in orders, the
+	// request has the base_currency, quote_currency and member_id.
+	FetchStopOrders(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	// FetchMassCancel waits until the mass cancel with the request_id of the request ran and returns
+	// how many orders it cancelled in count. It fails with the DeadlineExceeded code when it didn't run in time.
+	FetchMassCancel(context.Context, *structpb.Struct) (*structpb.Struct, error)
+}
+
+var BookServiceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*BookServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "FetchGroupedOrderBook",
+			Handler: unaryHandler("FetchGroupedOrderBook", func(srv BookServiceServer, ctx context.Context, req *structpb.Struct) (interface{}, error) {
+				return srv.FetchGroupedOrderBook(ctx, req)
+			}),
+		},
+		{
+			MethodName: "FetchDepthDeltas",
+			Handler: unaryHandler("FetchDepthDeltas", func(srv BookServiceServer, ctx context.Context, req *structpb.Struct) (interface{}, error) {
+				return srv.FetchDepthDeltas(ctx, req)
+			}),
+		},
+		{
+			MethodName: "FetchL3OrderBook",
+			Handler: unaryHandler("FetchL3OrderBook", func(srv BookServiceServer, ctx context.Context, req *structpb.Struct) (interface{}, error) {
+				return srv.FetchL3OrderBook(ctx, req)
+			}),
+		},
+		{
+			MethodName: "FetchStopOrders",
+			Handler: unaryHandler("FetchStopOrders", func(srv BookServiceServer, ctx context.Context, req *structpb.Struct) (interface{}, error) {
+				return srv.FetchStopOrders(ctx, req)
+			}),
+		},
+		{
+			MethodName: "FetchMassCancel",
+			Handler: unaryHandler("FetchMassCancel", func(srv BookServiceServer, ctx context.Context, req *structpb.Struct) (interface{}, error) {
+				return srv.FetchMassCancel(ctx, req)
+			}),
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func RegisterBookServiceServer(s *grpc.Server, srv BookServiceServer) {
+	s.RegisterService(&BookServiceDesc, srv)
+}
+
+type unaryMethod func(srv BookServiceServer, ctx context.Context, req *structpb.Struct) (interface{}, error)
+
+func unaryHandler(method_name string, method unaryMethod) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := new(structpb.Struct)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+
+		if interceptor == nil {
+			return method(srv.(BookServiceServer), ctx, in)
+		}
+
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/" + serviceName + "/" + method_name,
+		}
+
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return method(srv.(BookServiceServer), ctx, req.(*structpb.Struct))
+		}
+
+		return interceptor(ctx, in, info, handler)
+	}
+}
@@ -0,0 +1,110 @@
+package bookrpc
+
+import (
+	"context"
+	"os"
+
+	"github.com/shopspring/decimal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/zsmartex/pkg"
+	GrpcEngine "github.com/zsmartex/pkg/Grpc/engine"
+)
+
+// Client calls the book service of the matching engine at MATCHING_ENGINE_URL.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+func NewClient() (*Client, error) {
+	conn, err := grpc.Dial(os.Getenv("MATCHING_ENGINE_URL"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{conn: conn}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// FetchGroupedOrderBook returns the price levels of a market merged by multiples of group.
+func (c *Client) FetchGroupedOrderBook(ctx context.Context, symbol pkg.Symbol, limit int64, group decimal.Decimal) (*GrpcEngine.FetchOrderBookResponse, error) {
+	request, err := structpb.NewStruct(map[string]interface{}{
+		"base_currency":  symbol.BaseCurrency,
+		"quote_currency": symbol.QuoteCurrency,
+		"limit":          limit,
+		"group":          group.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(GrpcEngine.FetchOrderBookResponse)
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/FetchGroupedOrderBook", request, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// FetchDepthDeltas returns the depth events of a market from sequence from to sequence to, or up to
+// the last one when to is zero.
+func (c *Client) FetchDepthDeltas(ctx context.Context, symbol pkg.Symbol, from, to int64) (*structpb.Struct, error) {
+	request, err := structpb.NewStruct(map[string]interface{}{
+		"base_currency":  symbol.BaseCurrency,
+		"quote_currency": symbol.QuoteCurrency,
+		"from_sequence":  from,
+		"to_sequence":    to,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(structpb.Struct)
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/FetchDepthDeltas", request, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// FetchStopOrders returns the stop orders of a member in a market which are waiting for their trigger price.
+func (c *Client) FetchStopOrders(ctx context.Context, symbol pkg.Symbol, member_id int64) (*structpb.Struct, error) {
+	request, err := structpb.NewStruct(map[string]interface{}{
+		"base_currency":  symbol.BaseCurrency,
+		"quote_currency": symbol.QuoteCurrency,
+		"member_id":      member_id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(structpb.Struct)
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/FetchStopOrders", request, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// FetchMassCancel waits until the matching engine ran the mass cancel with the request id and returns
+// how many orders it cancelled, the call fails once the deadline of ctx is reached.
+func (c *Client) FetchMassCancel(ctx context.Context, request_id string) (int64, error) {
+	request, err := structpb.NewStruct(map[string]interface{}{
+		"request_id": request_id,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	response := new(structpb.Struct)
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/FetchMassCancel", request, response); err != nil {
+		return 0, err
+	}
+
+	return int64(response.GetFields()["count"].GetNumberValue()), nil
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/emirpasic/gods/trees/redblacktree"
 	GrpcEngine "github.com/zsmartex/pkg/Grpc/engine"
 	GrpcOrder "github.com/zsmartex/pkg/Grpc/order"
 	GrpcSymbol "github.com/zsmartex/pkg/Grpc/symbol"
@@ -18,11 +20,31 @@ import (
 	"github.com/zsmartex/finex/config"
 	"github.com/zsmartex/finex/matching"
 	"github.com/zsmartex/finex/models"
+	"github.com/zsmartex/finex/types"
 	"github.com/zsmartex/pkg"
 )
 
 type EngineServer struct {
-	Engines map[pkg.Symbol]*matching.Engine
+	// Engines are only written by the goroutine processing the matching topic,
+	// the gRPC calls read them under enginesMutex
+	Engines      map[pkg.Symbol]*matching.Engine
+	enginesMutex sync.RWMutex
+
+	// Snapshot is the snapshot the engines are restored from while starting
+	Snapshot        *EngineSnapshot
+	SnapshotOffsets map[int32]int64
+	SnapshotTime    time.Time
+	Processed       *ProcessedOffsets
+
+	// Journal records every input of the engines, it is nil if the journal is disabled
+	Journal *Journal
+	silent  bool
+
+	// now is the time the message being processed was received at
+	now time.Time
+
+	// massCancels are the counts of the mass cancels, the book service answers them to their senders
+	massCancels massCancelResults
 }
 
 func NewEngineServer() *EngineServer {
@@ -30,20 +52,152 @@ func NewEngineServer() *EngineServer {
 		Engines: make(map[pkg.Symbol]*matching.Engine),
 	}
 
+	if JournalEnabled() {
+		journal, err := OpenJournal()
+		if err != nil {
+			config.Logger.Fatalf("Failed to open engine journal: %v", err)
+		}
+
+		worker.Journal = journal
+	}
+
+	if SnapshotEnabled() {
+		snapshot, err := LoadSnapshot()
+		if err != nil {
+			config.Logger.Errorf("Failed to load engine snapshot, orders will be loaded from database: %v", err)
+		}
+
+		processed, err := OpenProcessedOffsets()
+		if err != nil {
+			config.Logger.Fatalf("Failed to open processed offsets: %v", err)
+		}
+
+		worker.Snapshot = snapshot
+		worker.Processed = processed
+
+		if snapshot != nil {
+			worker.SnapshotOffsets = snapshot.Offsets
+		}
+	}
+
 	worker.Reload(pkg.Symbol{BaseCurrency: "ALL", QuoteCurrency: "ALL"})
+	worker.Snapshot = nil
+	worker.SnapshotTime = time.Now()
 
 	return worker
 }
 
+// ProcessRecord processes a message of the matching topic, messages already contained in
+// the snapshot are skipped and messages processed before a restart are replayed silently.
+func (w *EngineServer) ProcessRecord(partition int32, offset int64, payload []byte) error {
+	if w.Processed == nil {
+		return w.Process(payload)
+	}
+
+	if last, found := w.SnapshotOffsets[partition]; found && offset <= last {
+		return nil
+	}
+
+	if err := w.SetSilent(w.Processed.Contains(partition, offset)); err != nil {
+		return err
+	}
+
+	if err := w.Process(payload); err != nil {
+		return err
+	}
+
+	w.Processed.Mark(partition, offset)
+
+	return nil
+}
+
+// FlushProcessed writes the offsets of the messages processed since the last flush, it is
+// called once per batch of messages polled.
+func (w *EngineServer) FlushProcessed() error {
+	if w.Processed == nil {
+		return nil
+	}
+
+	return w.Processed.Flush()
+}
+
+// SetSilent stops or resumes the events sent by the engines to the settlement workers.
+func (w *EngineServer) SetSilent(silent bool) error {
+	w.silent = silent
+
+	for _, engine := range w.Engines {
+		if err := engine.SetSilent(silent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SnapshotDue returns true if it's time to write a new snapshot.
+func (w *EngineServer) SnapshotDue() bool {
+	return w.Processed != nil && time.Since(w.SnapshotTime) >= SNAPSHOT_PERIOD
+}
+
+// TakeSnapshot writes the state of every engine to disk, it must be called between two messages.
+func (w *EngineServer) TakeSnapshot() error {
+	snapshot := &EngineSnapshot{
+		Offsets:    make(map[int32]int64),
+		CreatedAt:  time.Now(),
+		OrderBooks: make([]*matching.OrderBookSnapshot, 0),
+	}
+
+	for partition, offset := range w.Processed.Offsets {
+		snapshot.Offsets[partition] = offset
+	}
+
+	for _, engine := range w.Engines {
+		if !engine.IsInitialized() {
+			continue
+		}
+
+		order_book, err := engine.Snapshot()
+		if err != nil {
+			return err
+		}
+
+		snapshot.OrderBooks = append(snapshot.OrderBooks, order_book)
+	}
+
+	if err := WriteSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	w.SnapshotTime = snapshot.CreatedAt
+
+	return nil
+}
+
 func (w *EngineServer) Process(payload []byte) error {
-	var matching_payload pkg.MatchingPayloadMessage
+	var matching_payload matching.MatchingPayloadMessage
 	if err := json.Unmarshal(payload, &matching_payload); err != nil {
 		return err
 	}
 
+	w.now = time.Now()
+
+	if w.Journal != nil {
+		w.Journal.Begin(&JournalEntry{
+			Kind:      JournalEntryMessage,
+			CreatedAt: w.now,
+			Payload:   payload,
+			Replayed:  w.silent,
+		})
+		defer w.CommitJournal()
+	}
+
 	switch matching_payload.Action {
 	case pkg.ActionSubmit:
 		order := matching_payload.Order
+		if matching_payload.OcoOrder != nil {
+			return w.SubmitOcoOrders(order, matching_payload.OcoOrder)
+		}
+
 		return w.SubmitOrder(order)
 	case pkg.ActionCancel:
 		order := matching_payload.Order
@@ -51,6 +205,17 @@ func (w *EngineServer) Process(payload []byte) error {
 	case pkg.ActionCancelWithKey:
 		key := matching_payload.Key
 		return w.CancelOrderWithKey(key)
+	case matching.ActionAmend:
+		return w.AmendOrder(matching_payload.Key, matching_payload.Order)
+	case matching.ActionStartAuction:
+		return w.StartAuction(matching_payload.Symbol)
+	case matching.ActionEndAuction:
+		return w.EndAuction(matching_payload.Symbol)
+	case matching.ActionSetTradingState:
+		return w.SetTradingState(matching_payload.Symbol, matching_payload.TradingState)
+	case matching.ActionMassCancel:
+		_, err := w.MassCancel(matching_payload.Symbol, matching_payload.MassCancel)
+		return err
 	case pkg.ActionNew:
 		w.InitializeEngine(matching_payload.Symbol)
 	case pkg.ActionReload:
@@ -62,14 +227,14 @@ func (w *EngineServer) Process(payload []byte) error {
 	return nil
 }
 
-func (s *EngineServer) SubmitOrder(order *pkg.Order) error {
+func (s *EngineServer) SubmitOrder(order *matching.Order) error {
 	engine := s.Engines[order.Symbol]
 
 	if engine == nil {
 		return errors.New("engine not found")
 	}
 
-	if !engine.Initialized {
+	if !engine.IsInitialized() {
 		return errors.New("engine is not ready")
 	}
 
@@ -78,8 +243,46 @@ func (s *EngineServer) SubmitOrder(order *pkg.Order) error {
 		return nil
 	}
 
-	engine.Submit(order)
-	return nil
+	return engine.Submit(order)
+}
+
+// SubmitOcoOrders submits both orders of an OCO pair to the engine of their market.
+func (s *EngineServer) SubmitOcoOrders(order, oco_order *matching.Order) error {
+	engine := s.Engines[order.Symbol]
+
+	if engine == nil {
+		return errors.New("engine not found")
+	}
+
+	if !engine.IsInitialized() {
+		return errors.New("engine is not ready")
+	}
+
+	if order.Price.IsNegative() || order.StopPrice.IsNegative() || oco_order.Price.IsNegative() || oco_order.StopPrice.IsNegative() {
+		config.Logger.Error("price is negative")
+		return nil
+	}
+
+	return engine.SubmitOco(order, oco_order)
+}
+
+func (s *EngineServer) AmendOrder(key *pkg.OrderKey, order *matching.Order) error {
+	engine := s.Engines[order.Symbol]
+
+	if engine == nil {
+		return errors.New("engine not found")
+	}
+
+	if !engine.IsInitialized() {
+		return errors.New("engine is not ready")
+	}
+
+	if !order.Price.IsPositive() || !order.Quantity.IsPositive() {
+		config.Logger.Error("amended price or quantity isn't positive")
+		return nil
+	}
+
+	return engine.Amend(key, order)
 }
 
 func (s *EngineServer) CancelOrderWithKey(key *pkg.OrderKey) error {
@@ -89,30 +292,158 @@ func (s *EngineServer) CancelOrderWithKey(key *pkg.OrderKey) error {
 		return errors.New("engine not found")
 	}
 
-	if !engine.Initialized {
+	if !engine.IsInitialized() {
 		return errors.New("engine is not ready")
 	}
 
-	engine.CancelWithKey(key)
-	return nil
+	return engine.CancelWithKey(key)
 }
 
-func (s *EngineServer) CancelOrder(order *pkg.Order) error {
+func (s *EngineServer) CancelOrder(order *matching.Order) error {
 	engine := s.Engines[order.Symbol]
 
 	if engine == nil {
 		return errors.New("engine not found")
 	}
 
-	if !engine.Initialized {
+	if !engine.IsInitialized() {
 		return errors.New("engine is not ready")
 	}
 
-	engine.Cancel(order)
-	return nil
+	return engine.Cancel(order)
+}
+
+func (s *EngineServer) StartAuction(symbol pkg.Symbol) error {
+	engine := s.Engines[symbol]
+
+	if engine == nil {
+		return errors.New("engine not found")
+	}
+
+	if !engine.IsInitialized() {
+		return errors.New("engine is not ready")
+	}
+
+	return engine.StartAuction()
 }
 
-func (s EngineServer) GetEngineBySymbol(symbol pkg.Symbol) *matching.Engine {
+func (s *EngineServer) EndAuction(symbol pkg.Symbol) error {
+	engine := s.Engines[symbol]
+
+	if engine == nil {
+		return errors.New("engine not found")
+	}
+
+	if !engine.IsInitialized() {
+		return errors.New("engine is not ready")
+	}
+
+	return engine.EndAuction()
+}
+
+// SetTradingState switches the market of the symbol to a trading state without touching its book.
+func (s *EngineServer) SetTradingState(symbol pkg.Symbol, state types.TradingState) error {
+	engine := s.Engines[symbol]
+
+	if engine == nil {
+		return errors.New("engine not found")
+	}
+
+	if !engine.IsInitialized() {
+		return errors.New("engine is not ready")
+	}
+
+	if !state.IsValid() {
+		config.Logger.Errorf("unknown trading state: %s", state)
+		return nil
+	}
+
+	return engine.SetTradingState(state)
+}
+
+// MassCancel cancels the orders selected by the mass cancel in the market of the symbol, or in every
+// market when the symbol is empty, and returns how many were cancelled. Every engine is checked before
+// any order is cancelled so a mass cancel which fails cancels nothing. The count is kept for the book
+// service under the request id of the mass cancel.
+func (s *EngineServer) MassCancel(symbol pkg.Symbol, mass_cancel *matching.MassCancel) (int, error) {
+	if mass_cancel == nil {
+		config.Logger.Error("mass cancel without filter")
+		return 0, nil
+	}
+
+	symbols := []pkg.Symbol{symbol}
+	if symbol == (pkg.Symbol{}) {
+		symbols = sortedSymbols(s.Engines)
+	}
+
+	engines := make([]*matching.Engine, 0, len(symbols))
+	for _, symbol := range symbols {
+		engine := s.Engines[symbol]
+
+		if engine == nil {
+			return 0, errors.New("engine not found")
+		}
+
+		if !engine.IsInitialized() {
+			return 0, errors.New("engine is not ready")
+		}
+
+		engines = append(engines, engine)
+	}
+
+	count := 0
+	for _, engine := range engines {
+		cancelled, err := engine.MassCancel(mass_cancel)
+		if err != nil {
+			return count, err
+		}
+
+		count += cancelled
+	}
+
+	config.Logger.Infof("mass cancel of member %d cancelled %d orders", mass_cancel.MemberID, count)
+
+	if len(mass_cancel.RequestID) > 0 {
+		s.massCancels.Done(mass_cancel.RequestID, count)
+	}
+
+	return count, nil
+}
+
+// sortedSymbols returns the symbols of the engines in a fixed order, the engines of a mass
+// cancel are run in this order so a replay produces the same events.
+func sortedSymbols(engines map[pkg.Symbol]*matching.Engine) []pkg.Symbol {
+	symbols := make([]pkg.Symbol, 0, len(engines))
+	for symbol := range engines {
+		symbols = append(symbols, symbol)
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].String() < symbols[j].String()
+	})
+
+	return symbols
+}
+
+// readyEngine returns the engine of the symbol for the gRPC queries, the book of an engine
+// still loading its orders isn't answered.
+func (s *EngineServer) readyEngine(symbol pkg.Symbol) (*matching.Engine, error) {
+	engine := s.GetEngineBySymbol(symbol)
+	if engine == nil {
+		return nil, errors.New("engine not found")
+	}
+
+	if !engine.IsInitialized() {
+		return nil, errors.New("engine is not ready")
+	}
+
+	return engine, nil
+}
+
+func (s *EngineServer) GetEngineBySymbol(symbol pkg.Symbol) *matching.Engine {
+	s.enginesMutex.RLock()
+	defer s.enginesMutex.RUnlock()
+
 	engine, found := s.Engines[symbol]
 
 	if found {
@@ -122,84 +453,93 @@ func (s EngineServer) GetEngineBySymbol(symbol pkg.Symbol) *matching.Engine {
 	return nil
 }
 
+// FetchOrder returns an order of the book or a stop order waiting for its trigger,
+// the stop price of a stop order is the price it's currently triggered at.
 func (s *EngineServer) FetchOrder(ctx context.Context, req *GrpcEngine.FetchOrderRequest) (*GrpcEngine.FetchOrderResponse, error) {
 	key := req.OrderKey.ToOrderKey()
-	engine := s.GetEngineBySymbol(key.Symbol)
-	pl := matching.NewPriceLevel(key.Side, key.Price)
+	engine, err := s.readyEngine(key.Symbol)
+	if err != nil {
+		return nil, err
+	}
 
-	var price_levels *redblacktree.Tree
-	if key.Side == pkg.SideSell {
-		price_levels = engine.OrderBook.Depth.Asks
-	} else {
-		price_levels = engine.OrderBook.Depth.Bids
+	order, err := engine.FetchOrder(key)
+	if err != nil {
+		return nil, err
 	}
 
-	value, found := price_levels.Get(pl.Key())
-	if !found {
+	if order == nil {
 		return nil, fmt.Errorf("can't find order with uuid: %s in orderbook", key.UUID.String())
 	}
 
-	price_level := value.(*matching.PriceLevel)
-	order := price_level.Get(key)
-	if order == nil {
-		return nil, errors.New("Can't find order in book")
+	stop_price := order.StopPrice
+	if order.TriggerPrice.IsPositive() {
+		stop_price = order.TriggerPrice
+	}
+
+	values := make([]*GrpcUtils.Decimal, 4)
+	for i, value := range []decimal.Decimal{order.Price, stop_price, order.Quantity, order.FilledQuantity} {
+		var err error
+		if values[i], err = matching.GrpcDecimal(value); err != nil {
+			return nil, err
+		}
 	}
 
 	return &GrpcEngine.FetchOrderResponse{
 		Order: &GrpcOrder.Order{
-			Id:       order.ID,
-			Uuid:     order.UUID[:],
-			MemberId: order.MemberID,
-			Symbol:   &GrpcSymbol.Symbol{BaseCurrency: order.Symbol.BaseCurrency, QuoteCurrency: order.Symbol.QuoteCurrency},
-			Side:     string(order.Side),
-			Type:     string(order.Type),
-			Price: &GrpcUtils.Decimal{
-				Val: order.Price.CoefficientInt64(),
-				Exp: order.Price.Exponent(),
-			},
-			StopPrice: &GrpcUtils.Decimal{
-				Val: order.StopPrice.CoefficientInt64(),
-				Exp: order.StopPrice.Exponent(),
-			},
-			Quantity: &GrpcUtils.Decimal{
-				Val: order.Quantity.CoefficientInt64(),
-				Exp: order.Quantity.Exponent(),
-			},
-			FilledQuantity: &GrpcUtils.Decimal{
-				Val: order.FilledQuantity.CoefficientInt64(),
-				Exp: order.FilledQuantity.Exponent(),
-			},
-			Fake:      order.Fake,
-			Cancelled: order.Cancelled,
-			CreatedAt: timestamppb.New(order.CreatedAt),
+			Id:             order.ID,
+			Uuid:           order.UUID[:],
+			MemberId:       order.MemberID,
+			Symbol:         &GrpcSymbol.Symbol{BaseCurrency: order.Symbol.BaseCurrency, QuoteCurrency: order.Symbol.QuoteCurrency},
+			Side:           string(order.Side),
+			Type:           string(order.Type),
+			Price:          values[0],
+			StopPrice:      values[1],
+			Quantity:       values[2],
+			FilledQuantity: values[3],
+			Fake:           order.Fake,
+			Cancelled:      order.Cancelled,
+			CreatedAt:      timestamppb.New(order.CreatedAt),
 		},
 	}, nil
 }
 
 func (s *EngineServer) FetchMarketPrice(ctx context.Context, req *GrpcEngine.FetchMarketPriceRequest) (*GrpcEngine.FetchMarketPriceResponse, error) {
-	engine := s.GetEngineBySymbol(req.Symbol.ToSymbol())
-	price := engine.OrderBook.MarketPrice
+	engine, err := s.readyEngine(req.Symbol.ToSymbol())
+	if err != nil {
+		return nil, err
+	}
+
+	market_price, err := engine.MarketPrice()
+	if err != nil {
+		return nil, err
+	}
+
+	price, err := matching.GrpcDecimal(market_price)
+	if err != nil {
+		return nil, err
+	}
 
 	return &GrpcEngine.FetchMarketPriceResponse{
-		Price: &GrpcUtils.Decimal{
-			Val: price.CoefficientInt64(),
-			Exp: price.Exponent(),
-		},
+		Price: price,
 	}, nil
 }
 
 func (s *EngineServer) FetchOrderBook(ctx context.Context, req *GrpcEngine.FetchOrderBookRequest) (*GrpcEngine.FetchOrderBookResponse, error) {
-	engine := s.GetEngineBySymbol(req.Symbol.ToSymbol())
-	response := engine.OrderBook.Depth.FetchOrderBook(req.Limit)
+	engine, err := s.readyEngine(req.Symbol.ToSymbol())
+	if err != nil {
+		return nil, err
+	}
 
-	return response, nil
+	return engine.FetchOrderBook(req.Limit, decimal.Zero)
 }
 
 func (s *EngineServer) CalcMarketOrder(ctx context.Context, req *GrpcEngine.CalcMarketOrderRequest) (*GrpcEngine.CalcMarketOrderResponse, error) {
-	engine := s.GetEngineBySymbol(req.Symbol.ToSymbol())
-	response := engine.OrderBook.CalcMarketOrder(pkg.OrderSide(req.Side), req.Quantity.ToNullDecimal(), req.Volume.ToNullDecimal())
+	engine, err := s.readyEngine(req.Symbol.ToSymbol())
+	if err != nil {
+		return nil, err
+	}
 
-	return response, nil
+	return engine.CalcMarketOrder(pkg.OrderSide(req.Side), req.Quantity.ToNullDecimal(), req.Volume.ToNullDecimal())
 }
 
 func (s *EngineServer) Reload(symbol pkg.Symbol) {
@@ -222,17 +562,141 @@ func (s *EngineServer) InitializeEngine(symbol pkg.Symbol) {
 		lastPrice = trade.Price
 	}
 
-	engine := matching.NewEngine(symbol, lastPrice)
+	market_config := matching.DefaultMarketConfig()
+
+	var market *models.Market
+	if result := config.DataBase.First(&market, "symbol = ?", strings.ToLower(symbol.ToSymbol(""))); result.Error == nil {
+		market_config = market.MatchingConfig()
+	}
+
+	engine := matching.NewEngine(symbol, lastPrice, market_config)
+	engine.Execute(func(ob *matching.OrderBook) {
+		ob.Silent = s.silent
+		ob.Clock = s.Now
+	})
+
+	s.enginesMutex.Lock()
+	if previous := s.Engines[symbol]; previous != nil {
+		previous.Stop()
+	}
 	s.Engines[symbol] = engine
-	s.LoadOrders(engine)
-	engine.Initialized = true
+	s.enginesMutex.Unlock()
+
+	var entry *JournalEntry
+	if s.Journal != nil {
+		entry = &JournalEntry{
+			Kind:         JournalEntryInitialize,
+			CreatedAt:    s.Now(),
+			Replayed:     s.silent,
+			Symbol:       &symbol,
+			MarketPrice:  &lastPrice,
+			MarketConfig: &market_config,
+		}
+
+		s.Journal.Begin(entry)
+		defer s.CommitJournal()
+
+		engine.Execute(func(ob *matching.OrderBook) {
+			ob.Producer = &journalProducer{
+				journal:  s.Journal,
+				producer: ob.Producer,
+			}
+		})
+	}
+
+	if snapshot := s.FindOrderBookSnapshot(symbol); snapshot != nil {
+		if entry != nil {
+			entry.OrderBooks = []*matching.OrderBookSnapshot{snapshot}
+		}
+
+		engine.Restore(snapshot)
+		config.Logger.Infof("%v engine restored from snapshot taken at %v.", symbol.String(), s.Snapshot.CreatedAt)
+	} else {
+		s.LoadOrders(engine, entry)
+	}
+
+	engine.SetInitialized()
 	config.Logger.Infof("%v engine reloaded.", symbol.String())
 }
 
-func (s *EngineServer) LoadOrders(engine *matching.Engine) {
+// Now returns the time the message being processed was received at, the engines use it
+// instead of the clock so a replay of the journal sees the same time.
+func (s *EngineServer) Now() time.Time {
+	if s.now.IsZero() {
+		return time.Now()
+	}
+
+	return s.now
+}
+
+// FindOrderBookSnapshot returns the order book of the symbol in the startup snapshot.
+func (s *EngineServer) FindOrderBookSnapshot(symbol pkg.Symbol) *matching.OrderBookSnapshot {
+	if s.Snapshot == nil {
+		return nil
+	}
+
+	for _, snapshot := range s.Snapshot.OrderBooks {
+		if snapshot.Symbol == symbol {
+			return snapshot
+		}
+	}
+
+	return nil
+}
+
+// LoadOrders loads the open orders of the market, they are copied to the journal entry if any.
+func (s *EngineServer) LoadOrders(engine *matching.Engine, entry *JournalEntry) {
 	var orders []models.Order
 	config.DataBase.Where("market_id = ? AND state = ?", strings.ToLower(engine.Symbol.ToSymbol("")), models.StateWait).Order("id asc").Find(&orders)
 	for _, order := range orders {
-		engine.Submit(order.ToMatchingAttributes())
+		// the other order of an OCO pair already traded or was closed, this one is being cancelled
+		if oco_order := order.OcoOrder(); oco_order != nil && (oco_order.State != models.StateWait || oco_order.TradesCount > 0) {
+			continue
+		}
+
+		o := order.ToMatchingAttributes()
+
+		if entry != nil {
+			journal_order := *o
+			entry.Orders = append(entry.Orders, &journal_order)
+		}
+
+		engine.Load(o)
 	}
 }
+
+// CommitJournal appends the entry being processed to the journal, a journal which
+// can't be written is logged but never stops the engine.
+func (s *EngineServer) CommitJournal() {
+	if err := s.Journal.Commit(); err != nil {
+		config.Logger.Errorf("Failed to write engine journal: %v", err)
+	}
+}
+
+// WriteCheckpoint writes the books of every engine to the journal, replays compare their books
+// against it. It must be called between two messages.
+func (s *EngineServer) WriteCheckpoint() {
+	entry := &JournalEntry{
+		Kind:       JournalEntryCheckpoint,
+		CreatedAt:  time.Now(),
+		OrderBooks: make([]*matching.OrderBookSnapshot, 0),
+	}
+
+	for _, engine := range s.Engines {
+		if !engine.IsInitialized() {
+			continue
+		}
+
+		order_book, err := engine.Snapshot()
+		if err != nil {
+			config.Logger.Errorf("Failed to write engine checkpoint of %v: %v", engine.Symbol.String(), err)
+			continue
+		}
+
+		entry.OrderBooks = append(entry.OrderBooks, order_book)
+	}
+
+	s.Journal.CheckpointTime = time.Now()
+	s.Journal.Begin(entry)
+	s.CommitJournal()
+}
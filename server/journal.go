@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/zsmartex/pkg"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
+)
+
+var JOURNAL_CHECKPOINT_PERIOD = 60 * time.Second
+
+const journalFileName = "engine.journal"
+
+type JournalEntryKind string
+
+const (
+	// JournalEntryMessage is a message of the matching topic handled by the engine
+	JournalEntryMessage JournalEntryKind = "message"
+	// JournalEntryInitialize is an engine (re)created with the orders it was loaded with
+	JournalEntryInitialize JournalEntryKind = "initialize"
+	// JournalEntryCheckpoint is the state of every book, replays are compared against it
+	JournalEntryCheckpoint JournalEntryKind = "checkpoint"
+)
+
+type JournalOutput struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// JournalEntry is a line of the journal, entries are numbered by the engine in the order they are written.
+type JournalEntry struct {
+	Sequence     int64                         `json:"sequence"`
+	Kind         JournalEntryKind              `json:"kind"`
+	CreatedAt    time.Time                     `json:"created_at"`
+	Payload      json.RawMessage               `json:"payload,omitempty"`
+	Replayed     bool                          `json:"replayed,omitempty"`
+	Symbol       *pkg.Symbol                   `json:"symbol,omitempty"`
+	MarketPrice  *decimal.Decimal              `json:"market_price,omitempty"`
+	MarketConfig *matching.MarketConfig        `json:"market_config,omitempty"`
+	Orders       []*matching.Order             `json:"orders,omitempty"`
+	OrderBooks   []*matching.OrderBookSnapshot `json:"order_books,omitempty"`
+	Outputs      []*JournalOutput              `json:"outputs,omitempty"`
+}
+
+// JournalEnabled returns true if the engine writes every input it handles to the journal.
+func JournalEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("ENGINE_JOURNAL_ENABLED"))
+
+	return enabled
+}
+
+func journalDir() string {
+	dir := os.Getenv("ENGINE_JOURNAL_PATH")
+	if len(dir) == 0 {
+		dir = "journal"
+	}
+
+	return dir
+}
+
+// Journal is an append-only file of the inputs of the engine and of the events they produced,
+// it is enough to replay the engine offline with finex-replay.
+type Journal struct {
+	mutex          sync.Mutex
+	file           *os.File
+	sequence       int64
+	entries        []*JournalEntry
+	CheckpointTime time.Time
+}
+
+func OpenJournal() (*Journal, error) {
+	dir := journalDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, journalFileName)
+
+	journal := &Journal{
+		CheckpointTime: time.Now(),
+	}
+
+	// sequences keep growing across restarts
+	if err := ReadJournal(path, func(entry *JournalEntry) error {
+		journal.sequence = entry.Sequence
+		return nil
+	}); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := truncatePartialEntry(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	journal.file = file
+
+	return journal, nil
+}
+
+// Begin opens an entry, the events produced until it is committed are recorded in it.
+func (j *Journal) Begin(entry *JournalEntry) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	j.entries = append(j.entries, entry)
+}
+
+// Record adds an event to the entry being processed.
+func (j *Journal) Record(topic string, payload interface{}) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if len(j.entries) == 0 {
+		return nil
+	}
+
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	entry := j.entries[len(j.entries)-1]
+	entry.Outputs = append(entry.Outputs, &JournalOutput{
+		Topic:   topic,
+		Payload: buf,
+	})
+
+	return nil
+}
+
+// Commit numbers the latest opened entry and appends it to the journal.
+func (j *Journal) Commit() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if len(j.entries) == 0 {
+		return nil
+	}
+
+	entry := j.entries[len(j.entries)-1]
+	j.entries = j.entries[:len(j.entries)-1]
+
+	j.sequence++
+	entry.Sequence = j.sequence
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(buf, '\n'))
+
+	return err
+}
+
+// CheckpointDue returns true if it's time to write the books to the journal.
+func (j *Journal) CheckpointDue() bool {
+	return time.Since(j.CheckpointTime) >= JOURNAL_CHECKPOINT_PERIOD
+}
+
+// ReadJournal calls fn with every entry of the journal in the order they were written.
+func ReadJournal(path string, fn func(entry *JournalEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial line is an entry the engine did not finish to write
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry *JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// truncatePartialEntry drops the end of an entry which was being written when the engine stopped.
+func truncatePartialEntry(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	buf := make([]byte, 4096)
+
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+
+		n, err := file.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			if start+int64(i)+1 == size {
+				return nil
+			}
+
+			return file.Truncate(start + int64(i) + 1)
+		}
+
+		end = start
+	}
+
+	return file.Truncate(0)
+}
+
+// journalProducer records the events of an order book in the journal before sending them to Kafka.
+type journalProducer struct {
+	journal  *Journal
+	producer matching.Producer
+}
+
+func (p *journalProducer) Produce(topic string, payload interface{}) error {
+	if err := p.journal.Record(topic, payload); err != nil {
+		config.Logger.Errorf("Failed to record %s event in journal: %v", topic, err)
+	}
+
+	return p.producer.Produce(topic, payload)
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MASS_CANCEL_RESULT_TTL is how long the count of a mass cancel is kept for its sender.
+var MASS_CANCEL_RESULT_TTL = time.Minute
+
+// massCancelResult is the number of orders cancelled by a mass cancel, done is closed once it ran.
+type massCancelResult struct {
+	count     int
+	done      chan struct{}
+	createdAt time.Time
+}
+
+// massCancelResults keeps the counts of the mass cancels by request id, the goroutine processing
+// the matching topic sets them and the book service waits for them.
+type massCancelResults struct {
+	mutex   sync.Mutex
+	results map[string]*massCancelResult
+}
+
+// result returns the result of the request id, the results older than MASS_CANCEL_RESULT_TTL are
+// dropped. It must be called with the mutex held.
+func (r *massCancelResults) result(request_id string) *massCancelResult {
+	if r.results == nil {
+		r.results = make(map[string]*massCancelResult)
+	}
+
+	now := time.Now()
+	for id, result := range r.results {
+		if now.Sub(result.createdAt) > MASS_CANCEL_RESULT_TTL {
+			delete(r.results, id)
+		}
+	}
+
+	result, found := r.results[request_id]
+	if !found {
+		result = &massCancelResult{
+			done:      make(chan struct{}),
+			createdAt: now,
+		}
+		r.results[request_id] = result
+	}
+
+	return result
+}
+
+// Done records how many orders the mass cancel with the request id cancelled.
+func (r *massCancelResults) Done(request_id string, count int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result := r.result(request_id)
+	select {
+	case <-result.done:
+		// a message replayed after a restart runs the mass cancel again
+	default:
+		result.count = count
+		close(result.done)
+	}
+}
+
+// Wait returns how many orders the mass cancel with the request id cancelled once it ran.
+func (r *massCancelResults) Wait(ctx context.Context, request_id string) (int, error) {
+	r.mutex.Lock()
+	result := r.result(request_id)
+	r.mutex.Unlock()
+
+	select {
+	case <-result.done:
+		return result.count, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
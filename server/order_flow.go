@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/zsmartex/pkg"
+
+	"github.com/zsmartex/finex/matching"
+	"github.com/zsmartex/finex/types"
+)
+
+type OrderFlowAction string
+
+const (
+	OrderFlowSubmit OrderFlowAction = "submit"
+	OrderFlowCancel OrderFlowAction = "cancel"
+)
+
+// OrderFlowEvent is a line of an order flow, an order submitted to the engine or the cancel of
+// a submitted order.
+type OrderFlowEvent struct {
+	Time   time.Time       `json:"time"`
+	Action OrderFlowAction `json:"action"`
+	// Order is the submitted order, it is created at the time of the event unless it says otherwise
+	Order *matching.Order `json:"order,omitempty"`
+	// ID is the id of the cancelled order
+	ID int64 `json:"id,omitempty"`
+}
+
+// ReadOrderFlow calls fn with the events of an order flow file in the order they are written. The
+// file is read as CSV when its extension is .csv and as JSON lines otherwise.
+func ReadOrderFlow(path string, fn func(event *OrderFlowEvent) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return readOrderFlowCSV(file, fn)
+	}
+
+	return readOrderFlowJSON(file, fn)
+}
+
+func readOrderFlowJSON(file io.Reader, fn func(event *OrderFlowEvent) error) error {
+	reader := bufio.NewReader(file)
+	for line_number := 1; ; line_number++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var event *OrderFlowEvent
+			if err := json.Unmarshal(line, &event); err != nil {
+				return fmt.Errorf("line %d: %w", line_number, err)
+			}
+
+			if err := fn(event); err != nil {
+				return fmt.Errorf("line %d: %w", line_number, err)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// readOrderFlowCSV reads an order flow whose first line names its columns: time, action and id,
+// then for the submitted orders side, type, price, quantity and optionally member_id, stop_price,
+// time_in_force and display_quantity. Times are RFC 3339 or milliseconds since the epoch, sides
+// are buy and sell or bid and ask.
+func readOrderFlowCSV(file io.Reader, fn func(event *OrderFlowEvent) error) error {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range []string{"time", "action", "id"} {
+		if _, found := columns[name]; !found {
+			return fmt.Errorf("order flow has no %s column", name)
+		}
+	}
+
+	for line_number := 2; ; line_number++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		event, err := parseOrderFlowRecord(columns, record)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line_number, err)
+		}
+
+		if err := fn(event); err != nil {
+			return fmt.Errorf("line %d: %w", line_number, err)
+		}
+	}
+}
+
+func parseOrderFlowRecord(columns map[string]int, record []string) (*OrderFlowEvent, error) {
+	value := func(name string) string {
+		if i, found := columns[name]; found && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+
+		return ""
+	}
+
+	decimalValue := func(name string) (decimal.Decimal, error) {
+		if len(value(name)) == 0 {
+			return decimal.Zero, nil
+		}
+
+		d, err := decimal.NewFromString(value(name))
+		if err != nil {
+			return decimal.Zero, fmt.Errorf("%s: %w", name, err)
+		}
+
+		return d, nil
+	}
+
+	created_at, err := parseOrderFlowTime(value("time"))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(value("id"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("id: %w", err)
+	}
+
+	event := &OrderFlowEvent{
+		Time:   created_at,
+		Action: OrderFlowAction(value("action")),
+		ID:     id,
+	}
+
+	if event.Action != OrderFlowSubmit {
+		return event, nil
+	}
+
+	order := &matching.Order{
+		Order: pkg.Order{
+			ID:   id,
+			Side: parseOrderFlowSide(value("side")),
+			Type: pkg.OrderType(value("type")),
+		},
+		TimeInForce: types.TimeInForce(value("time_in_force")),
+	}
+
+	if member_id := value("member_id"); len(member_id) > 0 {
+		if order.MemberID, err = strconv.ParseInt(member_id, 10, 64); err != nil {
+			return nil, fmt.Errorf("member_id: %w", err)
+		}
+	}
+
+	for name, field := range map[string]*decimal.Decimal{
+		"price":            &order.Price,
+		"stop_price":       &order.StopPrice,
+		"quantity":         &order.Quantity,
+		"display_quantity": &order.DisplayQuantity,
+	} {
+		if *field, err = decimalValue(name); err != nil {
+			return nil, err
+		}
+	}
+
+	event.Order = order
+
+	return event, nil
+}
+
+// parseOrderFlowSide returns the side of the engine for the sides of the API, buy and sell.
+func parseOrderFlowSide(value string) pkg.OrderSide {
+	switch types.OrderSide(value) {
+	case types.SideBuy:
+		return pkg.SideBuy
+	case types.SideSell:
+		return pkg.SideSell
+	default:
+		return pkg.OrderSide(value)
+	}
+}
+
+func parseOrderFlowTime(value string) (time.Time, error) {
+	if milliseconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(milliseconds).UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time: %w", err)
+	}
+
+	return t, nil
+}
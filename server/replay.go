@@ -0,0 +1,327 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/zsmartex/pkg"
+
+	"github.com/zsmartex/finex/matching"
+)
+
+// Replayer runs the entries of a journal through offline engines and reports
+// every event or book which differs from what the engine recorded.
+type Replayer struct {
+	Engines    map[pkg.Symbol]*matching.Engine
+	Entries    int64
+	Mismatches int64
+
+	report  io.Writer
+	outputs []*JournalOutput
+	now     time.Time
+}
+
+func NewReplayer(report io.Writer) *Replayer {
+	return &Replayer{
+		Engines: make(map[pkg.Symbol]*matching.Engine),
+		report:  report,
+	}
+}
+
+// Produce captures the events of the offline engines.
+func (r *Replayer) Produce(topic string, payload interface{}) error {
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	r.outputs = append(r.outputs, &JournalOutput{
+		Topic:   topic,
+		Payload: buf,
+	})
+
+	return nil
+}
+
+func (r *Replayer) Apply(entry *JournalEntry) error {
+	r.Entries++
+	r.outputs = make([]*JournalOutput, 0)
+	r.now = entry.CreatedAt
+
+	switch entry.Kind {
+	case JournalEntryInitialize:
+		r.initialize(entry)
+	case JournalEntryMessage:
+		if err := r.process(entry); err != nil {
+			return err
+		}
+	case JournalEntryCheckpoint:
+		for _, expected := range entry.OrderBooks {
+			engine := r.Engines[expected.Symbol]
+			if engine == nil {
+				r.mismatch(entry, "%v engine was never initialized", expected.Symbol.String())
+				continue
+			}
+
+			actual, err := engine.Snapshot()
+			if err != nil {
+				return err
+			}
+
+			for _, diff := range DiffOrderBooks(expected, actual, entry.CreatedAt) {
+				r.mismatch(entry, "%v %s", expected.Symbol.String(), diff)
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown journal entry kind: %s", entry.Kind)
+	}
+
+	// events of replayed messages were dropped by the engine
+	if entry.Replayed {
+		return nil
+	}
+
+	for _, diff := range diffOutputs(entry.Outputs, r.outputs) {
+		r.mismatch(entry, "%s", diff)
+	}
+
+	return nil
+}
+
+func (r *Replayer) initialize(entry *JournalEntry) {
+	market_price := decimal.Zero
+	if entry.MarketPrice != nil {
+		market_price = *entry.MarketPrice
+	}
+
+	market_config := matching.DefaultMarketConfig()
+	if entry.MarketConfig != nil {
+		market_config = *entry.MarketConfig
+	}
+
+	engine := matching.NewOfflineEngine(*entry.Symbol, market_price, market_config, r)
+	engine.Execute(func(ob *matching.OrderBook) {
+		ob.Silent = entry.Replayed
+		ob.Clock = r.Now
+	})
+
+	if previous := r.Engines[*entry.Symbol]; previous != nil {
+		previous.Stop()
+	}
+	r.Engines[*entry.Symbol] = engine
+
+	if len(entry.OrderBooks) > 0 {
+		engine.Restore(entry.OrderBooks[0])
+	} else {
+		for _, order := range entry.Orders {
+			engine.Load(order)
+		}
+	}
+
+	engine.SetInitialized()
+}
+
+func (r *Replayer) process(entry *JournalEntry) error {
+	var matching_payload matching.MatchingPayloadMessage
+	if err := json.Unmarshal(entry.Payload, &matching_payload); err != nil {
+		return err
+	}
+
+	var symbol pkg.Symbol
+	switch matching_payload.Action {
+	case pkg.ActionSubmit, pkg.ActionCancel, matching.ActionAmend:
+		symbol = matching_payload.Order.Symbol
+	case pkg.ActionCancelWithKey:
+		symbol = matching_payload.Key.Symbol
+	case matching.ActionStartAuction, matching.ActionEndAuction, matching.ActionSetTradingState:
+		symbol = matching_payload.Symbol
+	case matching.ActionMassCancel:
+		if matching_payload.MassCancel == nil {
+			return nil
+		}
+
+		symbols := []pkg.Symbol{matching_payload.Symbol}
+		if matching_payload.Symbol == (pkg.Symbol{}) {
+			symbols = sortedSymbols(r.Engines)
+		}
+
+		for _, symbol := range symbols {
+			engine := r.Engines[symbol]
+			if engine == nil {
+				continue
+			}
+
+			if err := engine.SetSilent(entry.Replayed); err != nil {
+				return err
+			}
+
+			if _, err := engine.MassCancel(matching_payload.MassCancel); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		// engines are created by their own initialize entries
+		return nil
+	}
+
+	engine := r.Engines[symbol]
+	if engine == nil {
+		return nil
+	}
+
+	if err := engine.SetSilent(entry.Replayed); err != nil {
+		return err
+	}
+
+	switch matching_payload.Action {
+	case pkg.ActionSubmit:
+		order := matching_payload.Order
+		if order.Price.IsNegative() || order.StopPrice.IsNegative() {
+			return nil
+		}
+
+		if oco_order := matching_payload.OcoOrder; oco_order != nil {
+			if oco_order.Price.IsNegative() || oco_order.StopPrice.IsNegative() {
+				return nil
+			}
+
+			return engine.SubmitOco(order, oco_order)
+		}
+
+		return engine.Submit(order)
+	case pkg.ActionCancel:
+		return engine.Cancel(matching_payload.Order)
+	case pkg.ActionCancelWithKey:
+		return engine.CancelWithKey(matching_payload.Key)
+	case matching.ActionAmend:
+		order := matching_payload.Order
+		if !order.Price.IsPositive() || !order.Quantity.IsPositive() {
+			return nil
+		}
+
+		return engine.Amend(matching_payload.Key, order)
+	case matching.ActionStartAuction:
+		return engine.StartAuction()
+	case matching.ActionEndAuction:
+		return engine.EndAuction()
+	case matching.ActionSetTradingState:
+		return engine.SetTradingState(matching_payload.TradingState)
+	}
+
+	return nil
+}
+
+// Now returns the time the engine processed the entry being replayed.
+func (r *Replayer) Now() time.Time {
+	return r.now
+}
+
+func (r *Replayer) mismatch(entry *JournalEntry, format string, args ...interface{}) {
+	r.Mismatches++
+	fmt.Fprintf(r.report, "#%d %s: %s\n", entry.Sequence, entry.Kind, fmt.Sprintf(format, args...))
+}
+
+func diffOutputs(expected, actual []*JournalOutput) []string {
+	diffs := make([]string, 0)
+
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			diffs = append(diffs, fmt.Sprintf("missing %s event %s", expected[i].Topic, expected[i].Payload))
+		case i >= len(expected):
+			diffs = append(diffs, fmt.Sprintf("unexpected %s event %s", actual[i].Topic, actual[i].Payload))
+		case expected[i].Topic != actual[i].Topic || !equalJSON(expected[i].Payload, actual[i].Payload):
+			diffs = append(diffs, fmt.Sprintf("%s event %s, replayed %s event %s", expected[i].Topic, expected[i].Payload, actual[i].Topic, actual[i].Payload))
+		}
+	}
+
+	return diffs
+}
+
+func equalJSON(a, b json.RawMessage) bool {
+	var abuf, bbuf bytes.Buffer
+	if json.Compact(&abuf, a) != nil || json.Compact(&bbuf, b) != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return bytes.Equal(abuf.Bytes(), bbuf.Bytes())
+}
+
+// DiffOrderBooks lists the differences between two books taken at the given time, orders are
+// compared in priority order. A halt over at that time may have been resumed by the engine
+// between two messages, it is compared as no halt.
+func DiffOrderBooks(expected, actual *matching.OrderBookSnapshot, at time.Time) []string {
+	diffs := make([]string, 0)
+
+	if !expected.MarketPrice.Equal(actual.MarketPrice) {
+		diffs = append(diffs, fmt.Sprintf("market price %s, replayed %s", expected.MarketPrice, actual.MarketPrice))
+	}
+
+	if expected.TradingState != actual.TradingState {
+		diffs = append(diffs, fmt.Sprintf("trading state %s, replayed %s", expected.TradingState, actual.TradingState))
+	}
+
+	if expected.Auction != actual.Auction {
+		diffs = append(diffs, fmt.Sprintf("auction %v, replayed %v", expected.Auction, actual.Auction))
+	}
+
+	if expected_halt, actual_halt := haltedUntil(expected, at), haltedUntil(actual, at); !expected_halt.Equal(actual_halt) {
+		diffs = append(diffs, fmt.Sprintf("halted until %v, replayed %v", expected_halt, actual_halt))
+	}
+
+	diffs = append(diffs, diffOrders("asks", expected.Asks, actual.Asks)...)
+	diffs = append(diffs, diffOrders("bids", expected.Bids, actual.Bids)...)
+	diffs = append(diffs, diffOrders("stop asks", expected.StopAsks, actual.StopAsks)...)
+	diffs = append(diffs, diffOrders("stop bids", expected.StopBids, actual.StopBids)...)
+	diffs = append(diffs, diffOrders("trailing stops", expected.TrailingStops, actual.TrailingStops)...)
+
+	return diffs
+}
+
+// haltedUntil returns the end of the halt of the book if it isn't over at the given time.
+func haltedUntil(snapshot *matching.OrderBookSnapshot, at time.Time) time.Time {
+	if !at.IsZero() && !at.Before(snapshot.HaltedUntil) {
+		return time.Time{}
+	}
+
+	return snapshot.HaltedUntil
+}
+
+func diffOrders(side string, expected, actual []*matching.Order) []string {
+	diffs := make([]string, 0)
+
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			diffs = append(diffs, fmt.Sprintf("%s: missing order %s", side, describeOrder(expected[i])))
+		case i >= len(expected):
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected order %s", side, describeOrder(actual[i])))
+		case !equalOrders(expected[i], actual[i]):
+			diffs = append(diffs, fmt.Sprintf("%s: order %s, replayed %s", side, describeOrder(expected[i]), describeOrder(actual[i])))
+		}
+	}
+
+	return diffs
+}
+
+func equalOrders(a, b *matching.Order) bool {
+	return a.ID == b.ID &&
+		a.Price.Equal(b.Price) &&
+		a.StopPrice.Equal(b.StopPrice) &&
+		a.Quantity.Equal(b.Quantity) &&
+		a.FilledQuantity.Equal(b.FilledQuantity) &&
+		a.TriggerPrice.Equal(b.TriggerPrice) &&
+		a.VisibleQuantity.Equal(b.VisibleQuantity)
+}
+
+func describeOrder(o *matching.Order) string {
+	return fmt.Sprintf("%d %s %s@%s filled %s", o.ID, o.Side, o.Quantity, o.Price, o.FilledQuantity)
+}
@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/zsmartex/pkg"
+
+	"github.com/zsmartex/finex/matching"
+)
+
+// SimulatorConfig is the market a simulation runs.
+type SimulatorConfig struct {
+	Symbol       pkg.Symbol
+	MarketPrice  decimal.Decimal
+	MarketConfig matching.MarketConfig
+	// DepthInterval is the time of the order flow between two depth snapshots, the depth is only
+	// written at the end of the order flow when it is zero
+	DepthInterval time.Duration
+	// DepthLevels is the number of price levels of each side in the depth snapshots
+	DepthLevels int64
+}
+
+// SimulatorRecord is a line of the outputs of a simulation, Time is the time of the order flow
+// event which produced it.
+type SimulatorRecord struct {
+	Time    time.Time   `json:"time"`
+	Payload interface{} `json:"payload"`
+}
+
+// SimulatorDepth is a depth snapshot of a simulation, the levels are from the best price.
+type SimulatorDepth struct {
+	Asks [][]decimal.Decimal `json:"asks"`
+	Bids [][]decimal.Decimal `json:"bids"`
+}
+
+// Simulator runs an order flow through an offline engine and writes its trades, the events of
+// its orders and its depth as JSON lines. It needs neither Kafka, Postgres, Redis nor Influx, the
+// same order flow always gives the same outputs.
+type Simulator struct {
+	Engine      *matching.Engine
+	Events      int64
+	Trades      int64
+	OrderEvents int64
+
+	config    SimulatorConfig
+	trades    *json.Encoder
+	orders    *json.Encoder
+	depth     *json.Encoder
+	submitted map[int64]*pkg.OrderKey
+	now       time.Time
+	nextDepth time.Time
+	// err is the first error writing the events, the engine doesn't check them
+	err error
+}
+
+func NewSimulator(config SimulatorConfig, trades, orders, depth io.Writer) *Simulator {
+	simulator := &Simulator{
+		config:    config,
+		trades:    json.NewEncoder(trades),
+		orders:    json.NewEncoder(orders),
+		depth:     json.NewEncoder(depth),
+		submitted: make(map[int64]*pkg.OrderKey),
+	}
+
+	simulator.Engine = matching.NewOfflineEngine(config.Symbol, config.MarketPrice, config.MarketConfig, simulator)
+	simulator.Engine.Execute(func(ob *matching.OrderBook) {
+		ob.Clock = simulator.Now
+	})
+	simulator.Engine.SetInitialized()
+
+	return simulator
+}
+
+// Produce writes the events of the engine, the trades and the events of the orders go to their own output.
+func (s *Simulator) Produce(topic string, payload interface{}) error {
+	record := &SimulatorRecord{
+		Time:    s.now,
+		Payload: payload,
+	}
+
+	encoder := s.orders
+	if _, trade := payload.(*matching.Trade); trade {
+		s.Trades++
+		encoder = s.trades
+	} else {
+		s.OrderEvents++
+	}
+
+	if err := encoder.Encode(record); err != nil && s.err == nil {
+		s.err = err
+	}
+
+	return s.err
+}
+
+// Now returns the time of the order flow event being run.
+func (s *Simulator) Now() time.Time {
+	return s.now
+}
+
+// Apply runs an event of the order flow, the events must be in time order.
+func (s *Simulator) Apply(event *OrderFlowEvent) error {
+	if event.Time.Before(s.now) {
+		return fmt.Errorf("event at %v is before the previous one at %v", event.Time, s.now)
+	}
+
+	if err := s.writeDepthBefore(event.Time); err != nil {
+		return err
+	}
+
+	s.Events++
+	s.now = event.Time
+
+	switch event.Action {
+	case OrderFlowSubmit:
+		order := event.Order
+		if order == nil {
+			return fmt.Errorf("submit event has no order")
+		}
+
+		if _, found := s.submitted[order.ID]; found {
+			return fmt.Errorf("order %d was already submitted", order.ID)
+		}
+
+		if order.Side != pkg.SideBuy && order.Side != pkg.SideSell {
+			return fmt.Errorf("order %d has an unknown side: %s", order.ID, order.Side)
+		}
+
+		order.Symbol = s.config.Symbol
+		if order.UUID == uuid.Nil {
+			order.UUID = simulatorUUID(order.ID)
+		}
+
+		if order.CreatedAt.IsZero() {
+			order.CreatedAt = event.Time
+		}
+
+		s.submitted[order.ID] = order.Key()
+		if err := s.Engine.Submit(order); err != nil {
+			return err
+		}
+	case OrderFlowCancel:
+		key, found := s.submitted[event.ID]
+		if !found {
+			return fmt.Errorf("order %d was never submitted", event.ID)
+		}
+
+		if err := s.Engine.CancelWithKey(key); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown order flow action: %s", event.Action)
+	}
+
+	return s.err
+}
+
+// Finish writes the depth at the end of the order flow and stops the engine.
+func (s *Simulator) Finish() error {
+	defer s.Engine.Stop()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	return s.writeDepth(s.now)
+}
+
+// writeDepthBefore writes the depth at the end of the interval of the previous event when the next
+// event is in a later one. The book doesn't change between the events so a single snapshot is
+// written for the intervals without events.
+func (s *Simulator) writeDepthBefore(t time.Time) error {
+	interval := s.config.DepthInterval
+	if interval <= 0 {
+		return nil
+	}
+
+	if !s.nextDepth.IsZero() && !t.Before(s.nextDepth) {
+		if err := s.writeDepth(s.nextDepth); err != nil {
+			return err
+		}
+	}
+
+	if s.nextDepth.IsZero() || !t.Before(s.nextDepth) {
+		s.nextDepth = t.Truncate(interval).Add(interval)
+	}
+
+	return nil
+}
+
+func (s *Simulator) writeDepth(t time.Time) error {
+	response, err := s.Engine.FetchOrderBook(s.config.DepthLevels, decimal.Zero)
+	if err != nil {
+		return err
+	}
+
+	depth := &SimulatorDepth{
+		Asks: make([][]decimal.Decimal, 0, len(response.Asks)),
+		Bids: make([][]decimal.Decimal, 0, len(response.Bids)),
+	}
+
+	for _, book_order := range response.Asks {
+		depth.Asks = append(depth.Asks, []decimal.Decimal{book_order.PriceQuantity[0].ToDecimal(), book_order.PriceQuantity[1].ToDecimal()})
+	}
+
+	for _, book_order := range response.Bids {
+		depth.Bids = append(depth.Bids, []decimal.Decimal{book_order.PriceQuantity[0].ToDecimal(), book_order.PriceQuantity[1].ToDecimal()})
+	}
+
+	return s.depth.Encode(&SimulatorRecord{
+		Time:    t,
+		Payload: depth,
+	})
+}
+
+// simulatorUUID derives the UUID of an order from its id so the outputs don't change between runs.
+func simulatorUUID(id int64) uuid.UUID {
+	var order_uuid uuid.UUID
+	binary.BigEndian.PutUint64(order_uuid[8:], uint64(id))
+
+	return order_uuid
+}
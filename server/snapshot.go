@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
+)
+
+var SNAPSHOT_PERIOD = 60 * time.Second
+
+const (
+	snapshotFileName  = "engine.snapshot"
+	processedFileName = "engine.processed"
+)
+
+// EngineSnapshot is a consistent cut of every order book, it is taken between two
+// messages of the matching topic and remembers the last offset it contains.
+type EngineSnapshot struct {
+	Offsets    map[int32]int64
+	CreatedAt  time.Time
+	OrderBooks []*matching.OrderBookSnapshot
+}
+
+// SnapshotEnabled returns true if the engine writes snapshots and restores from them on startup.
+func SnapshotEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("ENGINE_SNAPSHOT_ENABLED"))
+
+	return enabled
+}
+
+func snapshotDir() string {
+	dir := os.Getenv("ENGINE_SNAPSHOT_PATH")
+	if len(dir) == 0 {
+		dir = "snapshots"
+	}
+
+	return dir
+}
+
+// WriteSnapshot atomically replaces the latest snapshot on disk.
+func WriteSnapshot(snapshot *EngineSnapshot) error {
+	dir := snapshotDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, snapshotFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := gob.NewEncoder(file).Encode(snapshot); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(dir, snapshotFileName))
+}
+
+// LoadSnapshot reads the latest snapshot, it returns nil if none was written yet.
+func LoadSnapshot() (*EngineSnapshot, error) {
+	file, err := os.Open(filepath.Join(snapshotDir(), snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var snapshot *EngineSnapshot
+	if err := gob.NewDecoder(file).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// ProcessedOffsets keeps the last offset processed on each partition, messages up to it
+// had their events published already and are replayed silently after a restart. The offsets
+// are marked in memory and written by Flush, the messages processed since the last flush are
+// replayed with their events after a crash.
+type ProcessedOffsets struct {
+	Offsets map[int32]int64
+	dirty   bool
+}
+
+func OpenProcessedOffsets() (*ProcessedOffsets, error) {
+	dir := snapshotDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	processed := &ProcessedOffsets{
+		Offsets: make(map[int32]int64),
+	}
+
+	file, err := os.Open(filepath.Join(dir, processedFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return processed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&processed.Offsets); err != nil {
+		config.Logger.Errorf("Failed to read processed offsets: %v", err)
+	}
+
+	return processed, nil
+}
+
+// Contains returns true if the message was processed before.
+func (p *ProcessedOffsets) Contains(partition int32, offset int64) bool {
+	last, found := p.Offsets[partition]
+
+	return found && offset <= last
+}
+
+// Mark records the message as processed, it is written by the next Flush.
+func (p *ProcessedOffsets) Mark(partition int32, offset int64) {
+	p.Offsets[partition] = offset
+	p.dirty = true
+}
+
+// Flush replaces the file of the offsets with the ones marked, a crash while writing leaves
+// the previous file. The file is not synced since it only has to survive a crash of the process.
+func (p *ProcessedOffsets) Flush() error {
+	if !p.dirty {
+		return nil
+	}
+
+	dir := snapshotDir()
+
+	file, err := os.CreateTemp(dir, processedFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := json.NewEncoder(file).Encode(p.Offsets); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), filepath.Join(dir, processedFileName)); err != nil {
+		return err
+	}
+
+	p.dirty = false
+
+	return nil
+}
@@ -34,8 +34,53 @@ var (
 type OrderType string
 
 const (
-	TypeLimit  OrderType = "limit"
-	TypeMarket OrderType = "market"
+	TypeLimit        OrderType = "limit"
+	TypeMarket       OrderType = "market"
+	TypeStopLimit    OrderType = "stop_limit"
+	TypeStopMarket   OrderType = "stop_market"
+	TypeTrailingStop OrderType = "trailing_stop"
+)
+
+// IsLimit returns true if the order has a limit price once it's in the book.
+func (t OrderType) IsLimit() bool {
+	return t == TypeLimit || t == TypeStopLimit
+}
+
+// IsMarket returns true if the order is matched at any price once it's in the book.
+func (t OrderType) IsMarket() bool {
+	return t == TypeMarket || t == TypeStopMarket || t == TypeTrailingStop
+}
+
+// IsStop returns true if the order waits in the engine until its trigger price is reached.
+func (t OrderType) IsStop() bool {
+	return t == TypeStopLimit || t == TypeStopMarket || t == TypeTrailingStop
+}
+
+type TimeInForce string
+
+const (
+	TimeInForceGTC      TimeInForce = "gtc"
+	TimeInForceIOC      TimeInForce = "ioc"
+	TimeInForceFOK      TimeInForce = "fok"
+	TimeInForcePostOnly TimeInForce = "post_only"
+)
+
+type SelfTradePrevention string
+
+const (
+	SelfTradePreventionNone               SelfTradePrevention = "none"
+	SelfTradePreventionCancelNewest       SelfTradePrevention = "cancel_newest"
+	SelfTradePreventionCancelOldest       SelfTradePrevention = "cancel_oldest"
+	SelfTradePreventionCancelBoth         SelfTradePrevention = "cancel_both"
+	SelfTradePreventionDecrementAndCancel SelfTradePrevention = "decrement_and_cancel"
+)
+
+type MatchingAlgorithm string
+
+const (
+	MatchingAlgorithmFIFO            MatchingAlgorithm = "fifo"
+	MatchingAlgorithmProRata         MatchingAlgorithm = "pro_rata"
+	MatchingAlgorithmProRataTopOrder MatchingAlgorithm = "pro_rata_top_order"
 )
 
 type Config struct {
@@ -60,6 +105,38 @@ var (
 	MarketStateDisabled MarketState = "disabled"
 )
 
+// TradingState is what the matching engine of an enabled market accepts. A halted market accepts
+// neither orders nor cancels, a cancel only market only cancels and a post only market only
+// accepts limit orders which rest in the book.
+type TradingState string
+
+const (
+	TradingStateTrading    TradingState = "trading"
+	TradingStateHalted     TradingState = "halted"
+	TradingStateCancelOnly TradingState = "cancel_only"
+	TradingStatePostOnly   TradingState = "post_only"
+)
+
+// AcceptsOrders returns true if orders can be placed or amended, the markets without state are trading.
+func (s TradingState) AcceptsOrders() bool {
+	return s == "" || s == TradingStateTrading || s == TradingStatePostOnly
+}
+
+// AcceptsCancels returns true if the orders of the market can be cancelled.
+func (s TradingState) AcceptsCancels() bool {
+	return s != TradingStateHalted
+}
+
+// IsValid returns true if s is one of the trading states.
+func (s TradingState) IsValid() bool {
+	switch s {
+	case TradingStateTrading, TradingStateHalted, TradingStateCancelOnly, TradingStatePostOnly:
+		return true
+	default:
+		return false
+	}
+}
+
 type AccountType string
 
 var (
@@ -0,0 +1,61 @@
+package daemons
+
+import (
+	"time"
+
+	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
+	"github.com/zsmartex/finex/models"
+	"github.com/zsmartex/pkg"
+)
+
+// CANCEL_ON_DISCONNECT_INTERVAL is how often the countdowns of the members are checked.
+var CANCEL_ON_DISCONNECT_INTERVAL = time.Second
+
+// CancelOnDisconnect cancels the resting orders of the members whose countdown expired,
+// the countdown is disarmed once it fired.
+type CancelOnDisconnect struct {
+	Running bool
+}
+
+func NewCancelOnDisconnect() *CancelOnDisconnect {
+	return &CancelOnDisconnect{Running: true}
+}
+
+func (w *CancelOnDisconnect) Stop() {
+	w.Running = false
+}
+
+func (w *CancelOnDisconnect) Start() {
+	for w.Running {
+		w.Process(time.Now())
+
+		time.Sleep(CANCEL_ON_DISCONNECT_INTERVAL)
+	}
+}
+
+// Process fires the countdowns expired at now, they are taken off the armed countdowns by the
+// same Redis script which finds them so a refresh arriving meanwhile is never lost.
+func (w *CancelOnDisconnect) Process(now time.Time) {
+	member_ids, err := models.PopExpiredCountdowns(now)
+	if err != nil {
+		config.Logger.Errorf("failed to pop the expired countdowns: %v", err)
+		return
+	}
+
+	for _, member_id := range member_ids {
+		w.CancelOrders(member_id)
+	}
+}
+
+// CancelOrders sends a mass cancel of every order of a member to the matching engines,
+// the engines of the halted markets keep them.
+func (w *CancelOnDisconnect) CancelOrders(member_id int64) {
+	config.Logger.Infof("countdown of member %d expired, cancelling its orders", member_id)
+
+	config.KafkaProducer.Produce("matching", map[string]interface{}{
+		"action":      matching.ActionMassCancel,
+		"symbol":      pkg.Symbol{},
+		"mass_cancel": &matching.MassCancel{MemberID: member_id},
+	})
+}
@@ -3,14 +3,19 @@ package engines
 import (
 	"encoding/json"
 
+	"github.com/shopspring/decimal"
+
 	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
 	"github.com/zsmartex/finex/models"
 	"github.com/zsmartex/pkg"
 )
 
 type OrderProcessorPayloadMessage struct {
-	Action pkg.PayloadAction `json:"action"`
-	ID     int64             `json:"id"`
+	Action   pkg.PayloadAction `json:"action"`
+	ID       int64             `json:"id"`
+	Quantity decimal.Decimal   `json:"quantity"`
+	Price    decimal.Decimal   `json:"price"`
 }
 
 type OrderProcessorWorker struct {
@@ -45,6 +50,14 @@ func (w OrderProcessorWorker) Process(payload []byte) error {
 		err = models.SubmitOrder(id)
 	case pkg.ActionCancel:
 		err = models.CancelOrder(id)
+	case matching.ActionReject:
+		err = models.RejectOrder(id)
+	case matching.ActionTrigger:
+		err = models.TriggerOrder(id)
+	case matching.ActionDecrement:
+		err = models.DecrementOrder(id, order_processor_payload.Quantity)
+	case matching.ActionAmend:
+		err = models.AmendOrder(id, order_processor_payload.Price, order_processor_payload.Quantity)
 	}
 
 	if err != nil {
@@ -13,6 +13,7 @@ import (
 
 	"github.com/shopspring/decimal"
 	"github.com/zsmartex/finex/config"
+	"github.com/zsmartex/finex/matching"
 	"github.com/zsmartex/finex/models"
 	"github.com/zsmartex/finex/types"
 )
@@ -22,7 +23,7 @@ type TradeExecutorWorker struct {
 }
 
 type TradeExecutor struct {
-	TradePayload *pkg.Trade
+	TradePayload *matching.Trade
 	MakerOrder   *models.Order
 	TakerOrder   *models.Order
 }
@@ -35,6 +36,25 @@ func (w *TradeExecutorWorker) Process(payload []byte) error {
 	w.ExecutorMutex.Lock()
 	defer w.ExecutorMutex.Unlock()
 
+	// the amends and the cancels of the engine are settled in order with the trades
+	var engine_payload struct {
+		Action   pkg.PayloadAction `json:"action"`
+		ID       int64             `json:"id"`
+		Price    decimal.Decimal   `json:"price"`
+		Quantity decimal.Decimal   `json:"quantity"`
+	}
+
+	if err := json.Unmarshal(payload, &engine_payload); err != nil {
+		return err
+	}
+
+	switch engine_payload.Action {
+	case matching.ActionAmend:
+		return models.ApplyAmend(engine_payload.ID, engine_payload.Price, engine_payload.Quantity)
+	case pkg.ActionCancel:
+		return models.CancelOrder(engine_payload.ID)
+	}
+
 	trade_executor := &TradeExecutor{
 		MakerOrder: &models.Order{},
 		TakerOrder: &models.Order{},
@@ -100,9 +120,9 @@ func (t *TradeExecutor) VaildateTrade() error {
 		bid_order = t.MakerOrder
 	}
 
-	if !ask_order_fake && ask_order.OrdType == types.TypeLimit && ask_order.Price.Decimal.GreaterThan(t.TradePayload.Price) {
+	if !ask_order_fake && ask_order.OrdType.IsLimit() && ask_order.Price.Decimal.GreaterThan(t.TradePayload.Price) {
 		return fmt.Errorf("ask price exceeds strike price")
-	} else if !bid_order_fake && bid_order.OrdType == types.TypeLimit && bid_order.Price.Decimal.LessThan(t.TradePayload.Price) {
+	} else if !bid_order_fake && bid_order.OrdType.IsLimit() && bid_order.Price.Decimal.LessThan(t.TradePayload.Price) {
 		return fmt.Errorf("bid price is less than strike price")
 	} else if !t.IsMakerOrderFake() && t.MakerOrder.State != models.StateWait {
 		return fmt.Errorf("maker order state isn't equal to «wait» (%v)", t.MakerOrder.State)
@@ -110,11 +130,9 @@ func (t *TradeExecutor) VaildateTrade() error {
 		return fmt.Errorf("taker order state isn't equal to «wait» (%v)", t.TakerOrder.State)
 	} else if !t.TradePayload.Total.IsPositive() {
 		return fmt.Errorf("not enough funds")
-	} else if !t.IsMakerOrderFake() && !t.IsTakerOrderFake() && decimal.Min(t.MakerOrder.Volume, t.TakerOrder.Volume).LessThan(t.TradePayload.Quantity) {
-		return fmt.Errorf("not enough funds")
-	} else if !t.IsMakerOrderFake() && t.MakerOrder.Volume.LessThan(t.TradePayload.Quantity) {
+	} else if !t.IsMakerOrderFake() && !t.MakerOrder.IsFillable(t.TradePayload.Quantity, t.TradePayload.Total) {
 		return fmt.Errorf("not enough funds")
-	} else if !t.IsTakerOrderFake() && t.TakerOrder.Volume.LessThan(t.TradePayload.Quantity) {
+	} else if !t.IsTakerOrderFake() && !t.TakerOrder.IsFillable(t.TradePayload.Quantity, t.TradePayload.Total) {
 		return fmt.Errorf("not enough funds")
 	}
 
@@ -268,23 +286,49 @@ func (t *TradeExecutor) Strike(trade *models.Trade, order *models.Order, outcome
 		return err
 	}
 
-	order.Volume = order.Volume.Sub(trade.Amount)
+	if order.IsQuoteOrder() {
+		// the volume of an order placed by quote volume is what its trades bought
+		order.OriginVolume = order.OriginVolume.Add(trade.Amount)
+	} else {
+		order.Volume = order.Volume.Sub(trade.Amount)
+	}
 	order.Locked = order.Locked.Sub(outcome_value)
 	order.FundsReceived = income_value.Add(order.FundsReceived)
 	order.TradesCount += 1
 
-	if order.Volume.IsZero() {
+	if order.IsQuoteOrder() {
+		// the budget is spent, what the engine can't spend is given back with its last trade
+		if order.Locked.IsZero() {
+			order.State = models.StateDone
+		}
+	} else if order.Volume.IsZero() {
 		order.State = models.StateDone
 
 		// Unlock not used funds.
-		if !order.Locked.IsZero() {
-			if err := outcome_account.UnlockFunds(tx, order.Locked); err != nil {
+		if unlocked := order.ReleasableFunds(tx); !unlocked.IsZero() {
+			if err := outcome_account.UnlockFunds(tx, unlocked); err != nil {
 				return err
 			}
 		}
-	} else if order.OrdType == types.TypeMarket && order.Locked.IsZero() {
+	} else if order.OrdType.IsMarket() && order.Locked.IsZero() {
 		order.State = models.StateCancel
 		order.RecordCancelOperations()
+
+		// the other order of an OCO pair may have locked more than this one
+		if unlocked := order.ReleasableFunds(tx); unlocked.IsPositive() {
+			if err := outcome_account.UnlockFunds(tx, unlocked); err != nil {
+				return err
+			}
+
+			order.RecordUnlockOperations(unlocked)
+		}
+	}
+
+	// the engine cancelled what is left of the order after this trade
+	if t.TradePayload.Cancels(order.ID) && order.State == models.StateWait {
+		if err := order.Close(tx, outcome_account, models.StateCancel); err != nil {
+			return err
+		}
 	}
 
 	return nil